@@ -3,16 +3,15 @@ package broker
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 
 	"github.com/GSA/ec2-broker/config"
 	"github.com/GSA/ec2-broker/service"
+	"github.com/GSA/ec2-broker/store"
 	"github.com/pivotal-cf/brokerapi"
-
-	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 /*
@@ -21,25 +20,66 @@ EC2Broker stores the baseline information about the EC2 Broker
 type EC2Broker struct {
 	BrokerName string `json:"broker_name"`
 	Manager    InstanceManager
+	Store      store.Store
 }
 
+// The operation types recorded in the store
+const (
+	operationProvision   = "provision"
+	operationDeprovision = "deprovision"
+	operationBind        = "bind"
+	operationUnbind      = "unbind"
+	operationUpdate      = "update"
+)
+
 /*
 ProvisionParameters is the JSON format for the parameters being passed into the provision API call
 */
 type ProvisionParameters struct {
-	AMIID           string `json:"ami_id"`
-	SecurityGroupID string `json:"security_group_id"`
-	SubnetID        string `json:"subnet_id"`
-	AssignPublicIP  bool   `json:"assign_public_ip"`
+	AMIID            string             `json:"ami_id"`
+	SecurityGroupID  string             `json:"security_group_id"`
+	SecurityGroupIDs []string           `json:"security_group_ids,omitempty"`
+	SubnetID         string             `json:"subnet_id"`
+	AssignPublicIP   bool               `json:"assign_public_ip"`
+	ElasticIP        bool               `json:"elastic_ip,omitempty"`
+	Image            string             `json:"image,omitempty"`
+	UserData         string             `json:"user_data,omitempty"`
+	InstanceProfile  string             `json:"instance_profile,omitempty"`
+	Volumes          []VolumeParameters `json:"volumes,omitempty"`
+	Tags             map[string]string  `json:"tags,omitempty"`
 }
 
 /*
-New creates a new broker and connects to AWS based on the current environment.
+VolumeParameters describes an EBS data volume to launch with the instance. The device name and volume type default to
+the next free device from /dev/sdf and the first type the plan allows.
 */
-func New(name string, m InstanceManager) (*EC2Broker, error) {
+type VolumeParameters struct {
+	DeviceName string `json:"device_name,omitempty"`
+	SizeGB     int64  `json:"size_gb"`
+	VolumeType string `json:"volume_type,omitempty"`
+	IOPS       int64  `json:"iops,omitempty"`
+	Encrypted  bool   `json:"encrypted,omitempty"`
+}
+
+// All the security groups requested, without duplicates
+func (p ProvisionParameters) securityGroups() []string {
+	groups := []string{}
+	for _, group := range append([]string{p.SecurityGroupID}, p.SecurityGroupIDs...) {
+		if group != "" && !stringIn(group, groups) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+/*
+New creates a new broker and connects to AWS based on the current environment. Every operation is recorded in the given store.
+*/
+func New(name string, m InstanceManager, s store.Store) (*EC2Broker, error) {
 	return &EC2Broker{
 		BrokerName: name,
 		Manager:    m,
+		Store:      s,
 	}, nil
 }
 
@@ -56,12 +96,21 @@ func (b *EC2Broker) Services(context context.Context) []brokerapi.Service {
 Provision a new EC2 instance using the parameters provided.
 
 The parameters include the AMI ID to launch, the Subnet to launch it into, and the Security Group to associate it with. The EC2 instance will have a tag called
-brokerInstance with a value matching instanceID associated with it. The parameters should be structed as follows:
+brokerInstance with a value matching instanceID associated with it, and a Name tag with the service instance's name when the Cloud Controller's context object
+gives it. The parameters should be structed as follows:
 
 "parameters: "{
   "ami_id": "<amazon AMI ID>",
+  "image": "<image family>[@<version>], in place of ami_id",
   "subnet_id": "<subnet ID>",
-  "security_group_id": "<security group ID>"
+  "security_group_id": "<security group ID>",
+  "security_group_ids": ["<additional security group ID>"],
+  "assign_public_ip": false,
+  "elastic_ip": false,
+  "user_data": "#cloud-config\n...",
+  "instance_profile": "<instance profile name or ARN>",
+  "volumes": [{"size_gb": 100, "volume_type": "gp2", "encrypted": true}],
+  "tags": {"Project": "<project>"}
 }
 
 */
@@ -74,25 +123,152 @@ func (b *EC2Broker) Provision(context context.Context, instanceID string, detail
 		logger.Info("failed-provision-parse-parameters", lager.Data{"error": err.Error()})
 		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrRawParamsInvalid
 	}
+	if record, err := b.Store.Get(instanceID); err == nil && record.AWSInstanceID != "" {
+		return b.repeatProvision(record, details, parameters)
+	}
+	var detail string
+	if parameters.Image != "" {
+		if parameters.AMIID != "" {
+			return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("Provide either an AMI ID or an image, not both")
+		}
+		plan, err := findPlan(conf, details.PlanID)
+		if err == nil {
+			parameters.AMIID, err = b.Manager.ResolveAWSImage(plan, parameters.Image)
+		}
+		if err != nil {
+			logger.Info("failed-provision-resolve-image", lager.Data{"image": parameters.Image, "error": err.Error()})
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+		detail = fmt.Sprintf("image %s resolved to %s", parameters.Image, parameters.AMIID)
+	}
 	logger.Info("attempting-provision", lager.Data{
 		"plan_id":             details.PlanID,
 		"service_instance_id": instanceID,
 		"ami_id":              parameters.AMIID,
+		"image":               parameters.Image,
 		"security_group_id":   parameters.SecurityGroupID,
+		"security_group_ids":  parameters.SecurityGroupIDs,
 		"subnet_id":           parameters.SubnetID,
 		"assign_public_ip":    parameters.AssignPublicIP,
+		"elastic_ip":          parameters.ElasticIP,
 	})
-	awsID, err := b.Manager.ProvisionAWSInstance(details.PlanID, parameters.AMIID, parameters.SecurityGroupID, parameters.SubnetID, parameters.AssignPublicIP, instanceID)
+	provisionContext := newProvisionContext(details, platformContext(context))
+	awsID, err := b.Manager.ProvisionAWSInstance(instanceID, provisionContext, parameters)
 	if err != nil {
 		logger.Info("failed-provision-creation", lager.Data{"error": err.Error()})
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
 	logger.Info("created-instance", lager.Data{"aws_instance_id": awsID, "instance_id": instanceID})
+	updateStore(b.Store, instanceID, func(record *store.Instance) {
+		record.AWSInstanceID = awsID
+		record.ServiceID = details.ServiceID
+		record.PlanID = details.PlanID
+		record.OrganizationGUID = details.OrganizationGUID
+		record.SpaceGUID = details.SpaceGUID
+		record.Name = provisionContext.InstanceName
+		record.OrganizationName = provisionContext.OrganizationName
+		record.SpaceName = provisionContext.SpaceName
+		// The parameters are recorded as launched, with any image resolved to its AMI
+		if data, err := json.Marshal(parameters); err == nil {
+			record.Parameters = data
+		}
+		op := record.AddOperation(operationProvision, string(brokerapi.InProgress), detail)
+		op.Detail = detail
+	})
 
 	return brokerapi.ProvisionedServiceSpec{
 		IsAsync:       true,
 		DashboardURL:  conf.DashboardURL,
-		OperationData: fmt.Sprintf("p_%s", instanceID)}, nil
+		OperationData: newOperationToken(operationProvision, instanceID).String()}, nil
+}
+
+// The context of a provision request, from its details and the Cloud Controller's context object
+func newProvisionContext(details brokerapi.ProvisionDetails, platform PlatformContext) ProvisionContext {
+	provisionContext := ProvisionContext{
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		InstanceName:     platform.InstanceName,
+		OrganizationName: platform.OrganizationName,
+		SpaceName:        platform.SpaceName,
+	}
+	if provisionContext.OrganizationGUID == "" {
+		provisionContext.OrganizationGUID = platform.OrganizationGUID
+	}
+	if provisionContext.SpaceGUID == "" {
+		provisionContext.SpaceGUID = platform.SpaceGUID
+	}
+	return provisionContext
+}
+
+// Answers a provision request for an instance the broker has already launched. The Cloud Controller retries requests, so
+// the same request gets the same answer without launching anything: accepted while the instance is still starting, and
+// created once it is running. Any other request for the instance is a conflict.
+func (b *EC2Broker) repeatProvision(record *store.Instance, details brokerapi.ProvisionDetails, parameters ProvisionParameters) (brokerapi.ProvisionedServiceSpec, error) {
+	logger := config.GetLogger()
+	conf := config.GetConfiguration()
+	var recorded ProvisionParameters
+	json.Unmarshal(record.Parameters, &recorded)
+	// Requests name the image; the recorded AMI is what it resolved to
+	if recorded.Image != "" {
+		recorded.AMIID = ""
+	}
+	recordedData, _ := json.Marshal(recorded)
+	requestedData, _ := json.Marshal(parameters)
+	// A record filled in from the instance's tags has neither the parameters nor the provision that launched it, so the
+	// request is matched on its plan, organization and space alone and answered from the instance's last known state
+	adopted := len(record.Parameters) == 0
+	same := record.PlanID == details.PlanID &&
+		record.OrganizationGUID == details.OrganizationGUID &&
+		record.SpaceGUID == details.SpaceGUID &&
+		(adopted || string(recordedData) == string(requestedData))
+	var state brokerapi.LastOperationState
+	if adopted {
+		state = operationHandlers[operationProvision].state(record.AWSState)
+	} else if op := record.LastOperation(operationProvision); op != nil {
+		state = brokerapi.LastOperationState(op.State)
+	}
+	if !same || state == "" || record.LastOperation(operationDeprovision) != nil {
+		logger.Info("failed-provision-conflict", lager.Data{"instance_id": record.ID, "same_request": same})
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+	logger.Info("repeated-provision", lager.Data{"instance_id": record.ID, "state": state})
+	switch state {
+	case brokerapi.InProgress:
+		return brokerapi.ProvisionedServiceSpec{
+			IsAsync:       true,
+			DashboardURL:  conf.DashboardURL,
+			OperationData: newOperationToken(operationProvision, record.ID).String()}, nil
+	case brokerapi.Succeeded:
+		return brokerapi.ProvisionedServiceSpec{DashboardURL: conf.DashboardURL}, nil
+	default:
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+}
+
+// Finishes a provision once the instance is running by associating the Elastic IP allocated for it, if one was requested
+func (b *EC2Broker) completeProvision(instanceID string) (string, error) {
+	var parameters ProvisionParameters
+	record, err := b.Store.Get(instanceID)
+	if err != nil || json.Unmarshal(record.Parameters, &parameters) != nil || !parameters.ElasticIP {
+		return "", nil
+	}
+	address, err := b.Manager.AssociateAWSElasticIP(instanceID)
+	if err != nil {
+		return "", fmt.Errorf("failed associating Elastic IP: %s", err)
+	}
+	return fmt.Sprintf("Elastic IP %s associated", address), nil
+}
+
+// Finishes a deprovision once the instance is gone by releasing the addresses the broker allocated for it, which would
+// otherwise outlive it
+func (b *EC2Broker) completeDeprovision(instanceID string) (string, error) {
+	err := b.Manager.ReleaseAWSElasticIP(instanceID)
+	if err != nil {
+		return "", fmt.Errorf("failed releasing addresses: %s", err)
+	}
+	return "", nil
 }
 
 /*
@@ -103,11 +279,35 @@ No parameters are required. The EC2 instance will be terminated. It's the respon
 func (b *EC2Broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
 	logger := config.GetLogger()
 	logger.Info("deprovision", lager.Data{"instanceID": instanceID})
-	_, err := b.Manager.TerminateAWSInstance(instanceID)
+	awsStatus, err := b.Manager.TerminateAWSInstance(instanceID)
 	if err != nil {
+		// A recorded instance left running is reported by reconciliation
+		if _, getErr := b.Store.Get(instanceID); getErr == nil && err != brokerapi.ErrInstanceDoesNotExist {
+			updateStore(b.Store, instanceID, func(record *store.Instance) {
+				record.AddOperation(operationDeprovision, string(brokerapi.Failed), err.Error())
+			})
+		}
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
-	return brokerapi.DeprovisionServiceSpec{OperationData: fmt.Sprintf("d_%s", instanceID), IsAsync: true}, nil
+	updateStore(b.Store, instanceID, func(record *store.Instance) {
+		record.AddOperation(operationDeprovision, string(brokerapi.InProgress), awsStatus)
+	})
+	return brokerapi.DeprovisionServiceSpec{OperationData: newOperationToken(operationDeprovision, instanceID).String(), IsAsync: true}, nil
+}
+
+/*
+BindingCredentials are the credentials handed to a bound application. Host is the public IP when the instance has one, and
+the private IP otherwise. PrivateKey is only set when the broker generated the key pair for the binding.
+*/
+type BindingCredentials struct {
+	Host        string `json:"host"`
+	PrivateIP   string `json:"private_ip"`
+	PublicIP    string `json:"public_ip,omitempty"`
+	ElasticIP   string `json:"elastic_ip,omitempty"`
+	Username    string `json:"username"`
+	URI         string `json:"uri"`
+	Fingerprint string `json:"fingerprint"`
+	PrivateKey  string `json:"private_key,omitempty"`
 }
 
 /*
@@ -118,69 +318,212 @@ public SSH key to allow access to the machine. The key text should be directly a
   "public_key": "<key text>"
 }
 
-After a Bind call is made, another tag will be placed on the EC2 instance called brokerBind with the value being the bindingID
+If no public key is given, the broker generates a key pair for this binding alone and returns the private key in the credentials. Either way, the key is installed for the plan's SSH user through the instance manager's command channel. After a Bind call is made, another tag will be placed on the EC2
+instance called brokerBind:<bindingID> with the value being the SSH user.
 */
 func (b *EC2Broker) Bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
-	return brokerapi.Binding{}, errors.New("Bind: function not implemented")
+	logger := config.GetLogger()
+	conf := config.GetConfiguration()
+	logger.Info("bind", lager.Data{"instanceID": instanceID, "bindingID": bindingID})
+	if !bindingIDPattern.MatchString(bindingID) {
+		return brokerapi.Binding{}, fmt.Errorf("Invalid binding ID: %s", bindingID)
+	}
+	var publicKey, privateKey string
+	var err error
+	if keyText, ok := details.Parameters["public_key"]; ok {
+		keyString, _ := keyText.(string)
+		publicKey, err = parsePublicKey(keyString)
+		if err != nil {
+			logger.Info("failed-bind-parse-key", lager.Data{"error": err.Error()})
+			return brokerapi.Binding{}, err
+		}
+	} else {
+		publicKey, privateKey, err = generateKeyPair()
+		if err != nil {
+			logger.Error("failed-bind-generate-key", err)
+			return brokerapi.Binding{}, err
+		}
+	}
+	plan, err := findPlan(conf, details.PlanID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	username := sshUsername(plan)
+	address, err := b.Manager.BindAWSInstance(instanceID, bindingID, username, publicKey)
+	if err != nil {
+		logger.Info("failed-bind", lager.Data{"error": err.Error()})
+		return brokerapi.Binding{}, err
+	}
+	host := address.PublicIP
+	if host == "" {
+		host = address.PrivateIP
+	}
+	updateStore(b.Store, instanceID, func(record *store.Instance) {
+		if record.Bindings == nil {
+			record.Bindings = make(map[string]store.Binding)
+		}
+		record.Bindings[bindingID] = store.Binding{
+			ID:          bindingID,
+			AppGUID:     details.AppGUID,
+			Username:    username,
+			Fingerprint: keyFingerprint(publicKey),
+			CreatedAt:   time.Now().UTC(),
+		}
+		record.AddOperation(operationBind, string(brokerapi.Succeeded), bindingID)
+	})
+	return brokerapi.Binding{
+		Credentials: BindingCredentials{
+			Host:        host,
+			PrivateIP:   address.PrivateIP,
+			PublicIP:    address.PublicIP,
+			ElasticIP:   address.ElasticIP,
+			Username:    username,
+			URI:         fmt.Sprintf("ssh://%s@%s", username, host),
+			Fingerprint: keyFingerprint(publicKey),
+			PrivateKey:  privateKey,
+		},
+	}, nil
 }
 
 /*
-Unbind the EC2 instance from the caller.
-
-Currently does nothing, though it should remove the key from the authorized keys....
+Unbind the EC2 instance from the caller, revoking the key added by the binding (whether brought by the user or generated) from the authorized keys and removing the brokerBind:<bindingID> tag.
 */
 func (b *EC2Broker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
-	return errors.New("Unbind: function not implemented")
+	logger := config.GetLogger()
+	logger.Info("unbind", lager.Data{"instanceID": instanceID, "bindingID": bindingID})
+	if !bindingIDPattern.MatchString(bindingID) {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+	err := b.Manager.UnbindAWSInstance(instanceID, bindingID)
+	if err != nil {
+		return err
+	}
+	updateStore(b.Store, instanceID, func(record *store.Instance) {
+		delete(record.Bindings, bindingID)
+		record.AddOperation(operationUnbind, string(brokerapi.Succeeded), bindingID)
+	})
+	return nil
 }
 
 /*
-Update does nothing. The plans are currently not updatable.
+Update changes the parameters of an instance, moves it to a new plan, or both.
+
+The security groups, public IP and custom tags can be changed with the same parameters used by Provision, and are validated the same way. A public IP is added by
+associating an address allocated by the broker. These changes are made immediately.
+
+A new plan must allow the instance's AMI, subnet and security groups. The instance is stopped, changed to the new plan's instance type and started again,
+which LastOperation tracks through each step.
 */
 func (b *EC2Broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+	logger := config.GetLogger()
+	conf := config.GetConfiguration()
+	logger.Info("update", lager.Data{"instanceID": instanceID, "plan_id": details.PlanID, "previous_plan_id": details.PreviousValues.PlanID})
+	currentPlanID := details.PreviousValues.PlanID
+	if record, err := b.Store.Get(instanceID); err == nil && record.PlanID != "" {
+		currentPlanID = record.PlanID
+	}
+	planChange := details.PlanID != "" && details.PlanID != currentPlanID
+	if !planChange && len(details.Parameters) == 0 {
+		return brokerapi.UpdateServiceSpec{}, nil
+	}
+	if planChange && !asyncAllowed {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+	planID := currentPlanID
+	if planChange {
+		planID = details.PlanID
+	}
+	service, plan, err := conf.FindPlan(planID)
+	if err == nil && planChange {
+		// Plans can only change within a service
+		if current, _, findErr := conf.FindPlan(currentPlanID); findErr == nil && current.ID != service.ID {
+			logger.Info("failed-update-plan-service", lager.Data{"instance_id": instanceID, "plan_id": planID, "service_id": service.ID})
+			return brokerapi.UpdateServiceSpec{}, brokerapi.ErrPlanChangeNotSupported
+		}
+	}
+	if err == nil {
+		plan, err = b.Manager.ResolvePlan(plan)
+	}
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	// A plan change that cannot go ahead must fail before any of the parameters are applied
+	var instance *InstanceDescription
+	if planChange {
+		instance, err = b.checkPlanChange(instanceID, plan)
+		if err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+	}
+	if len(details.Parameters) > 0 {
+		err = b.updateParameters(instanceID, plan, details.Parameters)
+		if err != nil {
+			logger.Info("failed-update-parameters", lager.Data{"instanceID": instanceID, "error": err.Error()})
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+	}
+	if !planChange {
+		return brokerapi.UpdateServiceSpec{}, nil
+	}
+	return b.startPlanChange(instanceID, plan, instance)
 }
 
 /*
-LastOperation will look up the current state of an existing instance from AWS and provide a status back to the user
+LastOperation will look up the current state of an existing instance from AWS and provide a status back to the user. The operation data is an operation
+token naming the type of operation, which selects the handler that maps the AWS state to the state of the operation. The record of an instance whose
+deprovision has succeeded is deleted from the store.
 */
 func (b *EC2Broker) LastOperation(context context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
 	logger := config.GetLogger()
 	logger.Info("last-operation", lager.Data{"operationData": operationData, "instanceID": instanceID})
-	var forProvision bool
-	if operationData == "p_"+instanceID {
-		forProvision = true
-	} else if operationData == "d_"+instanceID {
-		forProvision = false
-	} else {
+	token, err := parseOperationToken(operationData, instanceID)
+	if err != nil {
+		return brokerapi.LastOperation{}, brokerapi.ErrRawParamsInvalid
+	}
+	handler, ok := operationHandlers[token.Type]
+	if !ok {
 		return brokerapi.LastOperation{}, brokerapi.ErrRawParamsInvalid
 	}
-	awsStatus, err := b.Manager.GetAWSInstanceStatus(instanceID)
+	if handler.poll != nil {
+		return handler.poll(b, instanceID, token)
+	}
+	status, err := b.Manager.GetAWSInstanceStatus(instanceID)
 	if err != nil {
 		logger.Error("getting-status", err)
 		return brokerapi.LastOperation{}, fmt.Errorf("Unable to look up status for %s", instanceID)
 	}
-	logger.Info("last-operation-status", lager.Data{"operationData": operationData, "instanceID": instanceID, "awsStatus": awsStatus})
-	var state brokerapi.LastOperationState
-	if forProvision {
-		// for provisioning, pending => in progress, running => succeeded, else failed
-		if awsStatus == ec2.InstanceStateNamePending {
-			state = brokerapi.InProgress
-		} else if awsStatus == ec2.InstanceStateNameRunning {
-			state = brokerapi.Succeeded
-		} else {
-			logger.Error("last-operation-failed", errors.New("bad provision status"), lager.Data{"operationData": operationData, "instanceID": instanceID, "awsStatus": awsStatus})
-			state = brokerapi.Failed
+	description := status.Description()
+	state := handler.state(status.State)
+	if state == brokerapi.Succeeded && handler.complete != nil {
+		detail, err := handler.complete(b, instanceID)
+		if err != nil {
+			// Keep the operation going so the next poll tries again
+			logger.Error("last-operation-completing", err, lager.Data{"operationData": operationData, "instanceID": instanceID})
+			state, description = brokerapi.InProgress, fmt.Sprintf("%s; %s", description, err)
+		} else if detail != "" {
+			description = fmt.Sprintf("%s; %s", description, detail)
 		}
-	} else {
-		// for deprovisioning, stopping => in progress, stopped, terminated => succeeded, else failed
-		if awsStatus == ec2.InstanceStateNameShuttingDown || awsStatus == ec2.InstanceStateNameStopping {
-			state = brokerapi.InProgress
-		} else if awsStatus == ec2.InstanceStateNameStopped || awsStatus == ec2.InstanceStateNameTerminated {
-			state = brokerapi.Succeeded
-		} else {
-			logger.Error("last-operation-failed", errors.New("bad deprovision status"), lager.Data{"operationData": operationData, "instanceID": instanceID, "awsStatus": awsStatus})
-			state = brokerapi.Failed
+	}
+	logger.Info("last-operation-status", lager.Data{"operationData": operationData, "instanceID": instanceID, "awsStatus": status.State, "reason": status.ReasonCode})
+	if state == brokerapi.Failed {
+		logger.Error("last-operation-failed", fmt.Errorf("bad %s status", token.Type), lager.Data{"operationData": operationData, "instanceID": instanceID, "awsStatus": status.State, "errorCode": status.ErrorCode()})
+	}
+	if record, err := b.Store.Get(instanceID); err == nil {
+		if op := record.LastOperation(token.Type); op != nil && op.Detail != "" {
+			description = fmt.Sprintf("%s; %s", description, op.Detail)
+		}
+	}
+	if state == brokerapi.Succeeded && handler.forget {
+		// Nothing is left to bind, update or reconcile, and the state file would otherwise keep every instance ever deprovisioned
+		if err := b.Store.Delete(instanceID); err != nil && err != store.ErrNotFound {
+			logger.Error("deleting-record", err, lager.Data{"instanceID": instanceID})
 		}
+		return brokerapi.LastOperation{State: state, Description: description}, nil
 	}
-	return brokerapi.LastOperation{State: state, Description: awsStatus}, nil
+	updateStore(b.Store, instanceID, func(record *store.Instance) {
+		if op := record.LastOperation(token.Type); op != nil && (op.State != string(state) || op.Description != description) {
+			op.SetState(string(state), description)
+		}
+	})
+	return brokerapi.LastOperation{State: state, Description: description}, nil
 }
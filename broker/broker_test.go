@@ -2,11 +2,15 @@ package broker_test
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"strings"
 
 	. "github.com/GSA/ec2-broker/broker"
 
 	"github.com/GSA/ec2-broker/config"
+	"github.com/GSA/ec2-broker/store"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -18,8 +22,8 @@ type FakeAWSManager struct {
 	mock.Mock
 }
 
-func (fm *FakeAWSManager) ProvisionAWSInstance(planID, amiID, securityGroupID, subnetID string, assignPublicIP bool, instanceID string) (string, error) {
-	args := fm.Called(planID, amiID, securityGroupID, subnetID, assignPublicIP, instanceID)
+func (fm *FakeAWSManager) ProvisionAWSInstance(instanceID string, context ProvisionContext, parameters ProvisionParameters) (string, error) {
+	args := fm.Called(instanceID, context, parameters)
 	return args.String(0), args.Error(1)
 }
 
@@ -28,14 +32,85 @@ func (fm *FakeAWSManager) TerminateAWSInstance(instanceID string) (string, error
 	return args.String(0), args.Error(1)
 }
 
-func (fm *FakeAWSManager) GetAWSInstanceStatus(instanceID string) (string, error) {
+func (fm *FakeAWSManager) GetAWSInstanceStatus(instanceID string) (*InstanceStatus, error) {
+	args := fm.Called(instanceID)
+	status, _ := args.Get(0).(*InstanceStatus)
+	return status, args.Error(1)
+}
+
+func (fm *FakeAWSManager) BindAWSInstance(instanceID, bindingID, username, publicKey string) (*InstanceAddress, error) {
+	args := fm.Called(instanceID, bindingID, username, publicKey)
+	address, _ := args.Get(0).(*InstanceAddress)
+	return address, args.Error(1)
+}
+
+func (fm *FakeAWSManager) UnbindAWSInstance(instanceID, bindingID string) error {
+	args := fm.Called(instanceID, bindingID)
+	return args.Error(0)
+}
+
+func (fm *FakeAWSManager) DescribeAWSInstance(instanceID string) (*InstanceDescription, error) {
+	args := fm.Called(instanceID)
+	description, _ := args.Get(0).(*InstanceDescription)
+	return description, args.Error(1)
+}
+
+func (fm *FakeAWSManager) StopAWSInstance(instanceID string) (string, error) {
+	args := fm.Called(instanceID)
+	return args.String(0), args.Error(1)
+}
+
+func (fm *FakeAWSManager) StartAWSInstance(instanceID string) (string, error) {
+	args := fm.Called(instanceID)
+	return args.String(0), args.Error(1)
+}
+
+func (fm *FakeAWSManager) SetAWSInstanceSecurityGroups(instanceID string, securityGroupIDs []string) error {
+	args := fm.Called(instanceID, securityGroupIDs)
+	return args.Error(0)
+}
+
+func (fm *FakeAWSManager) SetAWSInstanceTags(instanceID string, tags map[string]string, removed []string) error {
+	args := fm.Called(instanceID, tags, removed)
+	return args.Error(0)
+}
+
+func (fm *FakeAWSManager) SetAWSInstancePublicIP(instanceID string, assignPublicIP bool) (string, error) {
+	args := fm.Called(instanceID, assignPublicIP)
+	return args.String(0), args.Error(1)
+}
+
+// Plans are used as configured, without tag selectors
+func (fm *FakeAWSManager) ResolvePlan(plan *config.PlanConfig) (*config.PlanConfig, error) {
+	return plan, nil
+}
+
+func (fm *FakeAWSManager) ResolveAWSImage(plan *config.PlanConfig, image string) (string, error) {
+	args := fm.Called(plan.ID, image)
+	return args.String(0), args.Error(1)
+}
+
+func (fm *FakeAWSManager) AssociateAWSElasticIP(instanceID string) (string, error) {
 	args := fm.Called(instanceID)
 	return args.String(0), args.Error(1)
 }
 
+func (fm *FakeAWSManager) ReleaseAWSElasticIP(instanceID string) error {
+	args := fm.Called(instanceID)
+	return args.Error(0)
+}
+
+func (fm *FakeAWSManager) SetAWSInstanceType(instanceID, instanceType string) error {
+	args := fm.Called(instanceID, instanceType)
+	return args.Error(0)
+}
+
+const testPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f"
+
 var _ = Describe("Broker", func() {
 	var (
 		m FakeAWSManager
+		s *store.FileStore
 		b *EC2Broker
 	)
 	// config.GetLogger().RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
@@ -49,6 +124,7 @@ var _ = Describe("Broker", func() {
 			ServiceDescription: "service-description",
 			BrokerUsername:     "broker-user",
 			BrokerPassword:     "broker-password",
+			OperationSecret:    "operation-secret",
 			KeyPairName:        "key-pair",
 			TagPrefix:          "tag-prefix",
 			Plans: []config.PlanConfig{
@@ -61,11 +137,31 @@ var _ = Describe("Broker", func() {
 					AllowedSecurityGroups: []string{"allowed-sg-1", "allowed-sg-2"},
 					AllowedSubnets:        []string{"allowed-sn-1", "allowed-sn-2"},
 					AllowPublicIP:         true,
+					AllowElasticIP:        true,
+				},
+				config.PlanConfig{
+					ID:                    "plan-id-2",
+					Name:                  "plan-name-2",
+					Description:           "plan-description-2",
+					InstanceType:          "instance-type-2",
+					AllowedAMIs:           []string{"allowed-ami-1", "allowed-ami-2"},
+					AllowedSecurityGroups: []string{"allowed-sg-1", "allowed-sg-2"},
+					AllowedSubnets:        []string{"allowed-sn-1", "allowed-sn-2"},
+				},
+				config.PlanConfig{
+					ID:                    "plan-id-3",
+					Name:                  "plan-name-3",
+					Description:           "plan-description-3",
+					InstanceType:          "instance-type-3",
+					AllowedAMIs:           []string{"allowed-ami-2"},
+					AllowedSecurityGroups: []string{"allowed-sg-1"},
+					AllowedSubnets:        []string{"allowed-sn-1"},
 				},
 			},
 		})
 		m = FakeAWSManager{}
-		b, _ = New("test-broker", &m)
+		s = store.NewMemoryStore()
+		b, _ = New("test-broker", &m, s)
 	})
 
 	Describe("services", func() {
@@ -76,13 +172,53 @@ var _ = Describe("Broker", func() {
 			Expect(services[0].ID).To(Equal("service-id"))
 			Expect(services[0].Name).To(Equal("service-name"))
 			Expect(services[0].Description).To(Equal("service-description"))
-			Expect(services[0].PlanUpdatable).To(Equal(false))
+			Expect(services[0].PlanUpdatable).To(Equal(true))
 			By("Checking plan values")
-			Expect(services[0].Plans).To(HaveLen(1))
+			Expect(services[0].Plans).To(HaveLen(3))
 			Expect(services[0].Plans[0].ID).To(Equal("plan-id"))
 			Expect(services[0].Plans[0].Name).To(Equal("plan-name"))
 			Expect(services[0].Plans[0].Description).To(Equal("plan-description"))
 		})
+
+		It("describes services and plans for the marketplace", func() {
+			conf := *config.GetConfiguration()
+			conf.ServiceMetadata = config.ServiceMetadata{DisplayName: "EC2", SupportURL: "https://support.example.com"}
+			conf.Plans = append([]config.PlanConfig{}, conf.Plans...)
+			conf.Plans[0].InstanceType = "t2.micro"
+			conf.Plans[0].Metadata = config.PlanMetadata{
+				DisplayName:   "Micro",
+				InstanceSpecs: true,
+				Bullets:       []string{"Burstable CPU"},
+				Costs:         []config.PlanCost{{Amount: map[string]float64{"usd": 0.0116}, Unit: "HOUR"}},
+			}
+			config.SetConfiguration(&conf)
+			services := b.Services(context.Background())
+			Expect(services[0].Metadata.DisplayName).To(Equal("EC2"))
+			Expect(services[0].Metadata.SupportUrl).To(Equal("https://support.example.com"))
+			metadata := services[0].Plans[0].Metadata
+			Expect(metadata.DisplayName).To(Equal("Micro"))
+			Expect(metadata.Bullets).To(Equal([]string{"1 vCPU", "1 GiB memory", "Burstable CPU"}))
+			Expect(metadata.Costs).To(Equal([]brokerapi.ServicePlanCost{{Amount: map[string]float64{"usd": 0.0116}, Unit: "HOUR"}}))
+			Expect(services[0].Plans[1].Metadata).To(BeNil())
+		})
+
+		It("lists every configured service with its own plans", func() {
+			conf := *config.GetConfiguration()
+			conf.Services = []config.ServiceConfig{
+				{ID: "compute-id", Name: "compute", Tags: []string{"ec2"}, Plans: conf.Plans[:2]},
+				{ID: "batch-id", Name: "batch", Plans: conf.Plans[2:]},
+			}
+			conf.ServiceID, conf.ServiceName, conf.Plans = "", "", nil
+			config.SetConfiguration(&conf)
+			services := b.Services(context.Background())
+			Expect(services).To(HaveLen(2))
+			Expect(services[0].ID).To(Equal("compute-id"))
+			Expect(services[0].Tags).To(Equal([]string{"ec2"}))
+			Expect(services[0].Plans).To(HaveLen(2))
+			Expect(services[1].Name).To(Equal("batch"))
+			Expect(services[1].Plans).To(HaveLen(1))
+			Expect(services[1].Plans[0].ID).To(Equal("plan-id-3"))
+		})
 	})
 
 	Describe("provision", func() {
@@ -94,19 +230,168 @@ var _ = Describe("Broker", func() {
 		})
 
 		It("succeeds provision on valid parameters", func() {
-			m.On("ProvisionAWSInstance", "plan-id", "allowed-ami-1", "allowed-sg-1", "allowed-sn-1", true, "instance-1").Return("i-aws-id", nil)
+			m.On("ProvisionAWSInstance", "instance-1", ProvisionContext{PlanID: "plan-id"}, ProvisionParameters{AMIID: "allowed-ami-1", SecurityGroupID: "allowed-sg-1", SubnetID: "allowed-sn-1", AssignPublicIP: true}).Return("i-aws-id", nil)
 			spec, err := b.Provision(context.Background(), "instance-1",
 				brokerapi.ProvisionDetails{
 					PlanID:        "plan-id",
 					RawParameters: []byte("{ \"ami_id\": \"allowed-ami-1\", \"subnet_id\": \"allowed-sn-1\", \"security_group_id\": \"allowed-sg-1\", \"assign_public_ip\": true }"),
 				}, true)
 			Expect(err).ToNot(HaveOccurred())
-			Expect(spec.OperationData).To(Equal("p_instance-1"))
+			Expect(spec.OperationData).To(HavePrefix("v1."))
+			m.AssertExpectations(GinkgoT())
+		})
+
+		It("passes requested data volumes to the instance manager", func() {
+			m.On("ProvisionAWSInstance", "instance-1", ProvisionContext{PlanID: "plan-id"}, ProvisionParameters{
+				AMIID: "allowed-ami-1", SecurityGroupID: "allowed-sg-1", SubnetID: "allowed-sn-1",
+				Volumes: []VolumeParameters{{SizeGB: 100, VolumeType: "gp2", Encrypted: true}},
+			}).Return("i-aws-id", nil)
+			_, err := b.Provision(context.Background(), "instance-1",
+				brokerapi.ProvisionDetails{
+					PlanID:        "plan-id",
+					RawParameters: []byte(`{"ami_id": "allowed-ami-1", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1", "volumes": [{"size_gb": 100, "volume_type": "gp2", "encrypted": true}]}`),
+				}, true)
+			Expect(err).ToNot(HaveOccurred())
+			m.AssertExpectations(GinkgoT())
+		})
+
+		It("resolves an image family to its AMI", func() {
+			m.On("ResolveAWSImage", "plan-id", "ubuntu-hardened@2017-03").Return("ami-family-1", nil)
+			m.On("ProvisionAWSInstance", "instance-1", ProvisionContext{PlanID: "plan-id"}, ProvisionParameters{
+				AMIID: "ami-family-1", Image: "ubuntu-hardened@2017-03", SecurityGroupID: "allowed-sg-1", SubnetID: "allowed-sn-1",
+			}).Return("i-aws-id", nil)
+			spec, err := b.Provision(context.Background(), "instance-1",
+				brokerapi.ProvisionDetails{
+					PlanID:        "plan-id",
+					RawParameters: []byte(`{"image": "ubuntu-hardened@2017-03", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1"}`),
+				}, true)
+			Expect(err).ToNot(HaveOccurred())
 			m.AssertExpectations(GinkgoT())
+
+			By("reporting the AMI in the last operation")
+			m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNamePending}, nil)
+			op, err := b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.Description).To(Equal("pending; image ubuntu-hardened@2017-03 resolved to ami-family-1"))
+		})
+
+		It("refuses requests for both an AMI and an image", func() {
+			_, err := b.Provision(context.Background(), "instance-1",
+				brokerapi.ProvisionDetails{
+					PlanID:        "plan-id",
+					RawParameters: []byte(`{"ami_id": "allowed-ami-1", "image": "ubuntu-hardened", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1"}`),
+				}, true)
+			Expect(err).To(HaveOccurred())
+			m.AssertNotCalled(GinkgoT(), "ProvisionAWSInstance", "instance-1", mock.Anything, mock.Anything)
+		})
+
+		It("records the provisioned instance in the store", func() {
+			m.On("ProvisionAWSInstance", "instance-1", ProvisionContext{ServiceID: "service-id", PlanID: "plan-id", OrganizationGUID: "org-guid", SpaceGUID: "space-guid"}, ProvisionParameters{AMIID: "allowed-ami-1", SecurityGroupID: "allowed-sg-1", SubnetID: "allowed-sn-1", AssignPublicIP: true}).Return("i-aws-id", nil)
+			_, err := b.Provision(context.Background(), "instance-1",
+				brokerapi.ProvisionDetails{
+					ServiceID:        "service-id",
+					PlanID:           "plan-id",
+					OrganizationGUID: "org-guid",
+					SpaceGUID:        "space-guid",
+					RawParameters:    []byte("{ \"ami_id\": \"allowed-ami-1\", \"subnet_id\": \"allowed-sn-1\", \"security_group_id\": \"allowed-sg-1\", \"assign_public_ip\": true }"),
+				}, true)
+			Expect(err).ToNot(HaveOccurred())
+			record, err := s.Get("instance-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.AWSInstanceID).To(Equal("i-aws-id"))
+			Expect(record.PlanID).To(Equal("plan-id"))
+			Expect(record.OrganizationGUID).To(Equal("org-guid"))
+			Expect(record.SpaceGUID).To(Equal("space-guid"))
+			Expect(string(record.Parameters)).To(ContainSubstring("allowed-ami-1"))
+			Expect(record.Operations).To(HaveLen(1))
+			Expect(record.Operations[0].Type).To(Equal("provision"))
+			Expect(record.Operations[0].State).To(Equal(string(brokerapi.InProgress)))
+		})
+
+		Describe("repeated requests", func() {
+			raw := []byte(`{"ami_id": "allowed-ami-1", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1"}`)
+
+			BeforeEach(func() {
+				m.On("ProvisionAWSInstance", "instance-1", mock.Anything, mock.Anything).Return("i-aws-id", nil).Once()
+				_, err := b.Provision(context.Background(), "instance-1", brokerapi.ProvisionDetails{PlanID: "plan-id", SpaceGUID: "space-guid", RawParameters: raw}, true)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("accepts an identical request for an instance still starting without launching another", func() {
+				spec, err := b.Provision(context.Background(), "instance-1", brokerapi.ProvisionDetails{PlanID: "plan-id", SpaceGUID: "space-guid", RawParameters: raw}, true)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(spec.IsAsync).To(BeTrue())
+				Expect(spec.OperationData).To(HavePrefix("v1."))
+				m.AssertNumberOfCalls(GinkgoT(), "ProvisionAWSInstance", 1)
+			})
+
+			It("answers an identical request for a running instance synchronously", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.LastOperation("provision").SetState(string(brokerapi.Succeeded), "running")
+					return nil
+				})
+				spec, err := b.Provision(context.Background(), "instance-1", brokerapi.ProvisionDetails{PlanID: "plan-id", SpaceGUID: "space-guid", RawParameters: raw}, true)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(spec.IsAsync).To(BeFalse())
+				m.AssertNumberOfCalls(GinkgoT(), "ProvisionAWSInstance", 1)
+			})
+
+			It("refuses a request with other parameters", func() {
+				_, err := b.Provision(context.Background(), "instance-1", brokerapi.ProvisionDetails{
+					PlanID:        "plan-id",
+					SpaceGUID:     "space-guid",
+					RawParameters: []byte(`{"ami_id": "allowed-ami-2", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1"}`),
+				}, true)
+				Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+				m.AssertNumberOfCalls(GinkgoT(), "ProvisionAWSInstance", 1)
+			})
+
+			It("refuses a request for another plan or space", func() {
+				_, err := b.Provision(context.Background(), "instance-1", brokerapi.ProvisionDetails{PlanID: "plan-id-2", SpaceGUID: "space-guid", RawParameters: raw}, true)
+				Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+				_, err = b.Provision(context.Background(), "instance-1", brokerapi.ProvisionDetails{PlanID: "plan-id", SpaceGUID: "other-space", RawParameters: raw}, true)
+				Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+			})
+
+			Describe("for instances recorded from their tags", func() {
+				BeforeEach(func() {
+					s.Update("instance-2", func(record *store.Instance) error {
+						record.AWSInstanceID = "i-aws-id-2"
+						record.PlanID = "plan-id"
+						record.SpaceGUID = "space-guid"
+						record.AWSState = ec2.InstanceStateNamePending
+						return nil
+					})
+				})
+
+				It("accepts a request for the same plan and space while the instance is starting", func() {
+					spec, err := b.Provision(context.Background(), "instance-2", brokerapi.ProvisionDetails{PlanID: "plan-id", SpaceGUID: "space-guid", RawParameters: raw}, true)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(spec.IsAsync).To(BeTrue())
+					m.AssertNumberOfCalls(GinkgoT(), "ProvisionAWSInstance", 1)
+				})
+
+				It("answers a request for the same plan and space synchronously once the instance is running", func() {
+					s.Update("instance-2", func(record *store.Instance) error {
+						record.AWSState = ec2.InstanceStateNameRunning
+						return nil
+					})
+					spec, err := b.Provision(context.Background(), "instance-2", brokerapi.ProvisionDetails{PlanID: "plan-id", SpaceGUID: "space-guid", RawParameters: raw}, true)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(spec.IsAsync).To(BeFalse())
+				})
+
+				It("refuses a request for another plan or space", func() {
+					_, err := b.Provision(context.Background(), "instance-2", brokerapi.ProvisionDetails{PlanID: "plan-id-2", SpaceGUID: "space-guid", RawParameters: raw}, true)
+					Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+					_, err = b.Provision(context.Background(), "instance-2", brokerapi.ProvisionDetails{PlanID: "plan-id", SpaceGUID: "other-space", RawParameters: raw}, true)
+					Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+				})
+			})
 		})
 
 		It("fails provision on provision error return", func() {
-			m.On("ProvisionAWSInstance", "plan-id", "allowed-ami-2", "allowed-sg-1", "allowed-sn-1", true, "instance-1").Return("", errors.New("AWS failure"))
+			m.On("ProvisionAWSInstance", "instance-1", ProvisionContext{PlanID: "plan-id"}, ProvisionParameters{AMIID: "allowed-ami-2", SecurityGroupID: "allowed-sg-1", SubnetID: "allowed-sn-1", AssignPublicIP: true}).Return("", errors.New("AWS failure"))
 			_, err := b.Provision(context.Background(), "instance-1",
 				brokerapi.ProvisionDetails{
 					PlanID:        "plan-id",
@@ -123,9 +408,12 @@ var _ = Describe("Broker", func() {
 			m.On("TerminateAWSInstance", "instance-1").Return("stopping", nil)
 			status, err := b.Deprovision(context.Background(), "instance-1", brokerapi.DeprovisionDetails{}, true)
 			Expect(err).To(Not(HaveOccurred()))
-			Expect(status.OperationData).To(Equal("d_instance-1"))
+			Expect(status.OperationData).To(HavePrefix("v1."))
 			Expect(status.IsAsync).To(Equal(true))
 			m.AssertExpectations(GinkgoT())
+			record, err := s.Get("instance-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.LastOperation("deprovision")).ToNot(BeNil())
 		})
 
 		It("fails termination on AWS error", func() {
@@ -134,105 +422,756 @@ var _ = Describe("Broker", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(status.OperationData).To(Equal(""))
 			m.AssertExpectations(GinkgoT())
+			_, err = s.Get("unknown")
+			Expect(err).To(Equal(store.ErrNotFound))
+		})
+
+		It("records a failed termination of a known instance", func() {
+			s.Update("instance-1", func(record *store.Instance) error {
+				record.AWSInstanceID = "i-aws-id"
+				return nil
+			})
+			m.On("TerminateAWSInstance", "instance-1").Return("", errors.New("AWS Error"))
+			_, err := b.Deprovision(context.Background(), "instance-1", brokerapi.DeprovisionDetails{}, true)
+			Expect(err).To(HaveOccurred())
+			record, _ := s.Get("instance-1")
+			Expect(record.LastOperation("deprovision").State).To(Equal(string(brokerapi.Failed)))
+			Expect(record.LastOperation("deprovision").Description).To(Equal("AWS Error"))
 		})
 	})
 
 	Describe("binding", func() {
+		It("installs a valid public key and returns the instance addresses", func() {
+			m.On("BindAWSInstance", "instance-1", "binding-1", "ec2-user", testPublicKey).Return(&InstanceAddress{PrivateIP: "10.0.0.1", PublicIP: "54.0.0.1"}, nil)
+			binding, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{
+				PlanID:     "plan-id",
+				Parameters: map[string]interface{}{"public_key": testPublicKey + " user@example.com"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(binding.Credentials).To(Equal(BindingCredentials{
+				Host:        "54.0.0.1",
+				PrivateIP:   "10.0.0.1",
+				PublicIP:    "54.0.0.1",
+				Username:    "ec2-user",
+				URI:         "ssh://ec2-user@54.0.0.1",
+				Fingerprint: "SHA256:ZkAslGjFiUHdGf/WUL8rQvkib4PTvQatUV0OUQSncCA",
+			}))
+			m.AssertExpectations(GinkgoT())
+		})
 
-		It("fails binding calls", func() {
-			_, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{})
-			Expect(err).To(HaveOccurred())
+		It("returns the Elastic IP of the instance", func() {
+			m.On("BindAWSInstance", "instance-1", "binding-1", "ec2-user", testPublicKey).Return(&InstanceAddress{PrivateIP: "10.0.0.1", PublicIP: "52.0.0.1", ElasticIP: "52.0.0.1"}, nil)
+			binding, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{
+				PlanID:     "plan-id",
+				Parameters: map[string]interface{}{"public_key": testPublicKey},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			credentials := binding.Credentials.(BindingCredentials)
+			Expect(credentials.ElasticIP).To(Equal("52.0.0.1"))
+			Expect(credentials.Host).To(Equal("52.0.0.1"))
+		})
 
-			err = b.Unbind(context.Background(), "instance-1", "binding-1", brokerapi.UnbindDetails{})
+		It("uses the private IP as the host when there is no public IP", func() {
+			m.On("BindAWSInstance", "instance-1", "binding-1", "ec2-user", testPublicKey).Return(&InstanceAddress{PrivateIP: "10.0.0.1"}, nil)
+			binding, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{
+				PlanID:     "plan-id",
+				Parameters: map[string]interface{}{"public_key": testPublicKey},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(binding.Credentials.(BindingCredentials).Host).To(Equal("10.0.0.1"))
+		})
+
+		It("generates a key pair for the binding without a public key", func() {
+			m.On("BindAWSInstance", "instance-1", "binding-1", "ec2-user", mock.MatchedBy(func(key string) bool {
+				return strings.HasPrefix(key, "ssh-rsa ")
+			})).Return(&InstanceAddress{PrivateIP: "10.0.0.1"}, nil)
+			binding, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{PlanID: "plan-id"})
+			Expect(err).ToNot(HaveOccurred())
+			creds := binding.Credentials.(BindingCredentials)
+			Expect(creds.URI).To(Equal("ssh://ec2-user@10.0.0.1"))
+			Expect(creds.Fingerprint).To(HavePrefix("SHA256:"))
+			block, _ := pem.Decode([]byte(creds.PrivateKey))
+			Expect(block).ToNot(BeNil())
+			_, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			Expect(err).ToNot(HaveOccurred())
+			m.AssertExpectations(GinkgoT())
+		})
+
+		It("generates a different key pair for each binding", func() {
+			m.On("BindAWSInstance", "instance-1", mock.Anything, "ec2-user", mock.Anything).Return(&InstanceAddress{PrivateIP: "10.0.0.1"}, nil)
+			first, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{PlanID: "plan-id"})
+			Expect(err).ToNot(HaveOccurred())
+			second, err := b.Bind(context.Background(), "instance-1", "binding-2", brokerapi.BindDetails{PlanID: "plan-id"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first.Credentials.(BindingCredentials).Fingerprint).ToNot(Equal(second.Credentials.(BindingCredentials).Fingerprint))
+		})
+
+		It("does not return a private key for user supplied keys", func() {
+			m.On("BindAWSInstance", "instance-1", "binding-1", "ec2-user", testPublicKey).Return(&InstanceAddress{PrivateIP: "10.0.0.1"}, nil)
+			binding, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{
+				PlanID:     "plan-id",
+				Parameters: map[string]interface{}{"public_key": testPublicKey},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(binding.Credentials.(BindingCredentials).PrivateKey).To(BeEmpty())
+			Expect(binding.Credentials.(BindingCredentials).Fingerprint).To(Equal("SHA256:ZkAslGjFiUHdGf/WUL8rQvkib4PTvQatUV0OUQSncCA"))
+		})
+
+		It("fails binding with an invalid public key", func() {
+			for _, key := range []string{
+				"not a key",
+				"ssh-dss AAAAB3NzaC1kc3M=",
+				"ssh-rsa " + testPublicKey[len("ssh-ed25519 "):],
+				testPublicKey + "\nssh-rsa AAAA",
+				"ssh-ed25519 AAAA'$(reboot)'",
+			} {
+				_, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{
+					PlanID:     "plan-id",
+					Parameters: map[string]interface{}{"public_key": key},
+				})
+				Expect(err).To(HaveOccurred(), key)
+			}
+		})
+
+		It("fails binding on AWS error", func() {
+			m.On("BindAWSInstance", "instance-1", "binding-1", "ec2-user", testPublicKey).Return(nil, errors.New("AWS failure"))
+			_, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{
+				PlanID:     "plan-id",
+				Parameters: map[string]interface{}{"public_key": testPublicKey},
+			})
 			Expect(err).To(HaveOccurred())
+			m.AssertExpectations(GinkgoT())
+		})
+
+		It("records bindings in the store without their private keys", func() {
+			m.On("BindAWSInstance", "instance-1", "binding-1", "ec2-user", mock.Anything).Return(&InstanceAddress{PrivateIP: "10.0.0.1"}, nil)
+			m.On("UnbindAWSInstance", "instance-1", "binding-1").Return(nil)
+			binding, err := b.Bind(context.Background(), "instance-1", "binding-1", brokerapi.BindDetails{PlanID: "plan-id", AppGUID: "app-guid"})
+			Expect(err).ToNot(HaveOccurred())
+			record, err := s.Get("instance-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Bindings).To(HaveKey("binding-1"))
+			Expect(record.Bindings["binding-1"].AppGUID).To(Equal("app-guid"))
+			Expect(record.Bindings["binding-1"].Fingerprint).To(Equal(binding.Credentials.(BindingCredentials).Fingerprint))
+
+			err = b.Unbind(context.Background(), "instance-1", "binding-1", brokerapi.UnbindDetails{PlanID: "plan-id"})
+			Expect(err).ToNot(HaveOccurred())
+			record, err = s.Get("instance-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Bindings).ToNot(HaveKey("binding-1"))
+		})
+
+		It("removes the binding's key on unbind", func() {
+			m.On("UnbindAWSInstance", "instance-1", "binding-1").Return(nil)
+			err := b.Unbind(context.Background(), "instance-1", "binding-1", brokerapi.UnbindDetails{PlanID: "plan-id"})
+			Expect(err).ToNot(HaveOccurred())
+			m.AssertExpectations(GinkgoT())
+		})
+
+		It("fails unbind for unknown bindings", func() {
+			m.On("UnbindAWSInstance", "instance-1", "binding-2").Return(brokerapi.ErrBindingDoesNotExist)
+			err := b.Unbind(context.Background(), "instance-1", "binding-2", brokerapi.UnbindDetails{PlanID: "plan-id"})
+			Expect(err).To(Equal(brokerapi.ErrBindingDoesNotExist))
+			m.AssertExpectations(GinkgoT())
 		})
 	})
 
 	Describe("update", func() {
-		It("fails update calls", func() {
-			_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{}, true)
+		var instance *InstanceDescription
+
+		BeforeEach(func() {
+			instance = &InstanceDescription{
+				AWSInstanceID:    "i-aws-id",
+				State:            ec2.InstanceStateNameRunning,
+				InstanceType:     "instance-type",
+				ImageID:          "allowed-ami-1",
+				SubnetID:         "allowed-sn-1",
+				SecurityGroupIDs: []string{"allowed-sg-1"},
+			}
+			s.Update("instance-1", func(record *store.Instance) error {
+				record.PlanID = "plan-id"
+				return nil
+			})
+		})
+
+		It("does nothing when the plan is unchanged", func() {
+			spec, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "plan-id"}, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(spec.IsAsync).To(BeFalse())
+			m.AssertExpectations(GinkgoT())
+		})
+
+		It("requires asynchronous updates for plan changes", func() {
+			_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "plan-id-2"}, false)
+			Expect(err).To(Equal(brokerapi.ErrAsyncRequired))
+		})
+
+		It("fails for unknown plans", func() {
+			_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "unknown-plan"}, true)
 			Expect(err).To(HaveOccurred())
+		})
+
+		It("refuses plans that do not allow the instance's AMI, subnet or security groups", func() {
+			m.On("DescribeAWSInstance", "instance-1").Return(instance, nil)
+			_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "plan-id-3"}, true)
+			Expect(err).To(Equal(brokerapi.ErrPlanChangeNotSupported))
+			m.AssertNotCalled(GinkgoT(), "StopAWSInstance", "instance-1")
+		})
+
+		It("applies no parameters when the plan change is refused", func() {
+			s.Update("instance-1", func(record *store.Instance) error {
+				record.Parameters = []byte(`{"ami_id": "allowed-ami-1", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1"}`)
+				return nil
+			})
+			m.On("DescribeAWSInstance", "instance-1").Return(instance, nil)
+			_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+				PlanID:     "plan-id-3",
+				Parameters: map[string]interface{}{"tags": map[string]interface{}{"Project": "new"}},
+			}, true)
+			Expect(err).To(Equal(brokerapi.ErrPlanChangeNotSupported))
+			m.AssertNotCalled(GinkgoT(), "SetAWSInstanceTags", "instance-1", mock.Anything, mock.Anything)
+			record, _ := s.Get("instance-1")
+			Expect(record.LastOperation("update")).To(BeNil())
+			Expect(string(record.Parameters)).ToNot(ContainSubstring("Project"))
+		})
+
+		It("refuses to move an instance to another service's plan", func() {
+			conf := *config.GetConfiguration()
+			conf.Services = []config.ServiceConfig{
+				{ID: "compute-id", Name: "compute", Plans: conf.Plans[:1]},
+				{ID: "batch-id", Name: "batch", Plans: conf.Plans[1:]},
+			}
+			conf.ServiceID, conf.ServiceName, conf.Plans = "", "", nil
+			config.SetConfiguration(&conf)
+			_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "plan-id-2"}, true)
 			Expect(err).To(Equal(brokerapi.ErrPlanChangeNotSupported))
+			m.AssertNotCalled(GinkgoT(), "StopAWSInstance", "instance-1")
+		})
+
+		It("stops the instance to begin a plan change", func() {
+			m.On("DescribeAWSInstance", "instance-1").Return(instance, nil)
+			m.On("StopAWSInstance", "instance-1").Return(ec2.InstanceStateNameStopping, nil)
+			spec, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "plan-id-2"}, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(spec.IsAsync).To(BeTrue())
+			Expect(spec.OperationData).To(HavePrefix("v1."))
+			m.AssertExpectations(GinkgoT())
+		})
+
+		It("resizes and restarts the instance through last operation", func() {
+			m.On("DescribeAWSInstance", "instance-1").Return(instance, nil)
+			m.On("StopAWSInstance", "instance-1").Return(ec2.InstanceStateNameStopping, nil)
+			spec, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "plan-id-2"}, true)
+			Expect(err).ToNot(HaveOccurred())
+
+			By("waiting for the instance to stop")
+			status := m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNameStopping}, nil)
+			op, err := b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.InProgress))
+
+			By("changing the type and starting once stopped")
+			status.Return(&InstanceStatus{State: ec2.InstanceStateNameStopped}, nil)
+			m.On("SetAWSInstanceType", "instance-1", "instance-type-2").Return(nil).Once()
+			m.On("StartAWSInstance", "instance-1").Return(ec2.InstanceStateNamePending, nil).Once()
+			op, err = b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.InProgress))
+
+			By("succeeding once running")
+			status.Return(&InstanceStatus{State: ec2.InstanceStateNameRunning}, nil)
+			op, err = b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.Succeeded))
+			m.AssertExpectations(GinkgoT())
+
+			record, _ := s.Get("instance-1")
+			Expect(record.PlanID).To(Equal("plan-id-2"))
+		})
+
+		It("resizes a stopped instance without starting it", func() {
+			instance.State = ec2.InstanceStateNameStopped
+			m.On("DescribeAWSInstance", "instance-1").Return(instance, nil)
+			m.On("SetAWSInstanceType", "instance-1", "instance-type-2").Return(nil)
+			spec, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "plan-id-2"}, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(spec.IsAsync).To(BeFalse())
+			m.AssertExpectations(GinkgoT())
+			m.AssertNotCalled(GinkgoT(), "StopAWSInstance", "instance-1")
+			m.AssertNotCalled(GinkgoT(), "StartAWSInstance", "instance-1")
+
+			record, _ := s.Get("instance-1")
+			Expect(record.PlanID).To(Equal("plan-id-2"))
+			Expect(record.LastOperation("update").State).To(Equal(string(brokerapi.Succeeded)))
+		})
+
+		It("fails when the instance stops again while starting", func() {
+			m.On("DescribeAWSInstance", "instance-1").Return(instance, nil)
+			m.On("StopAWSInstance", "instance-1").Return(ec2.InstanceStateNameStopping, nil)
+			spec, _ := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "plan-id-2"}, true)
+			status := m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNameStopped}, nil)
+			m.On("SetAWSInstanceType", "instance-1", "instance-type-2").Return(nil)
+			m.On("StartAWSInstance", "instance-1").Return(ec2.InstanceStateNamePending, nil).Once()
+			op, _ := b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(op.State).To(Equal(brokerapi.InProgress))
+
+			status.Return(&InstanceStatus{State: ec2.InstanceStateNameStopped}, nil)
+			op, err := b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.Failed))
+			m.AssertExpectations(GinkgoT())
+		})
+
+		It("restarts the instance and fails when the resize fails", func() {
+			m.On("DescribeAWSInstance", "instance-1").Return(instance, nil)
+			m.On("StopAWSInstance", "instance-1").Return(ec2.InstanceStateNameStopping, nil)
+			spec, _ := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{PlanID: "plan-id-2"}, true)
+			m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNameStopped}, nil)
+			m.On("SetAWSInstanceType", "instance-1", "instance-type-2").Return(errors.New("AWS failure"))
+			m.On("StartAWSInstance", "instance-1").Return(ec2.InstanceStateNamePending, nil)
+			op, err := b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.Failed))
+			m.AssertExpectations(GinkgoT())
+
+			record, _ := s.Get("instance-1")
+			Expect(record.PlanID).To(Equal("plan-id"))
+		})
+
+		Describe("parameters", func() {
+			BeforeEach(func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.Parameters = []byte(`{"ami_id": "allowed-ami-1", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1"}`)
+					return nil
+				})
+				m.On("DescribeAWSInstance", "instance-1").Return(instance, nil)
+			})
+
+			It("swaps security groups", func() {
+				m.On("SetAWSInstanceSecurityGroups", "instance-1", []string{"allowed-sg-2"}).Return(nil)
+				spec, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"security_group_id": "allowed-sg-2"},
+				}, true)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(spec.IsAsync).To(BeFalse())
+				m.AssertExpectations(GinkgoT())
+
+				record, _ := s.Get("instance-1")
+				Expect(string(record.Parameters)).To(ContainSubstring("allowed-sg-2"))
+				op := record.LastOperation("update")
+				Expect(op.State).To(Equal(string(brokerapi.Succeeded)))
+				Expect(op.Description).To(ContainSubstring("allowed-sg-2"))
+			})
+
+			It("adds security groups", func() {
+				m.On("SetAWSInstanceSecurityGroups", "instance-1", []string{"allowed-sg-1", "allowed-sg-2"}).Return(nil)
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"security_group_ids": []string{"allowed-sg-2"}},
+				}, true)
+				Expect(err).ToNot(HaveOccurred())
+				m.AssertExpectations(GinkgoT())
+			})
+
+			It("refuses security groups the plan does not allow", func() {
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"security_group_id": "disallowed-sg"},
+				}, true)
+				Expect(err).To(HaveOccurred())
+				m.AssertNotCalled(GinkgoT(), "SetAWSInstanceSecurityGroups", "instance-1", []string{"disallowed-sg"})
+			})
+
+			It("refuses changes to the AMI", func() {
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"ami_id": "allowed-ami-2"},
+				}, true)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("refuses changes to the data volumes", func() {
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"volumes": []interface{}{map[string]interface{}{"size_gb": 10}}},
+				}, true)
+				Expect(err).To(HaveOccurred())
+				m.AssertNotCalled(GinkgoT(), "SetAWSInstanceSecurityGroups", "instance-1", mock.Anything)
+			})
+
+			It("replaces the custom tags", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.Parameters = []byte(`{"ami_id": "allowed-ami-1", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1", "tags": {"Project": "old", "Team": "ops"}}`)
+					return nil
+				})
+				m.On("SetAWSInstanceTags", "instance-1", map[string]string{"Project": "new"}, []string{"Team"}).Return(nil)
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"tags": map[string]interface{}{"Project": "new"}},
+				}, true)
+				Expect(err).ToNot(HaveOccurred())
+				m.AssertExpectations(GinkgoT())
+			})
+
+			It("refuses tags under the broker's prefix", func() {
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"tags": map[string]interface{}{"tag-prefixbrokerInstance": "other"}},
+				}, true)
+				Expect(err).To(HaveOccurred())
+				m.AssertNotCalled(GinkgoT(), "SetAWSInstanceTags", "instance-1", mock.Anything, mock.Anything)
+			})
+
+			It("associates a public IP when the plan allows it", func() {
+				m.On("SetAWSInstancePublicIP", "instance-1", true).Return("54.0.0.1", nil)
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"assign_public_ip": true},
+				}, true)
+				Expect(err).ToNot(HaveOccurred())
+				m.AssertExpectations(GinkgoT())
+			})
+
+			It("disassociates a public IP", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.Parameters = []byte(`{"ami_id": "allowed-ami-1", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1", "assign_public_ip": true}`)
+					return nil
+				})
+				instance.PublicIP = "54.0.0.1"
+				m.On("SetAWSInstancePublicIP", "instance-1", false).Return("", nil)
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"assign_public_ip": false},
+				}, true)
+				Expect(err).ToNot(HaveOccurred())
+				m.AssertExpectations(GinkgoT())
+			})
+
+			It("leaves the public IP alone on updates that do not change it", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.Parameters = []byte(`{"ami_id": "allowed-ami-1", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1", "assign_public_ip": true}`)
+					return nil
+				})
+				instance.State = ec2.InstanceStateNameStopped
+				m.On("SetAWSInstanceTags", "instance-1", map[string]string{"Project": "new"}, []string{}).Return(nil)
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"tags": map[string]interface{}{"Project": "new"}},
+				}, true)
+				Expect(err).ToNot(HaveOccurred())
+				m.AssertExpectations(GinkgoT())
+				m.AssertNotCalled(GinkgoT(), "SetAWSInstancePublicIP", "instance-1", mock.Anything)
+			})
+
+			It("keeps the public IP setting of a stopped instance", func() {
+				instance.State = ec2.InstanceStateNameStopped
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"assign_public_ip": true},
+				}, true)
+				Expect(err).ToNot(HaveOccurred())
+				m.AssertNotCalled(GinkgoT(), "SetAWSInstancePublicIP", "instance-1", mock.Anything)
+				record, _ := s.Get("instance-1")
+				Expect(string(record.Parameters)).To(ContainSubstring(`"assign_public_ip":false`))
+				Expect(record.LastOperation("update").Description).To(Equal("public IP unchanged while instance is stopped"))
+			})
+
+			It("associates an Elastic IP when the plan allows it", func() {
+				m.On("AssociateAWSElasticIP", "instance-1").Return("52.0.0.1", nil)
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"elastic_ip": true},
+				}, true)
+				Expect(err).ToNot(HaveOccurred())
+				m.AssertExpectations(GinkgoT())
+				m.AssertNotCalled(GinkgoT(), "SetAWSInstancePublicIP", "instance-1", mock.Anything)
+				record, _ := s.Get("instance-1")
+				Expect(record.LastOperation("update").Description).To(ContainSubstring("Elastic IP 52.0.0.1 associated"))
+			})
+
+			It("releases an Elastic IP", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.Parameters = []byte(`{"ami_id": "allowed-ami-1", "subnet_id": "allowed-sn-1", "security_group_id": "allowed-sg-1", "elastic_ip": true}`)
+					return nil
+				})
+				m.On("ReleaseAWSElasticIP", "instance-1").Return(nil)
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"elastic_ip": false},
+				}, true)
+				Expect(err).ToNot(HaveOccurred())
+				m.AssertExpectations(GinkgoT())
+			})
+
+			It("refuses an Elastic IP when the plan does not allow it", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.PlanID = "plan-id-2"
+					return nil
+				})
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"elastic_ip": true},
+				}, true)
+				Expect(err).To(HaveOccurred())
+				m.AssertNotCalled(GinkgoT(), "AssociateAWSElasticIP", "instance-1")
+			})
+
+			It("refuses a public IP when the plan does not allow it", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.PlanID = "plan-id-2"
+					return nil
+				})
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"assign_public_ip": true},
+				}, true)
+				Expect(err).To(HaveOccurred())
+				m.AssertNotCalled(GinkgoT(), "SetAWSInstancePublicIP", "instance-1", true)
+			})
+
+			It("refuses to add a public IP when the plan does not allow Elastic IPs", func() {
+				conf := *config.GetConfiguration()
+				conf.Plans = append([]config.PlanConfig{}, conf.Plans...)
+				conf.Plans[0].AllowElasticIP = false
+				config.SetConfiguration(&conf)
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"assign_public_ip": true},
+				}, true)
+				Expect(err).To(MatchError(ContainSubstring("Elastic IP")))
+				m.AssertNotCalled(GinkgoT(), "SetAWSInstancePublicIP", "instance-1", true)
+			})
+
+			It("records failed changes in the operation history", func() {
+				m.On("SetAWSInstanceSecurityGroups", "instance-1", []string{"allowed-sg-2"}).Return(errors.New("AWS failure"))
+				_, err := b.Update(context.Background(), "instance-1", brokerapi.UpdateDetails{
+					Parameters: map[string]interface{}{"security_group_id": "allowed-sg-2"},
+				}, true)
+				Expect(err).To(HaveOccurred())
+				record, _ := s.Get("instance-1")
+				Expect(record.LastOperation("update").State).To(Equal(string(brokerapi.Failed)))
+				Expect(string(record.Parameters)).ToNot(ContainSubstring("allowed-sg-2"))
+			})
 		})
 	})
 
 	Describe("last operation", func() {
 		It("returns 'in progress' if the last operation is 'pending' on a provisioning request", func() {
-			m.On("GetAWSInstanceStatus", "instance-1").Return(ec2.InstanceStateNamePending, nil)
+			m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNamePending}, nil)
 			op, err := b.LastOperation(context.Background(), "instance-1", "p_instance-1")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.InProgress))
 		})
 
 		It("returns 'succeeded' if the AWS state is 'running' on a provisioning request", func() {
-			m.On("GetAWSInstanceStatus", "instance-2").Return(ec2.InstanceStateNameRunning, nil)
+			m.On("GetAWSInstanceStatus", "instance-2").Return(&InstanceStatus{State: ec2.InstanceStateNameRunning}, nil)
 			op, err := b.LastOperation(context.Background(), "instance-2", "p_instance-2")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.Succeeded))
 		})
 
+		It("associates a requested Elastic IP once the instance is running", func() {
+			s.Update("instance-2", func(record *store.Instance) error {
+				record.Parameters = []byte(`{"ami_id": "allowed-ami-1", "elastic_ip": true}`)
+				return nil
+			})
+			m.On("GetAWSInstanceStatus", "instance-2").Return(&InstanceStatus{State: ec2.InstanceStateNameRunning}, nil)
+			m.On("AssociateAWSElasticIP", "instance-2").Return("52.0.0.1", nil)
+			op, err := b.LastOperation(context.Background(), "instance-2", "p_instance-2")
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(op.State).To(Equal(brokerapi.Succeeded))
+			Expect(op.Description).To(Equal("running; Elastic IP 52.0.0.1 associated"))
+		})
+
+		It("keeps the provision in progress until the Elastic IP is associated", func() {
+			s.Update("instance-2", func(record *store.Instance) error {
+				record.Parameters = []byte(`{"ami_id": "allowed-ami-1", "elastic_ip": true}`)
+				return nil
+			})
+			m.On("GetAWSInstanceStatus", "instance-2").Return(&InstanceStatus{State: ec2.InstanceStateNameRunning}, nil)
+			m.On("AssociateAWSElasticIP", "instance-2").Return("", errors.New("AWS failure"))
+			op, err := b.LastOperation(context.Background(), "instance-2", "p_instance-2")
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(op.State).To(Equal(brokerapi.InProgress))
+		})
+
+		It("records the outcome of the operation in the store", func() {
+			s.Update("instance-2", func(record *store.Instance) error {
+				record.AddOperation("provision", string(brokerapi.InProgress), "")
+				return nil
+			})
+			m.On("GetAWSInstanceStatus", "instance-2").Return(&InstanceStatus{State: ec2.InstanceStateNameRunning}, nil)
+			_, err := b.LastOperation(context.Background(), "instance-2", "p_instance-2")
+			Expect(err).To(Not(HaveOccurred()))
+			record, err := s.Get("instance-2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.LastOperation("provision").State).To(Equal(string(brokerapi.Succeeded)))
+		})
+
 		It("returns 'failed' on provision if the AWS state is not 'running' or 'pending'", func() {
-			m.On("GetAWSInstanceStatus", "instance-3").Return(ec2.InstanceStateNameStopped, nil)
+			m.On("GetAWSInstanceStatus", "instance-3").Return(&InstanceStatus{State: ec2.InstanceStateNameStopped}, nil)
 			op, err := b.LastOperation(context.Background(), "instance-3", "p_instance-3")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.Failed))
 		})
 
 		It("returns 'failed' on provision if the AWS state is not 'running' or 'pending'", func() {
-			m.On("GetAWSInstanceStatus", "instance-3").Return(ec2.InstanceStateNameShuttingDown, nil)
+			m.On("GetAWSInstanceStatus", "instance-3").Return(&InstanceStatus{State: ec2.InstanceStateNameShuttingDown}, nil)
 			op, err := b.LastOperation(context.Background(), "instance-3", "p_instance-3")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.Failed))
 		})
 
 		It("returns 'in progress' if the AWS state is 'shutting down'", func() {
-			m.On("GetAWSInstanceStatus", "instance-4").Return(ec2.InstanceStateNameShuttingDown, nil)
+			m.On("GetAWSInstanceStatus", "instance-4").Return(&InstanceStatus{State: ec2.InstanceStateNameShuttingDown}, nil)
 			op, err := b.LastOperation(context.Background(), "instance-4", "d_instance-4")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.InProgress))
 		})
 
 		It("returns 'in progress' if the AWS state is 'stopping'", func() {
-			m.On("GetAWSInstanceStatus", "instance-4").Return(ec2.InstanceStateNameStopping, nil)
+			m.On("GetAWSInstanceStatus", "instance-4").Return(&InstanceStatus{State: ec2.InstanceStateNameStopping}, nil)
 			op, err := b.LastOperation(context.Background(), "instance-4", "d_instance-4")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.InProgress))
 		})
 
 		It("returns 'succeeded' if the AWS state is 'stopped'", func() {
-			m.On("GetAWSInstanceStatus", "instance-5").Return(ec2.InstanceStateNameStopped, nil)
+			m.On("GetAWSInstanceStatus", "instance-5").Return(&InstanceStatus{State: ec2.InstanceStateNameStopped}, nil)
+			m.On("ReleaseAWSElasticIP", "instance-5").Return(nil)
 			op, err := b.LastOperation(context.Background(), "instance-5", "d_instance-5")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.Succeeded))
 		})
 
 		It("returns 'succeeded' if the AWS state is 'terminated'", func() {
-			m.On("GetAWSInstanceStatus", "instance-6").Return(ec2.InstanceStateNameTerminated, nil)
+			m.On("GetAWSInstanceStatus", "instance-6").Return(&InstanceStatus{State: ec2.InstanceStateNameTerminated}, nil)
+			m.On("ReleaseAWSElasticIP", "instance-6").Return(nil)
 			op, err := b.LastOperation(context.Background(), "instance-6", "d_instance-6")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.Succeeded))
 		})
 
+		It("releases the instance's addresses once it has terminated", func() {
+			m.On("TerminateAWSInstance", "instance-1").Return(ec2.InstanceStateNameShuttingDown, nil)
+			spec, err := b.Deprovision(context.Background(), "instance-1", brokerapi.DeprovisionDetails{}, true)
+			Expect(err).ToNot(HaveOccurred())
+			m.AssertNotCalled(GinkgoT(), "ReleaseAWSElasticIP", "instance-1")
+			m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNameTerminated}, nil)
+			m.On("ReleaseAWSElasticIP", "instance-1").Return(nil)
+			op, err := b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.Succeeded))
+			m.AssertCalled(GinkgoT(), "ReleaseAWSElasticIP", "instance-1")
+		})
+
+		It("keeps the deprovision in progress until the instance's addresses are released", func() {
+			m.On("TerminateAWSInstance", "instance-1").Return(ec2.InstanceStateNameShuttingDown, nil)
+			spec, err := b.Deprovision(context.Background(), "instance-1", brokerapi.DeprovisionDetails{}, true)
+			Expect(err).ToNot(HaveOccurred())
+			m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNameTerminated}, nil)
+			m.On("ReleaseAWSElasticIP", "instance-1").Return(errors.New("AWS failure"))
+			op, err := b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.InProgress))
+			_, err = s.Get("instance-1")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
 		It("returns 'failed' on deprovision if the AWS state is not 'stopping', 'stopped', or 'terminated'", func() {
-			m.On("GetAWSInstanceStatus", "instance-7").Return(ec2.InstanceStateNameRunning, nil)
+			m.On("GetAWSInstanceStatus", "instance-7").Return(&InstanceStatus{State: ec2.InstanceStateNameRunning}, nil)
 			op, err := b.LastOperation(context.Background(), "instance-7", "d_instance-7")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.Failed))
 		})
 
 		It("returns 'failed' if the AWS state is unknown", func() {
-			m.On("GetAWSInstanceStatus", "instance-8").Return("unknown", nil)
+			m.On("GetAWSInstanceStatus", "instance-8").Return(&InstanceStatus{State: "unknown"}, nil)
 			op, err := b.LastOperation(context.Background(), "instance-8", "p_instance-8")
 			Expect(err).To(Not(HaveOccurred()))
 			Expect(op.State).To(Equal(brokerapi.Failed))
 		})
 
+		It("explains why a provision failed", func() {
+			m.On("GetAWSInstanceStatus", "instance-9").Return(&InstanceStatus{
+				State:         ec2.InstanceStateNameTerminated,
+				ReasonCode:    "Server.InsufficientInstanceCapacity",
+				ReasonMessage: "Server.InsufficientInstanceCapacity: Insufficient capacity",
+			}, nil)
+			op, err := b.LastOperation(context.Background(), "instance-9", "p_instance-9")
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(op.State).To(Equal(brokerapi.Failed))
+			Expect(op.Description).To(Equal("terminated: AWS does not have enough capacity for this instance type in the availability zone [insufficient-capacity]"))
+		})
+
+		It("falls back on the AWS message for reasons it doesn't know", func() {
+			m.On("GetAWSInstanceStatus", "instance-9").Return(&InstanceStatus{
+				State:         ec2.InstanceStateNameTerminated,
+				ReasonCode:    "Server.SomethingNew",
+				ReasonMessage: "Something new went wrong",
+			}, nil)
+			op, err := b.LastOperation(context.Background(), "instance-9", "p_instance-9")
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(op.Description).To(Equal("terminated: Something new went wrong [Server.SomethingNew]"))
+		})
+
+		It("includes the state transition reason when there is no state reason", func() {
+			m.On("GetAWSInstanceStatus", "instance-9").Return(&InstanceStatus{
+				State:            ec2.InstanceStateNameStopped,
+				TransitionReason: "User initiated (2017-03-01 12:00:00 GMT)",
+			}, nil)
+			m.On("ReleaseAWSElasticIP", "instance-9").Return(nil)
+			op, err := b.LastOperation(context.Background(), "instance-9", "d_instance-9")
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(op.Description).To(Equal("stopped: User initiated (2017-03-01 12:00:00 GMT)"))
+		})
+
 		It("returns an error if an AWS error occurs", func() {
-			m.On("GetAWSInstanceStatus", "instance-error").Return("", errors.New("AWS Error"))
+			m.On("GetAWSInstanceStatus", "instance-error").Return(nil, errors.New("AWS Error"))
 			_, err := b.LastOperation(context.Background(), "instance-error", "p_instance-error")
 			Expect(err).To(HaveOccurred())
 		})
 
+		It("follows the operation named by a signed token", func() {
+			m.On("TerminateAWSInstance", "instance-1").Return(ec2.InstanceStateNameShuttingDown, nil)
+			spec, err := b.Deprovision(context.Background(), "instance-1", brokerapi.DeprovisionDetails{}, true)
+			Expect(err).ToNot(HaveOccurred())
+			m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNameTerminated}, nil)
+			m.On("ReleaseAWSElasticIP", "instance-1").Return(nil)
+			op, err := b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.Succeeded))
+		})
+
+		It("deletes the record of an instance once its deprovision succeeds", func() {
+			m.On("TerminateAWSInstance", "instance-1").Return(ec2.InstanceStateNameShuttingDown, nil)
+			spec, err := b.Deprovision(context.Background(), "instance-1", brokerapi.DeprovisionDetails{}, true)
+			Expect(err).ToNot(HaveOccurred())
+			m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNameShuttingDown}, nil).Once()
+			_, err = b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			record, err := s.Get("instance-1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.LastOperation("deprovision").State).To(Equal(string(brokerapi.InProgress)))
+
+			m.On("GetAWSInstanceStatus", "instance-1").Return(&InstanceStatus{State: ec2.InstanceStateNameTerminated}, nil)
+			m.On("ReleaseAWSElasticIP", "instance-1").Return(nil)
+			op, err := b.LastOperation(context.Background(), "instance-1", spec.OperationData)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(op.State).To(Equal(brokerapi.Succeeded))
+			_, err = s.Get("instance-1")
+			Expect(err).To(Equal(store.ErrNotFound))
+		})
+
+		It("rejects a token that has been tampered with", func() {
+			m.On("TerminateAWSInstance", "instance-1").Return(ec2.InstanceStateNameShuttingDown, nil)
+			spec, err := b.Deprovision(context.Background(), "instance-1", brokerapi.DeprovisionDetails{}, true)
+			Expect(err).ToNot(HaveOccurred())
+			parts := strings.Split(spec.OperationData, ".")
+			parts[2] = strings.Repeat("A", len(parts[2]))
+			_, err = b.LastOperation(context.Background(), "instance-1", strings.Join(parts, "."))
+			Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+			m.AssertNotCalled(GinkgoT(), "GetAWSInstanceStatus", "instance-1")
+		})
+
+		It("rejects a token issued for another instance", func() {
+			m.On("TerminateAWSInstance", "instance-1").Return(ec2.InstanceStateNameShuttingDown, nil)
+			spec, err := b.Deprovision(context.Background(), "instance-1", brokerapi.DeprovisionDetails{}, true)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = b.LastOperation(context.Background(), "instance-2", spec.OperationData)
+			Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+		})
+
+		It("accepts no unversioned tokens other than those the broker issued before", func() {
+			_, err := b.LastOperation(context.Background(), "instance-1", "u_instance-1")
+			Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+		})
+
 		It("returns an error if operation data is not accurate", func() {
 			_, err := b.LastOperation(context.Background(), "instance-error", "")
 			Expect(err).To(HaveOccurred())
@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+/*
+CommandRunner sends shell commands to a running EC2 instance. The broker uses this channel to manage the authorized keys
+of the instances it has launched, so it never needs SSH access to the instances itself.
+*/
+type CommandRunner interface {
+	RunShellCommands(awsInstanceID string, commands []string) error
+}
+
+/*
+SSMCommandRunner runs shell commands using the AWS Systems Manager Run Command API. Instances must be running the SSM
+agent and have an instance profile that allows SSM to reach them.
+
+The vendored AWS SDK does not include the SSM service, so this speaks the SSM JSON protocol directly on top of the SDK's
+generic client, which still provides signing, retries and credentials.
+*/
+type SSMCommandRunner struct {
+	Client       *client.Client
+	PollInterval time.Duration
+	Timeout      time.Duration
+}
+
+const (
+	ssmServiceName  = "ssm"
+	ssmTargetPrefix = "AmazonSSM"
+)
+
+type ssmSendCommandInput struct {
+	DocumentName string              `json:"DocumentName"`
+	InstanceIds  []string            `json:"InstanceIds"`
+	Comment      string              `json:"Comment,omitempty"`
+	Parameters   map[string][]string `json:"Parameters"`
+}
+
+type ssmSendCommandOutput struct {
+	Command struct {
+		CommandID string `json:"CommandId"`
+	} `json:"Command"`
+}
+
+type ssmGetCommandInvocationInput struct {
+	CommandID  string `json:"CommandId"`
+	InstanceID string `json:"InstanceId"`
+}
+
+type ssmGetCommandInvocationOutput struct {
+	Status                string `json:"Status"`
+	StatusDetails         string `json:"StatusDetails"`
+	StandardErrorContent  string `json:"StandardErrorContent"`
+	StandardOutputContent string `json:"StandardOutputContent"`
+}
+
+/*
+NewSSMCommandRunner builds a command runner sharing the given AWS session
+*/
+func NewSSMCommandRunner(sess *session.Session) *SSMCommandRunner {
+	c := sess.ClientConfig(ssmServiceName)
+	svc := client.New(
+		*c.Config,
+		metadata.ClientInfo{
+			ServiceName:   ssmServiceName,
+			SigningRegion: c.SigningRegion,
+			Endpoint:      c.Endpoint,
+			APIVersion:    "2014-11-06",
+			JSONVersion:   "1.1",
+			TargetPrefix:  ssmTargetPrefix,
+		},
+		c.Handlers,
+	)
+	svc.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	svc.Handlers.Build.PushBack(buildSSMRequest)
+	svc.Handlers.Unmarshal.PushBack(unmarshalSSMResponse)
+	svc.Handlers.UnmarshalMeta.PushBack(unmarshalSSMMeta)
+	svc.Handlers.UnmarshalError.PushBack(unmarshalSSMError)
+
+	return &SSMCommandRunner{
+		Client:       svc,
+		PollInterval: 2 * time.Second,
+		Timeout:      45 * time.Second,
+	}
+}
+
+/*
+RunShellCommands runs the commands with the AWS-RunShellScript document and waits for them to complete, failing if the
+commands fail or do not finish within the runner's timeout.
+*/
+func (r *SSMCommandRunner) RunShellCommands(awsInstanceID string, commands []string) error {
+	sendOutput := &ssmSendCommandOutput{}
+	err := r.send("SendCommand", &ssmSendCommandInput{
+		DocumentName: "AWS-RunShellScript",
+		InstanceIds:  []string{awsInstanceID},
+		Comment:      "ec2-broker",
+		Parameters:   map[string][]string{"commands": commands},
+	}, sendOutput)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(r.Timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(r.PollInterval)
+		invocation := &ssmGetCommandInvocationOutput{}
+		err = r.send("GetCommandInvocation", &ssmGetCommandInvocationInput{
+			CommandID:  sendOutput.Command.CommandID,
+			InstanceID: awsInstanceID,
+		}, invocation)
+		if err != nil {
+			// The invocation is not always visible immediately after the command is sent
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvocationDoesNotExist" {
+				continue
+			}
+			return err
+		}
+		switch invocation.Status {
+		case "Success":
+			return nil
+		case "Pending", "InProgress", "Delayed":
+			continue
+		default:
+			return fmt.Errorf("Command %s on %s finished with status %s: %s", sendOutput.Command.CommandID, awsInstanceID, invocation.Status, strings.TrimSpace(invocation.StandardErrorContent))
+		}
+	}
+	return fmt.Errorf("Timed out waiting for command %s on %s", sendOutput.Command.CommandID, awsInstanceID)
+}
+
+func (r *SSMCommandRunner) send(operation string, input, output interface{}) error {
+	op := &request.Operation{
+		Name:       operation,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	return r.Client.NewRequest(op, input, output).Send()
+}
+
+// Private functions implementing the JSON 1.1 protocol used by SSM
+
+func buildSSMRequest(r *request.Request) {
+	body, err := json.Marshal(r.Params)
+	if err != nil {
+		r.Error = awserr.New("SerializationError", "failed encoding SSM request", err)
+		return
+	}
+	r.SetBufferBody(body)
+	r.HTTPRequest.Header.Set("X-Amz-Target", r.ClientInfo.TargetPrefix+"."+r.Operation.Name)
+	r.HTTPRequest.Header.Set("Content-Type", "application/x-amz-json-"+r.ClientInfo.JSONVersion)
+}
+
+func unmarshalSSMResponse(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	if r.DataFilled() {
+		err := json.NewDecoder(r.HTTPResponse.Body).Decode(r.Data)
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed decoding SSM response", err)
+		}
+	}
+}
+
+func unmarshalSSMMeta(r *request.Request) {
+	r.RequestID = r.HTTPResponse.Header.Get("X-Amzn-Requestid")
+}
+
+func unmarshalSSMError(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	var body struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	err := json.NewDecoder(r.HTTPResponse.Body).Decode(&body)
+	if err != nil {
+		r.Error = awserr.NewRequestFailure(awserr.New("SerializationError", "failed decoding SSM error", err), r.HTTPResponse.StatusCode, r.RequestID)
+		return
+	}
+	// Error types are sometimes namespaced, as in "com.amazonaws.ssm#InvalidInstanceId"
+	code := body.Type[strings.LastIndex(body.Type, "#")+1:]
+	r.Error = awserr.NewRequestFailure(awserr.New(code, body.Message, nil), r.HTTPResponse.StatusCode, r.RequestID)
+}
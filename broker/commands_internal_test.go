@@ -0,0 +1,138 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// A request the stub SSM endpoint received
+type ssmRequest struct {
+	target      string
+	contentType string
+	body        map[string]interface{}
+}
+
+// A response the stub SSM endpoint gives
+type ssmResponse struct {
+	status int
+	body   string
+}
+
+var _ = Describe("SSM command runner", func() {
+	var (
+		server      *httptest.Server
+		runner      *SSMCommandRunner
+		requests    []ssmRequest
+		invocations []ssmResponse
+		sent        ssmResponse
+	)
+
+	BeforeEach(func() {
+		requests, invocations = nil, nil
+		sent = ssmResponse{200, `{"Command": {"CommandId": "command-1"}}`}
+		// Answers SendCommand with sent, and each GetCommandInvocation with the next of invocations, or as still in
+		// progress once they run out
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			data, _ := ioutil.ReadAll(req.Body)
+			request := ssmRequest{target: req.Header.Get("X-Amz-Target"), contentType: req.Header.Get("Content-Type")}
+			json.Unmarshal(data, &request.body)
+			requests = append(requests, request)
+			response := ssmResponse{200, `{"Status": "InProgress"}`}
+			if request.target == "AmazonSSM.SendCommand" {
+				response = sent
+			} else if len(invocations) > 0 {
+				response, invocations = invocations[0], invocations[1:]
+			}
+			w.Header().Set("X-Amzn-Requestid", "request-1")
+			w.WriteHeader(response.status)
+			w.Write([]byte(response.body))
+		}))
+		runner = NewSSMCommandRunner(session.New(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(server.URL),
+			Credentials: credentials.NewStaticCredentials("access-key", "secret-key", ""),
+			MaxRetries:  aws.Int(0),
+		}))
+		runner.PollInterval = time.Millisecond
+		runner.Timeout = 200 * time.Millisecond
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("sends the commands as an AWS-RunShellScript document over the SSM JSON protocol", func() {
+		invocations = []ssmResponse{{200, `{"Status": "Success"}`}}
+		Expect(runner.RunShellCommands("i-1", []string{"set -e", "echo 'it''s'"})).To(Succeed())
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0].target).To(Equal("AmazonSSM.SendCommand"))
+		Expect(requests[0].contentType).To(Equal("application/x-amz-json-1.1"))
+		Expect(requests[0].body).To(Equal(map[string]interface{}{
+			"DocumentName": "AWS-RunShellScript",
+			"InstanceIds":  []interface{}{"i-1"},
+			"Comment":      "ec2-broker",
+			"Parameters":   map[string]interface{}{"commands": []interface{}{"set -e", "echo 'it''s'"}},
+		}))
+		Expect(requests[1].target).To(Equal("AmazonSSM.GetCommandInvocation"))
+		Expect(requests[1].body).To(Equal(map[string]interface{}{"CommandId": "command-1", "InstanceId": "i-1"}))
+	})
+
+	It("reports SSM errors by their code, without the namespace", func() {
+		sent = ssmResponse{400, `{"__type": "com.amazonaws.ssm#InvalidInstanceId", "message": "Instances not in a valid state"}`}
+		err := runner.RunShellCommands("i-1", []string{"true"})
+		aerr, ok := err.(awserr.RequestFailure)
+		Expect(ok).To(BeTrue())
+		Expect(aerr.Code()).To(Equal("InvalidInstanceId"))
+		Expect(aerr.Message()).To(Equal("Instances not in a valid state"))
+		Expect(aerr.StatusCode()).To(Equal(400))
+		Expect(aerr.RequestID()).To(Equal("request-1"))
+		Expect(requests).To(HaveLen(1))
+	})
+
+	It("reports an error response it can't decode", func() {
+		sent = ssmResponse{500, `<html>Bad Gateway</html>`}
+		err := runner.RunShellCommands("i-1", []string{"true"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(awserr.Error).Code()).To(Equal("SerializationError"))
+	})
+
+	table.DescribeTable("waiting for the command to finish",
+		func(responses []ssmResponse, polls int, failure string) {
+			invocations = responses
+			err := runner.RunShellCommands("i-1", []string{"true"})
+			if failure == "" {
+				Expect(err).ToNot(HaveOccurred())
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(failure)))
+			}
+			if polls > 0 {
+				Expect(requests).To(HaveLen(1 + polls))
+			}
+		},
+		table.Entry("succeeds once the command succeeds",
+			[]ssmResponse{{200, `{"Status": "Success"}`}}, 1, ""),
+		table.Entry("keeps polling while the command is pending, in progress or delayed",
+			[]ssmResponse{{200, `{"Status": "Pending"}`}, {200, `{"Status": "InProgress"}`}, {200, `{"Status": "Delayed"}`}, {200, `{"Status": "Success"}`}}, 4, ""),
+		table.Entry("keeps polling until the invocation is visible",
+			[]ssmResponse{{400, `{"__type": "InvocationDoesNotExist", "message": "not yet"}`}, {200, `{"Status": "Success"}`}}, 2, ""),
+		table.Entry("fails with the standard error of a failed command",
+			[]ssmResponse{{200, `{"Status": "Failed", "StandardErrorContent": "getent: no such user\n"}`}}, 1, "Command command-1 on i-1 finished with status Failed: getent: no such user"),
+		table.Entry("fails on a cancelled command",
+			[]ssmResponse{{200, `{"Status": "Cancelled"}`}}, 1, "finished with status Cancelled"),
+		table.Entry("fails on any other error",
+			[]ssmResponse{{400, `{"__type": "InvalidCommandId", "message": "no such command"}`}}, 1, "no such command"),
+		table.Entry("times out on a command that never finishes",
+			nil, 0, "Timed out waiting for command command-1 on i-1"),
+	)
+})
@@ -0,0 +1,181 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+/*
+DiscoveryCache holds the IDs of the AMIs, subnets and security groups found by a plan's tag selectors, so that requests
+don't each have to search AWS. Entries expire after the configured TTL; if a search then fails, the expired IDs are
+used until a search succeeds.
+*/
+type DiscoveryCache struct {
+	mu      sync.Mutex
+	entries map[string]discoveryEntry
+	now     func() time.Time
+}
+
+type discoveryEntry struct {
+	ids     []string
+	expires time.Time
+}
+
+/*
+NewDiscoveryCache creates an empty discovery cache
+*/
+func NewDiscoveryCache() *DiscoveryCache {
+	return &DiscoveryCache{
+		entries: make(map[string]discoveryEntry),
+		now:     time.Now,
+	}
+}
+
+// Returns the cached IDs for the key, searching again with fetch once they have expired
+func (c *DiscoveryCache) lookup(key string, ttl time.Duration, fetch func() ([]string, error)) ([]string, error) {
+	c.mu.Lock()
+	entry, found := c.entries[key]
+	c.mu.Unlock()
+	if found && c.now().Before(entry.expires) {
+		return entry.ids, nil
+	}
+	ids, err := fetch()
+	if err != nil {
+		if found {
+			config.GetLogger().Error("using-expired-discovery", err, lager.Data{"key": key})
+			return entry.ids, nil
+		}
+		return nil, err
+	}
+	c.mu.Lock()
+	c.entries[key] = discoveryEntry{ids: ids, expires: c.now().Add(ttl)}
+	c.mu.Unlock()
+	return ids, nil
+}
+
+// How long discovered IDs are cached for
+func discoveryTTL(conf *config.Config) time.Duration {
+	if conf.DiscoveryTTLSeconds > 0 {
+		return time.Duration(conf.DiscoveryTTLSeconds) * time.Second
+	}
+	return time.Duration(config.DefaultDiscoveryTTLSeconds) * time.Second
+}
+
+// Builds the EC2 filters for a tag selector. A selector matches resources having every tag it lists with the given
+// value, or with any value when the value is empty.
+func selectorFilters(selector map[string]string) []*ec2.Filter {
+	keys := make([]string, 0, len(selector))
+	for key := range selector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	filters := make([]*ec2.Filter, 0, len(keys))
+	for _, key := range keys {
+		if selector[key] == "" {
+			filters = append(filters, &ec2.Filter{Name: aws.String("tag-key"), Values: []*string{aws.String(key)}})
+			continue
+		}
+		filters = append(filters, &ec2.Filter{Name: aws.String("tag:" + key), Values: []*string{aws.String(selector[key])}})
+	}
+	return filters
+}
+
+// A cache key naming a kind of resource and a selector
+func selectorKey(kind string, selector map[string]string) string {
+	pairs := make([]string, 0, len(selector))
+	for key, value := range selector {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return kind + ":" + strings.Join(pairs, ",")
+}
+
+/*
+ResolvePlan returns a copy of the plan whose allowed AMIs, subnets and security groups also include those found by the
+plan's tag selectors
+*/
+func (m *AWSManager) ResolvePlan(plan *config.PlanConfig) (*config.PlanConfig, error) {
+	resolved := *plan
+	var err error
+	resolved.AllowedAMIs, err = m.discover("image", plan.AMISelector, plan.AllowedAMIs, m.findImages)
+	if err != nil {
+		return nil, err
+	}
+	resolved.AllowedSubnets, err = m.discover("subnet", plan.SubnetSelector, plan.AllowedSubnets, m.findSubnets)
+	if err != nil {
+		return nil, err
+	}
+	resolved.AllowedSecurityGroups, err = m.discover("security-group", plan.SecurityGroupSelector, plan.AllowedSecurityGroups, m.findSecurityGroups)
+	if err != nil {
+		return nil, err
+	}
+	return &resolved, nil
+}
+
+// Adds the IDs found by a selector to a static list of IDs
+func (m *AWSManager) discover(kind string, selector map[string]string, static []string, find func([]*ec2.Filter) ([]string, error)) ([]string, error) {
+	if len(selector) == 0 {
+		return static, nil
+	}
+	fetch := func() ([]string, error) {
+		return find(selectorFilters(selector))
+	}
+	var ids []string
+	var err error
+	if m.Discovery != nil {
+		ids, err = m.Discovery.lookup(selectorKey(kind, selector), discoveryTTL(config.GetConfiguration()), fetch)
+	} else {
+		ids, err = fetch()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find %ss for plan: %s", strings.Replace(kind, "-", " ", -1), err)
+	}
+	return append(append([]string{}, static...), ids...), nil
+}
+
+func (m *AWSManager) findImages(filters []*ec2.Filter) ([]string, error) {
+	output, err := m.Client.DescribeImages(&ec2.DescribeImagesInput{
+		Filters: append(filters, &ec2.Filter{Name: aws.String("state"), Values: []*string{aws.String(ec2.ImageStateAvailable)}}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(output.Images))
+	for i, image := range output.Images {
+		ids[i] = aws.StringValue(image.ImageId)
+	}
+	return ids, nil
+}
+
+func (m *AWSManager) findSubnets(filters []*ec2.Filter) ([]string, error) {
+	output, err := m.Client.DescribeSubnets(&ec2.DescribeSubnetsInput{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(output.Subnets))
+	for i, subnet := range output.Subnets {
+		ids[i] = aws.StringValue(subnet.SubnetId)
+	}
+	return ids, nil
+}
+
+func (m *AWSManager) findSecurityGroups(filters []*ec2.Filter) ([]string, error) {
+	output, err := m.Client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(output.SecurityGroups))
+	for i, group := range output.SecurityGroups {
+		ids[i] = aws.StringValue(group.GroupId)
+	}
+	return ids, nil
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Discovery", func() {
+	Describe("selector filters", func() {
+		It("filters on each tag in a stable order", func() {
+			filters := selectorFilters(map[string]string{"cg:ec2broker:plan": "micro", "approved": ""})
+			Expect(filters).To(HaveLen(2))
+			Expect(aws.StringValue(filters[0].Name)).To(Equal("tag-key"))
+			Expect(aws.StringValueSlice(filters[0].Values)).To(Equal([]string{"approved"}))
+			Expect(aws.StringValue(filters[1].Name)).To(Equal("tag:cg:ec2broker:plan"))
+			Expect(aws.StringValueSlice(filters[1].Values)).To(Equal([]string{"micro"}))
+		})
+
+		It("keys the cache by kind and selector", func() {
+			Expect(selectorKey("image", map[string]string{"b": "2", "a": "1"})).To(Equal("image:a=1,b=2"))
+		})
+	})
+
+	Describe("cache", func() {
+		var (
+			cache    *DiscoveryCache
+			now      time.Time
+			fetches  int
+			fetched  []string
+			fetchErr error
+			fetch    func() ([]string, error)
+		)
+
+		BeforeEach(func() {
+			now = time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+			cache = NewDiscoveryCache()
+			cache.now = func() time.Time { return now }
+			fetches, fetched, fetchErr = 0, []string{"ami-1"}, nil
+			fetch = func() ([]string, error) {
+				fetches++
+				return fetched, fetchErr
+			}
+		})
+
+		It("searches again only once the entry expires", func() {
+			Expect(cache.lookup("key", time.Minute, fetch)).To(Equal([]string{"ami-1"}))
+			fetched = []string{"ami-1", "ami-2"}
+			Expect(cache.lookup("key", time.Minute, fetch)).To(Equal([]string{"ami-1"}))
+			Expect(fetches).To(Equal(1))
+			now = now.Add(2 * time.Minute)
+			Expect(cache.lookup("key", time.Minute, fetch)).To(Equal([]string{"ami-1", "ami-2"}))
+			Expect(fetches).To(Equal(2))
+		})
+
+		It("uses expired entries when the search fails", func() {
+			Expect(cache.lookup("key", time.Minute, fetch)).To(Equal([]string{"ami-1"}))
+			now = now.Add(2 * time.Minute)
+			fetchErr = errors.New("AWS failure")
+			Expect(cache.lookup("key", time.Minute, fetch)).To(Equal([]string{"ami-1"}))
+		})
+
+		It("fails when there is nothing cached to fall back on", func() {
+			fetchErr = errors.New("AWS failure")
+			_, err := cache.lookup("key", time.Minute, fetch)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
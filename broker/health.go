@@ -0,0 +1,395 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+// How long a readiness result is reused, so frequent probes do not turn into a stream of AWS calls
+const readinessTTL = 30 * time.Second
+
+/*
+HealthCheck is the result of one of the checks behind readiness. Problems names everything the check found wrong.
+*/
+type HealthCheck struct {
+	Name     string   `json:"name"`
+	OK       bool     `json:"ok"`
+	Detail   string   `json:"detail,omitempty"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+/*
+Readiness is the answer to a readiness probe
+*/
+type Readiness struct {
+	Ready     bool          `json:"ready"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Checks    []HealthCheck `json:"checks"`
+}
+
+/*
+HealthChecker answers the platform's liveness and readiness probes. The broker is ready when its configuration is sound,
+its AWS credentials work, the AMIs, subnets and security groups its plans list still exist, and its plans' tag selectors
+and image families still find something to launch with.
+*/
+type HealthChecker struct {
+	Manager *AWSManager
+	STS     *sts.STS
+	mutex   sync.Mutex
+	last    *Readiness
+	now     func() time.Time
+}
+
+/*
+NewHealthChecker creates a health checker using the manager's AWS session
+*/
+func NewHealthChecker(m *AWSManager) *HealthChecker {
+	client := sts.New(m.Session)
+	instrumentAWSRequests(&client.Handlers)
+	return &HealthChecker{Manager: m, STS: client, now: time.Now}
+}
+
+/*
+Liveness answers that the broker is up
+*/
+func (h *HealthChecker) Liveness(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+/*
+Readiness answers whether the broker can serve requests, with 503 Service Unavailable when it cannot. Probes are not
+authenticated, so only the name and outcome of each check is given; ReadinessReport gives their details.
+*/
+func (h *HealthChecker) Readiness(w http.ResponseWriter, req *http.Request) {
+	readiness := h.Check()
+	writeJSON(w, readinessStatus(readiness), readiness.summary())
+}
+
+/*
+ReadinessReport answers as Readiness does, along with the details and problems of each check, which name the broker's
+AWS identity and resources. It belongs behind the broker's credentials.
+*/
+func (h *HealthChecker) ReadinessReport(w http.ResponseWriter, req *http.Request) {
+	readiness := h.Check()
+	writeJSON(w, readinessStatus(readiness), readiness)
+}
+
+// The HTTP status answering a readiness probe
+func readinessStatus(readiness *Readiness) int {
+	if !readiness.Ready {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// The readiness without the details and problems of its checks
+func (r *Readiness) summary() *Readiness {
+	summary := &Readiness{Ready: r.Ready, CheckedAt: r.CheckedAt, Checks: make([]HealthCheck, len(r.Checks))}
+	for i, check := range r.Checks {
+		summary.Checks[i] = HealthCheck{Name: check.Name, OK: check.OK}
+	}
+	return summary
+}
+
+/*
+Check runs the readiness checks, or returns the last result if it is recent enough
+*/
+func (h *HealthChecker) Check() *Readiness {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.last != nil && h.now().Sub(h.last.CheckedAt) < readinessTTL {
+		return h.last
+	}
+	conf := config.GetConfiguration()
+	readiness := &Readiness{Ready: true, CheckedAt: h.now().UTC()}
+	readiness.Checks = append(readiness.Checks, checkConfiguration(conf))
+	readiness.Checks = append(readiness.Checks, h.checkCredentials())
+	amis, subnets, groups := configuredResources(conf)
+	readiness.Checks = append(readiness.Checks,
+		checkResources("amis", amis, h.Manager.existingImages),
+		checkResources("subnets", subnets, h.Manager.existingSubnets),
+		checkResources("security_groups", groups, h.Manager.existingSecurityGroups),
+		checkPlans(conf, h.Manager.ResolvePlan, h.Manager.ResolveAWSImage),
+	)
+	for _, check := range readiness.Checks {
+		if !check.OK {
+			readiness.Ready = false
+			config.GetLogger().Info("not-ready", lager.Data{"check": check.Name, "problems": check.Problems})
+		}
+	}
+	h.last = readiness
+	return readiness
+}
+
+// Checks the configuration has what the broker needs to serve its catalog and launch instances
+func checkConfiguration(conf *config.Config) HealthCheck {
+	check := HealthCheck{Name: "config"}
+	if errs, ok := conf.Validate().(config.ValidationErrors); ok {
+		for _, err := range errs {
+			check.Problems = append(check.Problems, err.Error())
+		}
+	}
+	check.OK = len(check.Problems) == 0
+	return check
+}
+
+// Checks the broker's AWS credentials by asking AWS whose they are
+func (h *HealthChecker) checkCredentials() HealthCheck {
+	check := HealthCheck{Name: "credentials"}
+	output, err := h.STS.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		check.Problems = []string{err.Error()}
+		return check
+	}
+	check.OK = true
+	check.Detail = aws.StringValue(output.Arn)
+	return check
+}
+
+// The AMIs, subnets and security groups the plans of every service list, without duplicates
+func configuredResources(conf *config.Config) (amis, subnets, groups []string) {
+	if conf == nil {
+		return
+	}
+	add := func(list []string, ids []string) []string {
+		for _, id := range ids {
+			if !stringIn(id, list) {
+				list = append(list, id)
+			}
+		}
+		return list
+	}
+	for _, service := range conf.ServiceConfigs() {
+		for _, plan := range service.Plans {
+			amis = add(amis, plan.AllowedAMIs)
+			subnets = add(subnets, plan.AllowedSubnets)
+			groups = add(groups, plan.AllowedSecurityGroups)
+		}
+	}
+	sort.Strings(amis)
+	sort.Strings(subnets)
+	sort.Strings(groups)
+	return
+}
+
+// Checks that each of the resources exists, given a function finding which of them do
+func checkResources(name string, ids []string, existing func([]string) ([]string, error)) HealthCheck {
+	check := HealthCheck{Name: name, Detail: fmt.Sprintf("%d configured", len(ids))}
+	if len(ids) == 0 {
+		check.OK = true
+		return check
+	}
+	found, err := existing(ids)
+	if err != nil {
+		check.Problems = []string{err.Error()}
+		return check
+	}
+	for _, id := range ids {
+		if !stringIn(id, found) {
+			check.Problems = append(check.Problems, fmt.Sprintf("%s was not found", id))
+		}
+	}
+	check.OK = len(check.Problems) == 0
+	return check
+}
+
+// Checks that every plan has AMIs, subnets and security groups to launch with once its tag selectors and image families
+// are resolved, which checkResources cannot see
+func checkPlans(conf *config.Config, resolvePlan func(*config.PlanConfig) (*config.PlanConfig, error), resolveImage func(*config.PlanConfig, string) (string, error)) HealthCheck {
+	check := HealthCheck{Name: "plans"}
+	count := 0
+	for _, service := range conf.ServiceConfigs() {
+		for i := range service.Plans {
+			count++
+			for _, problem := range planProblems(&service.Plans[i], resolvePlan, resolveImage) {
+				check.Problems = append(check.Problems, fmt.Sprintf("plan %s %s", service.Plans[i].ID, problem))
+			}
+		}
+	}
+	check.Detail = fmt.Sprintf("%d configured", count)
+	check.OK = len(check.Problems) == 0
+	return check
+}
+
+// What keeps a plan from launching instances once its tag selectors and image families are resolved: a selector the
+// plan relies on finding nothing, or an image family without an available image. Whether the resources the plan lists by
+// ID exist is left to checkResources.
+func planProblems(plan *config.PlanConfig, resolvePlan func(*config.PlanConfig) (*config.PlanConfig, error), resolveImage func(*config.PlanConfig, string) (string, error)) []string {
+	resolved, err := resolvePlan(plan)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot be resolved: %s", err)}
+	}
+	problems := []string{}
+	if len(resolved.AllowedAMIs) == 0 && len(plan.ImageFamilies) == 0 {
+		problems = append(problems, "allows no AMIs")
+	}
+	for _, family := range plan.ImageFamilies {
+		if _, err := resolveImage(plan, family.Name); err != nil {
+			problems = append(problems, fmt.Sprintf("image family %s cannot be resolved: %s", family.Name, err))
+		}
+	}
+	if len(resolved.AllowedSubnets) == 0 {
+		problems = append(problems, "allows no subnets")
+	}
+	if len(resolved.AllowedSecurityGroups) == 0 {
+		problems = append(problems, "allows no security groups")
+	}
+	return problems
+}
+
+// Which of the AMIs exist and are available. Like subnets and security groups below, they are looked up through a filter,
+// since AWS fails the whole call when asked for a missing resource by ID.
+func (m *AWSManager) existingImages(ids []string) ([]string, error) {
+	output, err := m.Client.DescribeImages(&ec2.DescribeImagesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("image-id"), Values: aws.StringSlice(ids)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	found := []string{}
+	for _, image := range output.Images {
+		if aws.StringValue(image.State) == ec2.ImageStateAvailable {
+			found = append(found, aws.StringValue(image.ImageId))
+		}
+	}
+	return found, nil
+}
+
+// Which of the subnets exist
+func (m *AWSManager) existingSubnets(ids []string) ([]string, error) {
+	output, err := m.Client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("subnet-id"), Values: aws.StringSlice(ids)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	found := []string{}
+	for _, subnet := range output.Subnets {
+		found = append(found, aws.StringValue(subnet.SubnetId))
+	}
+	return found, nil
+}
+
+// Which of the security groups exist
+func (m *AWSManager) existingSecurityGroups(ids []string) ([]string, error) {
+	output, err := m.Client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("group-id"), Values: aws.StringSlice(ids)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	found := []string{}
+	for _, group := range output.SecurityGroups {
+		found = append(found, aws.StringValue(group.GroupId))
+	}
+	return found, nil
+}
+
+// Writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+/*
+ValidateResources checks that the AMIs, subnets, security groups and key pairs the configuration names exist in the
+region the manager's session uses, and that the plans' tag selectors and image families find something to launch with,
+returning config.ValidationErrors naming each problem, or nil
+*/
+func ValidateResources(m *AWSManager, conf *config.Config) error {
+	errs := config.ValidationErrors{}
+	amis, subnets, groups := configuredResources(conf)
+	lookups := []struct {
+		field    string
+		ids      []string
+		existing func([]string) ([]string, error)
+		listed   func(plan *config.PlanConfig) []string
+	}{
+		{"allowed_amis", amis, m.existingImages, func(plan *config.PlanConfig) []string { return plan.AllowedAMIs }},
+		{"allowed_subnets", subnets, m.existingSubnets, func(plan *config.PlanConfig) []string { return plan.AllowedSubnets }},
+		{"allowed_security_groups", groups, m.existingSecurityGroups, func(plan *config.PlanConfig) []string { return plan.AllowedSecurityGroups }},
+	}
+	services := configuredServices(conf)
+	for _, lookup := range lookups {
+		if len(lookup.ids) == 0 {
+			continue
+		}
+		found, err := lookup.existing(lookup.ids)
+		if err != nil {
+			errs = append(errs, config.ValidationError{Path: "$.plans[*]." + lookup.field, Message: fmt.Sprintf("cannot be checked: %s", err)})
+			continue
+		}
+		for _, service := range services {
+			for i := range service.plans {
+				for j, id := range lookup.listed(&service.plans[i]) {
+					if !stringIn(id, found) {
+						errs = append(errs, config.ValidationError{
+							Path:    fmt.Sprintf("%s.plans[%d].%s[%d]", service.path, i, lookup.field, j),
+							Message: fmt.Sprintf("%s was not found in %s", id, aws.StringValue(m.Session.Config.Region)),
+						})
+					}
+				}
+			}
+		}
+	}
+	for _, service := range services {
+		for i := range service.plans {
+			for _, problem := range planProblems(&service.plans[i], m.ResolvePlan, m.ResolveAWSImage) {
+				errs = append(errs, config.ValidationError{Path: fmt.Sprintf("%s.plans[%d]", service.path, i), Message: problem})
+			}
+		}
+	}
+	for _, service := range services {
+		if service.keyPairName == "" {
+			continue
+		}
+		output, err := m.Client.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{
+			Filters: []*ec2.Filter{{Name: aws.String("key-name"), Values: []*string{aws.String(service.keyPairName)}}},
+		})
+		if err != nil {
+			errs = append(errs, config.ValidationError{Path: service.path + ".keypair_name", Message: fmt.Sprintf("cannot be checked: %s", err)})
+		} else if len(output.KeyPairs) == 0 {
+			errs = append(errs, config.ValidationError{Path: service.path + ".keypair_name", Message: fmt.Sprintf("key pair %s was not found", service.keyPairName)})
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// A service's plans and key pair, with the JSON path they are configured at
+type configuredService struct {
+	path        string
+	plans       []config.PlanConfig
+	keyPairName string
+}
+
+// The services as configured: the top level for a single service configuration, or each of the services. A service's
+// key pair is only listed where it is set, so an inherited one is checked once.
+func configuredServices(conf *config.Config) []configuredService {
+	if len(conf.Services) == 0 {
+		return []configuredService{{path: "$", plans: conf.Plans, keyPairName: conf.KeyPairName}}
+	}
+	services := []configuredService{{path: "$", keyPairName: conf.KeyPairName}}
+	for i, service := range conf.Services {
+		services = append(services, configuredService{
+			path:        fmt.Sprintf("$.services[%d]", i),
+			plans:       service.Plans,
+			keyPairName: service.KeyPairName,
+		})
+	}
+	return services
+}
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+var _ = Describe("Health", func() {
+	var conf *config.Config
+
+	BeforeEach(func() {
+		conf = &config.Config{
+			Region:          "us-east-1",
+			ServiceID:       "service-id",
+			ServiceName:     "ec2",
+			BrokerUsername:  "user",
+			BrokerPassword:  "password",
+			OperationSecret: "secret",
+			Plans: []config.PlanConfig{
+				{ID: "plan-1", Name: "micro", InstanceType: "t2.micro", AllowedAMIs: []string{"ami-22222222", "ami-11111111"}, AllowedSubnets: []string{"subnet-11111111"}, AllowedSecurityGroups: []string{"sg-11111111"}},
+				{ID: "plan-2", Name: "large", InstanceType: "t2.large", AllowedAMIs: []string{"ami-11111111"}, AllowedSubnets: []string{"subnet-11111111"}, AllowedSecurityGroups: []string{"sg-11111111"}},
+			},
+		}
+	})
+
+	It("accepts a sound configuration", func() {
+		check := checkConfiguration(conf)
+		Expect(check.OK).To(BeTrue())
+		Expect(check.Problems).To(BeEmpty())
+	})
+
+	It("reports the problems with the configuration", func() {
+		conf.Region = ""
+		check := checkConfiguration(conf)
+		Expect(check.OK).To(BeFalse())
+		Expect(check.Problems).To(Equal([]string{"$.region: is required"}))
+	})
+
+	It("lists the resources the plans name once each", func() {
+		amis, subnets, groups := configuredResources(conf)
+		Expect(amis).To(Equal([]string{"ami-11111111", "ami-22222222"}))
+		Expect(subnets).To(Equal([]string{"subnet-11111111"}))
+		Expect(groups).To(Equal([]string{"sg-11111111"}))
+	})
+
+	It("names the resources that are missing", func() {
+		check := checkResources("amis", []string{"ami-1", "ami-2"}, func(ids []string) ([]string, error) {
+			return []string{"ami-1"}, nil
+		})
+		Expect(check.OK).To(BeFalse())
+		Expect(check.Problems).To(Equal([]string{"ami-2 was not found"}))
+	})
+
+	Describe("plans", func() {
+		var (
+			resolvePlan  func(*config.PlanConfig) (*config.PlanConfig, error)
+			resolveImage func(*config.PlanConfig, string) (string, error)
+		)
+
+		BeforeEach(func() {
+			resolvePlan = func(plan *config.PlanConfig) (*config.PlanConfig, error) {
+				return plan, nil
+			}
+			resolveImage = func(plan *config.PlanConfig, image string) (string, error) {
+				return "", errors.New("No available image in family " + image)
+			}
+		})
+
+		It("accepts plans with something to launch", func() {
+			check := checkPlans(conf, resolvePlan, resolveImage)
+			Expect(check.OK).To(BeTrue())
+			Expect(check.Detail).To(Equal("2 configured"))
+		})
+
+		It("names plans whose tag selectors find nothing", func() {
+			conf.Plans[1].AllowedAMIs = nil
+			conf.Plans[1].AMISelector = map[string]string{"approved": ""}
+			conf.Plans[1].AllowedSubnets = nil
+			conf.Plans[1].SubnetSelector = map[string]string{"tier": "app"}
+			check := checkPlans(conf, resolvePlan, resolveImage)
+			Expect(check.OK).To(BeFalse())
+			Expect(check.Problems).To(Equal([]string{"plan plan-2 allows no AMIs", "plan plan-2 allows no subnets"}))
+		})
+
+		It("names plans whose image families cannot be resolved", func() {
+			conf.Plans[0].AllowedAMIs = nil
+			conf.Plans[0].ImageFamilies = []config.ImageFamily{{Name: "ubuntu"}}
+			check := checkPlans(conf, resolvePlan, resolveImage)
+			Expect(check.OK).To(BeFalse())
+			Expect(check.Problems).To(Equal([]string{"plan plan-1 image family ubuntu cannot be resolved: No available image in family ubuntu"}))
+		})
+
+		It("names plans whose tag selectors fail", func() {
+			resolvePlan = func(plan *config.PlanConfig) (*config.PlanConfig, error) {
+				return nil, errors.New("UnauthorizedOperation")
+			}
+			check := checkPlans(conf, resolvePlan, resolveImage)
+			Expect(check.Problems).To(ContainElement("plan plan-1 cannot be resolved: UnauthorizedOperation"))
+		})
+	})
+
+	It("keeps the details of each check out of the unauthenticated answer", func() {
+		readiness := &Readiness{Checks: []HealthCheck{
+			{Name: "credentials", OK: true, Detail: "arn:aws:sts::123456789012:assumed-role/broker"},
+			{Name: "subnets", Problems: []string{"subnet-1 was not found"}},
+		}}
+		summary := readiness.summary()
+		Expect(summary.Checks).To(Equal([]HealthCheck{{Name: "credentials", OK: true}, {Name: "subnets"}}))
+		Expect(readiness.Checks[0].Detail).ToNot(BeEmpty())
+	})
+
+	It("fails when the resources cannot be looked up", func() {
+		check := checkResources("subnets", []string{"subnet-1"}, func(ids []string) ([]string, error) {
+			return nil, errors.New("UnauthorizedOperation")
+		})
+		Expect(check.OK).To(BeFalse())
+		Expect(check.Problems).To(Equal([]string{"UnauthorizedOperation"}))
+	})
+})
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+// Splits an image reference of the form "family" or "family@version". The version "latest" is the same as none.
+func parseImageReference(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		if image[i+1:] == "latest" {
+			return image[:i], ""
+		}
+		return image[:i], image[i+1:]
+	}
+	return image, ""
+}
+
+// Finds the plan's image family for an image reference
+func findImageFamily(plan *config.PlanConfig, image string) *config.ImageFamily {
+	name, _ := parseImageReference(image)
+	for i := range plan.ImageFamilies {
+		if plan.ImageFamilies[i].Name == name {
+			return &plan.ImageFamilies[i]
+		}
+	}
+	return nil
+}
+
+// Picks the newest image matching the version, if there is one. Creation dates are ISO 8601, so they sort as strings.
+func newestImage(images []*ec2.Image, versionTag, version string) *ec2.Image {
+	var newest *ec2.Image
+	for _, image := range images {
+		if version != "" && !imageHasVersion(image, versionTag, version) {
+			continue
+		}
+		if newest == nil || aws.StringValue(image.CreationDate) > aws.StringValue(newest.CreationDate) {
+			newest = image
+		}
+	}
+	return newest
+}
+
+func imageHasVersion(image *ec2.Image, versionTag, version string) bool {
+	if versionTag != "" {
+		for _, tag := range image.Tags {
+			if aws.StringValue(tag.Key) == versionTag && aws.StringValue(tag.Value) == version {
+				return true
+			}
+		}
+	}
+	return strings.HasPrefix(aws.StringValue(image.CreationDate), version)
+}
+
+/*
+ResolveAWSImage finds the AMI an image reference ("family" or "family@version") stands for under the given plan
+*/
+func (m *AWSManager) ResolveAWSImage(plan *config.PlanConfig, image string) (string, error) {
+	family := findImageFamily(plan, image)
+	if family == nil {
+		return "", fmt.Errorf("Plan %s has no image family named %s", plan.ID, image)
+	}
+	_, version := parseImageReference(image)
+	output, err := m.Client.DescribeImages(familyImagesInput(family))
+	if err != nil {
+		return "", err
+	}
+	newest := newestImage(output.Images, family.VersionTag, version)
+	if newest == nil {
+		return "", fmt.Errorf("No available image in family %s matches %s", family.Name, image)
+	}
+	return aws.StringValue(newest.ImageId), nil
+}
+
+// Checks that an AMI is an available image of the family and version an image reference names under the given plan
+func (m *AWSManager) checkFamilyImage(plan *config.PlanConfig, image, amiID string) error {
+	family := findImageFamily(plan, image)
+	if family == nil {
+		return fmt.Errorf("Plan %s has no image family named %s", plan.ID, image)
+	}
+	_, version := parseImageReference(image)
+	input := familyImagesInput(family)
+	input.Filters = append(input.Filters, &ec2.Filter{Name: aws.String("image-id"), Values: []*string{aws.String(amiID)}})
+	output, err := m.Client.DescribeImages(input)
+	if err != nil {
+		return err
+	}
+	if !imageInFamily(output.Images, amiID, family.VersionTag, version) {
+		return fmt.Errorf("Attempt to start AMI %s, which is not an available image matching %s", amiID, image)
+	}
+	return nil
+}
+
+// Whether the images of a family include the AMI at the given version
+func imageInFamily(images []*ec2.Image, amiID, versionTag, version string) bool {
+	for _, image := range images {
+		if aws.StringValue(image.ImageId) == amiID {
+			return version == "" || imageHasVersion(image, versionTag, version)
+		}
+	}
+	return false
+}
+
+// The search for the available images of an image family
+func familyImagesInput(family *config.ImageFamily) *ec2.DescribeImagesInput {
+	filters := append(selectorFilters(family.Tags), &ec2.Filter{
+		Name:   aws.String("state"),
+		Values: []*string{aws.String(ec2.ImageStateAvailable)},
+	})
+	if family.NamePattern != "" {
+		filters = append(filters, &ec2.Filter{Name: aws.String("name"), Values: []*string{aws.String(family.NamePattern)}})
+	}
+	input := &ec2.DescribeImagesInput{Filters: filters}
+	if len(family.Owners) > 0 {
+		input.Owners = aws.StringSlice(family.Owners)
+	}
+	return input
+}
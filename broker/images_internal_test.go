@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+var _ = Describe("Images", func() {
+	image := func(id, created, version string) *ec2.Image {
+		return &ec2.Image{
+			ImageId:      aws.String(id),
+			CreationDate: aws.String(created),
+			Tags:         []*ec2.Tag{{Key: aws.String("version"), Value: aws.String(version)}},
+		}
+	}
+	images := []*ec2.Image{
+		image("ami-1", "2017-01-15T10:00:00.000Z", "1.0"),
+		image("ami-3", "2017-03-02T10:00:00.000Z", "1.2"),
+		image("ami-2", "2017-02-20T10:00:00.000Z", "1.1"),
+	}
+
+	It("splits image references into family and version", func() {
+		family, version := parseImageReference("ubuntu-hardened@2017-03")
+		Expect(family).To(Equal("ubuntu-hardened"))
+		Expect(version).To(Equal("2017-03"))
+		family, version = parseImageReference("ubuntu-hardened")
+		Expect(family).To(Equal("ubuntu-hardened"))
+		Expect(version).To(BeEmpty())
+		family, version = parseImageReference("ubuntu-hardened@latest")
+		Expect(family).To(Equal("ubuntu-hardened"))
+		Expect(version).To(BeEmpty())
+	})
+
+	It("picks the newest image", func() {
+		Expect(aws.StringValue(newestImage(images, "version", "").ImageId)).To(Equal("ami-3"))
+	})
+
+	It("picks the newest image with a version tag or creation date matching the version", func() {
+		Expect(aws.StringValue(newestImage(images, "version", "1.1").ImageId)).To(Equal("ami-2"))
+		Expect(aws.StringValue(newestImage(images, "version", "2017-01").ImageId)).To(Equal("ami-1"))
+		Expect(newestImage(images, "version", "2.0")).To(BeNil())
+	})
+
+	It("only allows AMIs among the family's images at the requested version", func() {
+		Expect(imageInFamily(images, "ami-2", "version", "")).To(BeTrue())
+		Expect(imageInFamily(images, "ami-2", "version", "1.1")).To(BeTrue())
+		Expect(imageInFamily(images, "ami-2", "version", "1.2")).To(BeFalse())
+		Expect(imageInFamily(images, "ami-9", "version", "")).To(BeFalse())
+	})
+
+	It("only allows the plan's image families", func() {
+		plan := &config.PlanConfig{
+			ID:                    "plan-id",
+			AllowedSecurityGroups: []string{"sg-1"},
+			AllowedSubnets:        []string{"sn-1"},
+			ImageFamilies:         []config.ImageFamily{{Name: "ubuntu-hardened"}},
+		}
+		parameters := ProvisionParameters{AMIID: "ami-3", Image: "ubuntu-hardened@1.2", SecurityGroupID: "sg-1", SubnetID: "sn-1"}
+		Expect(validateParameters(plan, parameters)).To(Succeed())
+		parameters.Image = "centos"
+		Expect(validateParameters(plan, parameters)).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+// The key types we are willing to place into an authorized_keys file
+var allowedKeyTypes = []string{
+	"ssh-rsa",
+	"ssh-ed25519",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+}
+
+// Binding IDs and user names end up in shell commands run as root on the instance, so both are held to a strict pattern
+var (
+	bindingIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	usernamePattern  = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+)
+
+// Size of the RSA keys generated for bindings that don't bring their own key
+const generatedKeyBits = 3072
+
+// The comment placed after every key the broker installs, which is how Unbind finds the key to remove
+const authorizedKeyMarker = "ec2-broker:"
+
+// Validates public key text in authorized_keys format ("<type> <base64 key> [comment]"), returning it as
+// "<type> <base64 key>". Any comment is dropped, and the encoded key must agree with the stated type.
+func parsePublicKey(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", fmt.Errorf("No public key provided")
+	}
+	if strings.ContainsAny(text, "\r\n") {
+		return "", fmt.Errorf("Public key must be a single line")
+	}
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("Public key must be in the form '<type> <key> [comment]'")
+	}
+	keyType, encoded := fields[0], fields[1]
+	if !stringIn(keyType, allowedKeyTypes) {
+		return "", fmt.Errorf("Unsupported public key type: %s", keyType)
+	}
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("Public key is not valid base64: %s", err)
+	}
+	// The key blob starts with the length prefixed key type, which must match the stated type
+	if len(blob) < 4 {
+		return "", fmt.Errorf("Public key is too short")
+	}
+	typeLen := binary.BigEndian.Uint32(blob[:4])
+	if uint32(len(blob)-4) < typeLen || !bytes.Equal(blob[4:4+typeLen], []byte(keyType)) {
+		return "", fmt.Errorf("Public key data does not match key type %s", keyType)
+	}
+	return keyType + " " + encoded, nil
+}
+
+// Generates a new RSA key pair for a single binding, returning the public key as "ssh-rsa <base64 key>" and the
+// private key PEM encoded, which OpenSSH reads directly
+func generateKeyPair() (string, string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, generatedKeyBits)
+	if err != nil {
+		return "", "", err
+	}
+	// The wire format of an RSA public key: the key type, public exponent and modulus
+	var blob bytes.Buffer
+	writeSSHString(&blob, []byte("ssh-rsa"))
+	writeSSHString(&blob, mpint(big.NewInt(int64(key.PublicKey.E))))
+	writeSSHString(&blob, mpint(key.PublicKey.N))
+	privateKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	return "ssh-rsa " + base64.StdEncoding.EncodeToString(blob.Bytes()), string(privateKey), nil
+}
+
+// Computes the OpenSSH style SHA256 fingerprint of a public key in "<type> <base64 key>" form
+func keyFingerprint(publicKey string) string {
+	fields := strings.Fields(publicKey)
+	if len(fields) < 2 {
+		return ""
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+func writeSSHString(buf *bytes.Buffer, b []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+	buf.Write(length[:])
+	buf.Write(b)
+}
+
+// Encodes a positive integer as an SSH mpint, which needs a leading zero byte when the high bit is set
+func mpint(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		return append([]byte{0}, b...)
+	}
+	return b
+}
+
+// Builds the authorized_keys line for a binding, tagged with the marker used to find it again
+func authorizedKeyLine(publicKey, bindingID string) string {
+	return fmt.Sprintf("%s %s%s", publicKey, authorizedKeyMarker, bindingID)
+}
+
+// Shell commands resolving the user's authorized_keys file and making sure it exists with the right ownership. Every
+// value is quoted as a shell word, even those already held to a strict pattern.
+func authorizedKeysPreamble(username string) []string {
+	user := config.ShellQuote(username)
+	return []string{
+		"set -e",
+		fmt.Sprintf("home=$(getent passwd %s | cut -d: -f6)", user),
+		"test -n \"$home\"",
+		fmt.Sprintf("install -d -m 700 -o %s -g \"$(id -gn %s)\" \"$home/.ssh\"", user, user),
+		"touch \"$home/.ssh/authorized_keys\"",
+		fmt.Sprintf("chown %s \"$home/.ssh/authorized_keys\"", user),
+		"chmod 600 \"$home/.ssh/authorized_keys\"",
+	}
+}
+
+// Shell commands appending the key line to the user's authorized_keys. printf writes the line as given, where some
+// shells' echo would interpret backslashes in it.
+func addAuthorizedKeyCommands(username, keyLine string) []string {
+	return append(authorizedKeysPreamble(username),
+		fmt.Sprintf("printf '%%s\\n' %s >> \"$home/.ssh/authorized_keys\"", config.ShellQuote(keyLine)),
+	)
+}
+
+// Shell commands removing the binding's key line from the user's authorized_keys
+func removeAuthorizedKeyCommands(username, bindingID string) []string {
+	return append(authorizedKeysPreamble(username),
+		fmt.Sprintf("sed -i %s \"$home/.ssh/authorized_keys\"", config.ShellQuote("/ "+authorizedKeyMarker+bindingID+"$/d")),
+	)
+}
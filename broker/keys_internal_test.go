@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"os/exec"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Authorized keys commands", func() {
+	preamble := []string{
+		"set -e",
+		`home=$(getent passwd 'ec2-user' | cut -d: -f6)`,
+		`test -n "$home"`,
+		`install -d -m 700 -o 'ec2-user' -g "$(id -gn 'ec2-user')" "$home/.ssh"`,
+		`touch "$home/.ssh/authorized_keys"`,
+		`chown 'ec2-user' "$home/.ssh/authorized_keys"`,
+		`chmod 600 "$home/.ssh/authorized_keys"`,
+	}
+
+	It("appends the binding's key line", func() {
+		keyLine := authorizedKeyLine(testKey, "binding-1")
+		Expect(addAuthorizedKeyCommands("ec2-user", keyLine)).To(Equal(append(preamble,
+			`printf '%s\n' 'ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f ec2-broker:binding-1' >> "$home/.ssh/authorized_keys"`,
+		)))
+	})
+
+	It("removes the binding's key line by its marker", func() {
+		Expect(removeAuthorizedKeyCommands("ec2-user", "binding-1")).To(Equal(append(preamble,
+			`sed -i '/ ec2-broker:binding-1$/d' "$home/.ssh/authorized_keys"`,
+		)))
+	})
+
+	It("keeps a key line with quotes in it to a single word", func() {
+		keyLine := `ssh-ed25519 AAAA' ; touch /tmp/owned ; echo '"\n ec2-broker:binding-1`
+		commands := addAuthorizedKeyCommands("ec2-user", keyLine)
+		appendLine := commands[len(commands)-1]
+		Expect(appendLine).To(Equal(
+			`printf '%s\n' 'ssh-ed25519 AAAA'\'' ; touch /tmp/owned ; echo '\''"\n ec2-broker:binding-1' >> "$home/.ssh/authorized_keys"`,
+		))
+		// The shell hands printf the key line exactly as given
+		output, err := exec.Command("sh", "-c", strings.TrimSuffix(appendLine, ` >> "$home/.ssh/authorized_keys"`)).Output()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(output)).To(Equal(keyLine + "\n"))
+	})
+})
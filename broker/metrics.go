@@ -0,0 +1,180 @@
+package broker
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/GSA/ec2-broker/metrics"
+	"github.com/GSA/ec2-broker/store"
+)
+
+// The broker's metrics, served from /metrics
+var (
+	requestsTotal = metrics.NewCounter("ec2_broker_requests_total",
+		"Broker API requests by operation, plan and outcome.", "operation", "plan", "outcome")
+	requestDuration = metrics.NewHistogram("ec2_broker_request_duration_seconds",
+		"Time taken to answer broker API requests.", metrics.DefaultBuckets, "operation", "plan", "outcome")
+	awsRequestsTotal = metrics.NewCounter("ec2_broker_aws_requests_total",
+		"AWS API calls by service and operation.", "service", "operation")
+	awsRequestErrors = metrics.NewCounter("ec2_broker_aws_request_errors_total",
+		"AWS API calls that failed, by service, operation and error code.", "service", "operation", "code")
+	awsRequestDuration = metrics.NewHistogram("ec2_broker_aws_request_duration_seconds",
+		"Time taken by AWS API calls, including retries.", metrics.DefaultBuckets, "service", "operation")
+	managedInstances = metrics.NewGauge("ec2_broker_instances",
+		"Service instances the broker manages, by plan and the last EC2 state it saw.", "plan", "state")
+)
+
+/*
+InstrumentedBroker is an EC2Broker that counts and times each request it answers
+*/
+type InstrumentedBroker struct {
+	*EC2Broker
+}
+
+// Records a broker request, taking errors as the outcome when there is one
+func observeRequest(operation, planID, outcome string, started time.Time, err error) {
+	if err != nil {
+		outcome = "error"
+	}
+	requestsTotal.Inc(operation, planID, outcome)
+	requestDuration.Observe(time.Since(started).Seconds(), operation, planID, outcome)
+}
+
+// The recorded plan of an instance, for requests that do not name it
+func (b InstrumentedBroker) planID(instanceID string) string {
+	if record, err := b.Store.Get(instanceID); err == nil {
+		return record.PlanID
+	}
+	return ""
+}
+
+/*
+Provision provisions the instance, recording the request
+*/
+func (b InstrumentedBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	started := time.Now()
+	spec, err := b.EC2Broker.Provision(ctx, instanceID, details, asyncAllowed)
+	observeRequest(operationProvision, details.PlanID, "success", started, err)
+	return spec, err
+}
+
+/*
+Deprovision deprovisions the instance, recording the request
+*/
+func (b InstrumentedBroker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	started := time.Now()
+	spec, err := b.EC2Broker.Deprovision(ctx, instanceID, details, asyncAllowed)
+	observeRequest(operationDeprovision, details.PlanID, "success", started, err)
+	return spec, err
+}
+
+/*
+Bind binds the instance, recording the request
+*/
+func (b InstrumentedBroker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	started := time.Now()
+	binding, err := b.EC2Broker.Bind(ctx, instanceID, bindingID, details)
+	observeRequest(operationBind, details.PlanID, "success", started, err)
+	return binding, err
+}
+
+/*
+Unbind unbinds the instance, recording the request
+*/
+func (b InstrumentedBroker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	started := time.Now()
+	err := b.EC2Broker.Unbind(ctx, instanceID, bindingID, details)
+	observeRequest(operationUnbind, details.PlanID, "success", started, err)
+	return err
+}
+
+/*
+Update updates the instance, recording the request
+*/
+func (b InstrumentedBroker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	started := time.Now()
+	spec, err := b.EC2Broker.Update(ctx, instanceID, details, asyncAllowed)
+	planID := details.PlanID
+	if planID == "" {
+		planID = details.PreviousValues.PlanID
+	}
+	observeRequest(operationUpdate, planID, "success", started, err)
+	return spec, err
+}
+
+/*
+LastOperation reports on the instance's last operation, recording the request with the state of the operation as its
+outcome
+*/
+func (b InstrumentedBroker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	started := time.Now()
+	op, err := b.EC2Broker.LastOperation(ctx, instanceID, operationData)
+	observeRequest("last_operation", b.planID(instanceID), strings.Replace(string(op.State), " ", "_", -1), started, err)
+	return op, err
+}
+
+// Adds handlers to an AWS client counting and timing every call it makes, retries included. They belong after the
+// client's own handlers, so the response has been unmarshalled when they run.
+func instrumentAWSRequests(handlers *request.Handlers) {
+	observe := func(r *request.Request) {
+		service, operation := r.ClientInfo.ServiceName, r.Operation.Name
+		awsRequestsTotal.Inc(service, operation)
+		awsRequestDuration.Observe(time.Since(r.Time).Seconds(), service, operation)
+		if r.Error != nil {
+			code := "unknown"
+			if aerr, ok := r.Error.(awserr.Error); ok {
+				code = aerr.Code()
+			}
+			awsRequestErrors.Inc(service, operation, code)
+		}
+	}
+	// A call ends after unmarshalling its response, or after the retry handlers give up on it
+	handlers.Unmarshal.PushBack(func(r *request.Request) {
+		if r.Error == nil {
+			observe(r)
+		}
+	})
+	handlers.AfterRetry.PushBack(func(r *request.Request) {
+		if r.Error != nil {
+			observe(r)
+		}
+	})
+}
+
+// Counts the instances in the store by plan and state before each scrape, leaving out those that are terminated
+func instanceMetrics(s store.Store) func() {
+	return func() {
+		records, err := s.List()
+		if err != nil {
+			return
+		}
+		counts := map[[2]string]int{}
+		for _, record := range records {
+			if record.AWSInstanceID == "" || record.AWSState == ec2.InstanceStateNameTerminated {
+				continue
+			}
+			state := record.AWSState
+			if state == "" {
+				state = "unknown"
+			}
+			counts[[2]string{record.PlanID, state}]++
+		}
+		managedInstances.Reset()
+		for key, count := range counts {
+			managedInstances.Set(float64(count), key[0], key[1])
+		}
+	}
+}
+
+/*
+RegisterInstanceMetrics reports the instances recorded in the store with the broker's metrics
+*/
+func RegisterInstanceMetrics(s store.Store) {
+	metrics.OnCollect(instanceMetrics(s))
+}
@@ -0,0 +1,37 @@
+package broker
+
+import (
+	"net/http/httptest"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/GSA/ec2-broker/metrics"
+	"github.com/GSA/ec2-broker/store"
+)
+
+var _ = Describe("Metrics", func() {
+	It("counts the instances in the store by plan and state before each scrape", func() {
+		s := store.NewMemoryStore()
+		record := func(id, awsID, planID, state string) {
+			s.Update(id, func(instance *store.Instance) error {
+				instance.AWSInstanceID, instance.PlanID, instance.AWSState = awsID, planID, state
+				return nil
+			})
+		}
+		record("instance-1", "i-1", "plan-1", ec2.InstanceStateNameRunning)
+		record("instance-2", "i-2", "plan-1", ec2.InstanceStateNameRunning)
+		record("instance-3", "i-3", "plan-2", "")
+		record("instance-4", "i-4", "plan-2", ec2.InstanceStateNameTerminated)
+		record("instance-5", "", "plan-2", "")
+		instanceMetrics(s)()
+
+		recorder := httptest.NewRecorder()
+		metrics.DefaultRegistry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body := recorder.Body.String()
+		Expect(body).To(ContainSubstring(`ec2_broker_instances{plan="plan-1",state="running"} 2` + "\n"))
+		Expect(body).To(ContainSubstring(`ec2_broker_instances{plan="plan-2",state="unknown"} 1` + "\n"))
+		Expect(body).ToNot(ContainSubstring(`state="terminated"`))
+	})
+})
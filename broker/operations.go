@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+/*
+operationToken is the operation data handed to the Cloud Controller for an asynchronous operation, and passed back on
+each LastOperation call. It is encoded as "v1.<payload>.<signature>", where the payload is base64 encoded JSON and the
+signature an HMAC over the payload, so tokens can't be forged or pointed at another instance.
+
+A token names the type of operation and the instance, and nothing more: the Cloud Controller passes back the same
+operation data on every poll, so a start time or step could only ever say where the operation began. The step of a
+multi-step operation is kept with the operation in the store instead, and the token carries no start time since no
+operation times out.
+*/
+type operationToken struct {
+	Version    int    `json:"v"`
+	Type       string `json:"t"`
+	InstanceID string `json:"i"`
+}
+
+const operationTokenVersion = 1
+
+// The prefixes of the tokens used before operation tokens were versioned, which are still accepted for operations in flight
+var legacyOperationPrefixes = map[string]string{
+	"p_": operationProvision,
+	"d_": operationDeprovision,
+}
+
+var errInvalidOperationToken = errors.New("invalid operation token")
+
+/*
+operationHandler describes how LastOperation reports on one type of operation. Most operations only wait on the instance
+reaching a state, and are described by the mapping of EC2 states to operation states; any other state means the
+operation failed. Those with work left once the instance gets there do it in complete, which returns a description of
+what it did. Multi-step operations drive themselves forward with poll instead. Operations that end the instance set
+forget, so the store drops its record once they succeed.
+*/
+type operationHandler struct {
+	states   map[string]brokerapi.LastOperationState
+	complete func(b *EC2Broker, instanceID string) (string, error)
+	poll     func(b *EC2Broker, instanceID string, token operationToken) (brokerapi.LastOperation, error)
+	forget   bool
+}
+
+var operationHandlers = map[string]operationHandler{
+	operationProvision: {
+		states: map[string]brokerapi.LastOperationState{
+			ec2.InstanceStateNamePending: brokerapi.InProgress,
+			ec2.InstanceStateNameRunning: brokerapi.Succeeded,
+		},
+		complete: (*EC2Broker).completeProvision,
+	},
+	operationDeprovision: {
+		states: map[string]brokerapi.LastOperationState{
+			ec2.InstanceStateNameShuttingDown: brokerapi.InProgress,
+			ec2.InstanceStateNameStopping:     brokerapi.InProgress,
+			ec2.InstanceStateNameStopped:      brokerapi.Succeeded,
+			ec2.InstanceStateNameTerminated:   brokerapi.Succeeded,
+		},
+		complete: (*EC2Broker).completeDeprovision,
+		forget:   true,
+	},
+	operationUpdate: {
+		poll: func(b *EC2Broker, instanceID string, token operationToken) (brokerapi.LastOperation, error) {
+			return b.lastUpdateOperation(instanceID)
+		},
+	},
+}
+
+// Maps an EC2 state to the state of the operation
+func (h operationHandler) state(awsStatus string) brokerapi.LastOperationState {
+	if state, ok := h.states[awsStatus]; ok {
+		return state
+	}
+	return brokerapi.Failed
+}
+
+// Builds a token for an operation on an instance
+func newOperationToken(operationType, instanceID string) operationToken {
+	return operationToken{
+		Version:    operationTokenVersion,
+		Type:       operationType,
+		InstanceID: instanceID,
+	}
+}
+
+// Encodes and signs the token
+func (t operationToken) String() string {
+	data, _ := json.Marshal(t)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return "v1." + payload + "." + signOperationPayload(payload)
+}
+
+// Decodes operation data for the given instance, accepting both signed tokens and the older p_/d_ tokens
+func parseOperationToken(operationData, instanceID string) (operationToken, error) {
+	for prefix, operationType := range legacyOperationPrefixes {
+		if operationData == prefix+instanceID {
+			return operationToken{Type: operationType, InstanceID: instanceID}, nil
+		}
+	}
+	parts := strings.Split(operationData, ".")
+	if len(parts) != 3 || parts[0] != "v1" {
+		return operationToken{}, errInvalidOperationToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signOperationPayload(parts[1]))) {
+		return operationToken{}, errInvalidOperationToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return operationToken{}, errInvalidOperationToken
+	}
+	var token operationToken
+	err = json.Unmarshal(data, &token)
+	if err != nil || token.Version != operationTokenVersion || token.InstanceID != instanceID {
+		return operationToken{}, errInvalidOperationToken
+	}
+	return token, nil
+}
+
+// Signs a token payload with the configured operation secret
+func signOperationPayload(payload string) string {
+	mac := hmac.New(sha256.New, []byte(config.GetConfiguration().OperationSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
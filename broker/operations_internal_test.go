@@ -0,0 +1,33 @@
+package broker
+
+import (
+	"encoding/base64"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+var _ = Describe("Operation tokens", func() {
+	BeforeEach(func() {
+		config.SetConfiguration(&config.Config{OperationSecret: "operation-secret"})
+	})
+
+	It("names only the type of operation and the instance", func() {
+		token := newOperationToken(operationUpdate, "instance-1")
+		parts := strings.Split(token.String(), ".")
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(payload)).To(Equal(`{"v":1,"t":"update","i":"instance-1"}`))
+		Expect(parseOperationToken(token.String(), "instance-1")).To(Equal(token))
+	})
+
+	It("accepts tokens issued with a start time for operations in flight", func() {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"v":1,"t":"deprovision","i":"instance-1","s":1490000000}`))
+		token, err := parseOperationToken("v1."+payload+"."+signOperationPayload(payload), "instance-1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token.Type).To(Equal(operationDeprovision))
+	})
+})
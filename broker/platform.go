@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+/*
+PlatformContext is the context object the Cloud Controller sends with provision and update requests. Newer Cloud
+Controllers name the service instance and its organization and space as well as giving their GUIDs.
+*/
+type PlatformContext struct {
+	Platform         string `json:"platform"`
+	OrganizationGUID string `json:"organization_guid"`
+	SpaceGUID        string `json:"space_guid"`
+	InstanceName     string `json:"instance_name"`
+	OrganizationName string `json:"organization_name"`
+	SpaceName        string `json:"space_name"`
+}
+
+type platformContextKey struct{}
+
+/*
+MaxRequestBytes bounds the provision and update request bodies WithPlatformContext reads; those are small JSON documents,
+so anything larger is refused rather than held in memory
+*/
+const MaxRequestBytes = 1 << 20
+
+/*
+WithPlatformContext wraps the broker API handler so the context object of provision and update requests, which the
+vendored brokerapi does not decode, reaches the broker through the request's context. Bodies over MaxRequestBytes are
+refused with 413 Request Entity Too Large. It does not authenticate: the caller wraps it in the broker's basic auth so
+bodies are only read for authenticated requests.
+*/
+func WithPlatformContext(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		instancePath := strings.TrimPrefix(req.URL.Path, "/v2/service_instances/")
+		if (req.Method != "PUT" && req.Method != "PATCH") || instancePath == req.URL.Path || strings.Contains(instancePath, "/") || req.Body == nil {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, MaxRequestBytes))
+		req.Body.Close()
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(brokerapi.ErrorResponse{
+				Description: fmt.Sprintf("Request body is larger than %d bytes", MaxRequestBytes),
+			})
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var request struct {
+			Context *PlatformContext `json:"context"`
+		}
+		if json.Unmarshal(body, &request) == nil && request.Context != nil {
+			req = req.WithContext(context.WithValue(req.Context(), platformContextKey{}, *request.Context))
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// The context object sent with the request, if there was one
+func platformContext(ctx context.Context) PlatformContext {
+	if ctx == nil {
+		return PlatformContext{}
+	}
+	platform, _ := ctx.Value(platformContextKey{}).(PlatformContext)
+	return platform
+}
+
+// Checks the organization and space an instance belongs to against the plan's lists, which allow any when empty
+func validateContext(plan *config.PlanConfig, context ProvisionContext) error {
+	if len(plan.AllowedOrganizations) > 0 && !stringIn(context.OrganizationGUID, plan.AllowedOrganizations) {
+		return fmt.Errorf("Plan %s is not available to organization %s", plan.Name, context.OrganizationGUID)
+	}
+	if len(plan.AllowedSpaces) > 0 && !stringIn(context.SpaceGUID, plan.AllowedSpaces) {
+		return fmt.Errorf("Plan %s is not available to space %s", plan.Name, context.SpaceGUID)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+var _ = Describe("Platform context", func() {
+	var (
+		seen     PlatformContext
+		seenBody string
+		handler  http.Handler
+	)
+
+	BeforeEach(func() {
+		seen, seenBody = PlatformContext{}, ""
+		handler = WithPlatformContext(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			seen = platformContext(req.Context())
+			body, _ := ioutil.ReadAll(req.Body)
+			seenBody = string(body)
+		}))
+	})
+
+	It("passes the context object of a provision request to the broker", func() {
+		body := `{"plan_id": "plan-id", "context": {"platform": "cloudfoundry", "instance_name": "my-ec2", "organization_name": "finance", "space_name": "prod"}}`
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v2/service_instances/instance-1", strings.NewReader(body)))
+		Expect(seen).To(Equal(PlatformContext{Platform: "cloudfoundry", InstanceName: "my-ec2", OrganizationName: "finance", SpaceName: "prod"}))
+		Expect(seenBody).To(Equal(body))
+	})
+
+	It("refuses request bodies over the limit without passing them on", func() {
+		body := `{"plan_id": "plan-id", "parameters": {"user_data": "` + strings.Repeat("x", MaxRequestBytes) + `"}}`
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("PUT", "/v2/service_instances/instance-1", strings.NewReader(body)))
+		Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(recorder.Body.String()).To(ContainSubstring("larger than"))
+		Expect(seenBody).To(BeEmpty())
+	})
+
+	It("leaves other requests alone", func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v2/service_instances/instance-1/service_bindings/binding-1", strings.NewReader(`{"context": {"instance_name": "my-ec2"}}`)))
+		Expect(seen).To(Equal(PlatformContext{}))
+		Expect(platformContext(context.Background())).To(Equal(PlatformContext{}))
+	})
+
+	It("restricts plans to the organizations and spaces they list", func() {
+		plan := &config.PlanConfig{Name: "small"}
+		Expect(validateContext(plan, ProvisionContext{OrganizationGUID: "org-1", SpaceGUID: "space-1"})).To(Succeed())
+		plan.AllowedOrganizations = []string{"org-1"}
+		Expect(validateContext(plan, ProvisionContext{OrganizationGUID: "org-1", SpaceGUID: "space-1"})).To(Succeed())
+		Expect(validateContext(plan, ProvisionContext{OrganizationGUID: "org-2", SpaceGUID: "space-1"})).ToNot(Succeed())
+		plan.AllowedSpaces = []string{"space-2"}
+		Expect(validateContext(plan, ProvisionContext{OrganizationGUID: "org-1", SpaceGUID: "space-1"})).ToNot(Succeed())
+	})
+})
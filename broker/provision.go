@@ -1,13 +1,20 @@
 package broker
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 
 	"code.cloudfoundry.org/lager"
 
 	"github.com/GSA/ec2-broker/config"
+	"github.com/GSA/ec2-broker/store"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/pivotal-cf/brokerapi"
@@ -17,31 +24,98 @@ import (
 InstanceManager represents the core functions of a manager of AWS instances of interest
 */
 type InstanceManager interface {
-	ProvisionAWSInstance(planID, amiID, securityGroupID, subnetID string, assignPublicIP bool, instanceID string) (string, error)
+	ProvisionAWSInstance(instanceID string, context ProvisionContext, parameters ProvisionParameters) (string, error)
 	TerminateAWSInstance(instanceID string) (string, error)
-	GetAWSInstanceStatus(instanceID string) (string, error)
+	GetAWSInstanceStatus(instanceID string) (*InstanceStatus, error)
+	SetAWSInstanceSecurityGroups(instanceID string, securityGroupIDs []string) error
+	SetAWSInstanceTags(instanceID string, tags map[string]string, removed []string) error
+	SetAWSInstancePublicIP(instanceID string, assignPublicIP bool) (string, error)
+	AssociateAWSElasticIP(instanceID string) (string, error)
+	ReleaseAWSElasticIP(instanceID string) error
+	BindAWSInstance(instanceID, bindingID, username, publicKey string) (*InstanceAddress, error)
+	UnbindAWSInstance(instanceID, bindingID string) error
+	DescribeAWSInstance(instanceID string) (*InstanceDescription, error)
+	StopAWSInstance(instanceID string) (string, error)
+	StartAWSInstance(instanceID string) (string, error)
+	SetAWSInstanceType(instanceID, instanceType string) error
+	ResolvePlan(plan *config.PlanConfig) (*config.PlanConfig, error)
+	ResolveAWSImage(plan *config.PlanConfig, image string) (string, error)
 }
 
 /*
-AWSManager abstracts a number of calls to the AWS services
+ProvisionContext describes where a provision request came from: the Cloud Foundry service and plan, and the organization
+and space the instance is provisioned for. The names are only known when the Cloud Controller sends them.
+*/
+type ProvisionContext struct {
+	ServiceID        string
+	PlanID           string
+	OrganizationGUID string
+	SpaceGUID        string
+	InstanceName     string
+	OrganizationName string
+	SpaceName        string
+}
+
+/*
+InstanceDescription holds the launch settings of an instance that plan changes are checked against
+*/
+type InstanceDescription struct {
+	AWSInstanceID    string
+	State            string
+	InstanceType     string
+	ImageID          string
+	SubnetID         string
+	SecurityGroupIDs []string
+	PublicIP         string
+	ElasticIP        string
+}
+
+/*
+InstanceAddress holds the addresses a bound application can use to reach an instance
+*/
+type InstanceAddress struct {
+	PrivateIP string
+	PublicIP  string
+	ElasticIP string
+}
+
+/*
+AWSManager abstracts a number of calls to the AWS services. It records the AWS instance ID and the last state it saw for
+each instance in the store.
 */
 type AWSManager struct {
-	Client  *ec2.EC2
-	Session *session.Session
+	Client    *ec2.EC2
+	Session   *session.Session
+	Commands  CommandRunner
+	Store     store.Store
+	Discovery *DiscoveryCache
 }
 
 /*
 NewAWSManager uilds a new AWS Manager, including starting its session
 */
-func NewAWSManager() (*AWSManager, error) {
-	sess, err := session.NewSession()
+func NewAWSManager(s store.Store) (*AWSManager, error) {
+	// The configured region, if any, takes precedence over the environment's
+	awsConfig := aws.NewConfig()
+	if region := config.GetConfiguration().Region; region != "" {
+		awsConfig = awsConfig.WithRegion(region)
+	}
+	sess, err := session.NewSession(awsConfig)
 	if err != nil {
 		return nil, fmt.Errorf("creating AWS client: Failed to create AWS Session: %s", err.Error())
 	}
 
+	client := ec2.New(sess)
+	commands := NewSSMCommandRunner(sess)
+	instrumentAWSRequests(&client.Handlers)
+	instrumentAWSRequests(&commands.Client.Handlers)
+
 	return &AWSManager{
-		Session: sess,
-		Client:  ec2.New(sess),
+		Session:   sess,
+		Client:    client,
+		Commands:  commands,
+		Store:     s,
+		Discovery: NewDiscoveryCache(),
 	}, nil
 }
 
@@ -49,28 +123,55 @@ func NewAWSManager() (*AWSManager, error) {
 ProvisionAWSInstance will launch and instance and provide the instance ID back.
 
 This will validate the inputs against the configuration to ensure that this can be called. The end result will
-be an instance with a tag called brokerInstance = instanceID
+be an instance with a tag called brokerInstance = instanceID, along with tags naming its plan, organization, space and
+creation time. The instance, its volumes and its network interface are tagged as they are launched. Provisioning is idempotent: an instance already launched
+for instanceID is returned if it matches the request and brokerapi.ErrInstanceAlreadyExists returned if not, and the
+launch itself uses a client token derived from instanceID so AWS never starts a second instance.
 */
-func (m *AWSManager) ProvisionAWSInstance(planID, amiID, securityGroupID, subnetID string, assignPublicIP bool, instanceID string) (string, error) {
-	conf := config.GetConfiguration()
+func (m *AWSManager) ProvisionAWSInstance(instanceID string, context ProvisionContext, parameters ProvisionParameters) (string, error) {
 	logger := config.GetLogger()
-	plan, err := findPlan(conf, planID)
+	conf, plan, err := servicePlan(config.GetConfiguration(), context.ServiceID, context.PlanID)
+	if err == nil {
+		plan, err = m.ResolvePlan(plan)
+	}
 	// Does the request ask for an allowable AMI, security group, subnet and public IP setting?
 	if err != nil {
 		return "", err
 	}
-	if !stringIn(amiID, plan.AllowedAMIs) {
-		return "", fmt.Errorf("Attempt to start disallowed AMI: %s", amiID)
+	err = validateParameters(plan, parameters)
+	// An AMI resolved from an image family is not on the plan's list of AMIs, so it must be shown to be of the family
+	if err == nil && parameters.Image != "" {
+		err = m.checkFamilyImage(plan, parameters.Image, parameters.AMIID)
+	}
+	if err == nil {
+		err = validateContext(plan, context)
+	}
+	if err == nil {
+		err = validateTags(conf, parameters.Tags)
+	}
+	if err != nil {
+		return "", err
 	}
-	if !stringIn(securityGroupID, plan.AllowedSecurityGroups) {
-		return "", fmt.Errorf("Attempt to start instance in disallowed security group: %s", securityGroupID)
+	userData, err := renderUserData(plan, instanceID, context, parameters)
+	if err != nil {
+		return "", err
 	}
-	if !stringIn(subnetID, plan.AllowedSubnets) {
-		return "", fmt.Errorf("Attempt to start instance in disallowed subnet: %s", subnetID)
+	// A retried request finds the instance the first one launched
+	existing, err := m.getEC2InstanceByServiceID(instanceID)
+	if err == nil {
+		if !sameLaunch(conf, existing, plan, context, parameters) {
+			return "", brokerapi.ErrInstanceAlreadyExists
+		}
+		logger.Info("found-existing-instance", lager.Data{"instance_id": instanceID, "aws_instance_id": existing.InstanceId})
+		return aws.StringValue(existing.InstanceId), nil
 	}
-	if assignPublicIP && !plan.AllowPublicIP {
-		return "", errors.New("Attempt to start instance with a public IP while plan does not allow it")
+	if err != brokerapi.ErrInstanceDoesNotExist {
+		return "", err
 	}
+	amiID := parameters.AMIID
+	securityGroupIDs := parameters.securityGroups()
+	subnetID := parameters.SubnetID
+	assignPublicIP := parameters.AssignPublicIP
 
 	// Build the instance request, including going a level deeper into the network to allow
 	// for us to request a public IP
@@ -79,31 +180,70 @@ func (m *AWSManager) ProvisionAWSInstance(planID, amiID, securityGroupID, subnet
 		AssociatePublicIpAddress: aws.Bool(assignPublicIP),
 		DeviceIndex:              aws.Int64(0),
 		SubnetId:                 aws.String(subnetID),
-		Groups: []*string{
-			aws.String(securityGroupID),
-		},
+		Groups:                   aws.StringSlice(securityGroupIDs),
 	}
 
 	instanceInput := &ec2.RunInstancesInput{
+		ClientToken:  aws.String(provisionClientToken(instanceID)),
 		ImageId:      aws.String(amiID),
 		MaxCount:     aws.Int64(1),
 		MinCount:     aws.Int64(1),
 		InstanceType: aws.String(instanceType),
-		KeyName:      aws.String(conf.KeyPairName),
 		NetworkInterfaces: []*ec2.InstanceNetworkInterfaceSpecification{
 			&nis,
 		},
 	}
-	reservation, err := m.Client.RunInstances(instanceInput)
+	// Access is normally granted per binding, so the shared launch key pair is optional
+	if conf.KeyPairName != "" {
+		instanceInput.KeyName = aws.String(conf.KeyPairName)
+	}
+	if parameters.InstanceProfile != "" {
+		instanceInput.IamInstanceProfile = instanceProfileSpecification(parameters.InstanceProfile)
+	}
+	if userData != "" {
+		instanceInput.UserData = aws.String(base64.StdEncoding.EncodeToString([]byte(userData)))
+	}
+	// The Elastic IP is allocated up front so a lack of addresses fails the request before an instance is launched. It
+	// is associated once the instance is running. Only an address allocated here is released if the launch fails, since
+	// any other belongs to an earlier launch.
+	var allocated *ec2.Address
+	if parameters.ElasticIP {
+		var addresses []*ec2.Address
+		addresses, err = m.brokerAddresses(instanceID)
+		if err == nil && len(addresses) == 0 {
+			allocated, err = m.allocateAddress(conf, instanceID)
+		}
+		if err != nil {
+			logger.Error("allocating-address", err, lager.Data{"instance_id": instanceID})
+			return "", err
+		}
+	}
+	blockDevices, extraParameters := blockDeviceMappings(plan.Volumes, parameters.Volumes)
+	instanceInput.BlockDeviceMappings = blockDevices
+	// The instance and everything launched with it are tagged by RunInstances itself, so there is never an instance
+	// the broker can't find by its tags
+	for key, values := range tagSpecificationParameters(launchTaggedResources, launchTags(conf, instanceID, context, parameters)) {
+		extraParameters[key] = values
+	}
+	runRequest, reservation := m.Client.RunInstancesRequest(instanceInput)
+	runRequest.Handlers.Build.PushBack(withQueryParameters(extraParameters))
+	err = runRequest.Send()
 
 	// Fail if we haven't constructed the instance
 	if err != nil {
 		logger.Error("creating-instance", err, lager.Data{
-			"ami_id":            amiID,
-			"security_group_id": securityGroupID,
-			"subnet_id":         subnetID,
+			"ami_id":             amiID,
+			"security_group_ids": securityGroupIDs,
+			"subnet_id":          subnetID,
 		})
-		return "", err
+		if allocated != nil {
+			m.releaseAddressAfterFailure(instanceID, allocated)
+		}
+		// The client token was used for a launch with other parameters
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "IdempotentParameterMismatch" {
+			return "", brokerapi.ErrInstanceAlreadyExists
+		}
+		return "", describeLaunchError(err)
 	}
 
 	logger.Info("created-instance", lager.Data{
@@ -111,64 +251,499 @@ func (m *AWSManager) ProvisionAWSInstance(planID, amiID, securityGroupID, subnet
 		"ami_id":      reservation.Instances[0].ImageId,
 	})
 
-	err = m.tagEC2Instance(*reservation.Instances[0].InstanceId, map[string]string{
-		conf.TagPrefix + "brokerInstance": instanceID,
+	updateStore(m.Store, instanceID, func(record *store.Instance) {
+		record.AWSInstanceID = *reservation.Instances[0].InstanceId
+		record.AWSState = aws.StringValue(reservation.Instances[0].State.Name)
 	})
+	return *reservation.Instances[0].InstanceId, nil
+}
+
+/*
+TerminateAWSInstance terminates an EC2 instance given its service instance ID (*not* its AWS Instance ID).
+Returns the current status. The addresses the broker allocated for the instance are left to ReleaseAWSElasticIP once
+it has terminated, so an instance that fails to terminate keeps its address.
+*/
+func (m *AWSManager) TerminateAWSInstance(instanceID string) (string, error) {
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err != nil {
+		return "", err
+	}
+	err = m.applyVolumeDeletionPolicy(instanceID, *instance.InstanceId)
+	if err != nil {
+		config.GetLogger().Error("failed-applying-volume-policy", err, lager.Data{"instance_id": instanceID})
+	}
+	state, err := m.terminateEC2Instance(*instance.InstanceId)
+	if err != nil {
+		return "", err
+	}
+	updateStore(m.Store, instanceID, func(record *store.Instance) {
+		record.AWSState = state
+	})
+	return state, nil
+}
+
+/*
+GetAWSInstanceStatus gets the status of an EC2 instance by its service instance ID, including the reasons AWS gives for
+its state. Terminated instances eventually disappear from AWS, so an instance the store last saw terminating is reported
+as terminated once AWS no longer knows it.
+*/
+func (m *AWSManager) GetAWSInstanceStatus(instanceID string) (*InstanceStatus, error) {
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err == brokerapi.ErrInstanceDoesNotExist {
+		record, storeErr := m.Store.Get(instanceID)
+		if storeErr == nil && (record.AWSState == ec2.InstanceStateNameShuttingDown || record.AWSState == ec2.InstanceStateNameTerminated) {
+			return &InstanceStatus{State: ec2.InstanceStateNameTerminated}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	status := &InstanceStatus{
+		State:            *instance.State.Name,
+		TransitionReason: aws.StringValue(instance.StateTransitionReason),
+	}
+	if instance.StateReason != nil {
+		status.ReasonCode = aws.StringValue(instance.StateReason.Code)
+		status.ReasonMessage = aws.StringValue(instance.StateReason.Message)
+	}
+	updateStore(m.Store, instanceID, func(record *store.Instance) {
+		record.AWSState = status.State
+	})
+	return status, nil
+}
+
+/*
+BindAWSInstance appends the public key to the authorized_keys of the given user on the instance found by its service
+instance ID, and tags the instance with brokerBind:bindingID = username. The key must already be validated with
+parsePublicKey, as it is passed to a shell on the instance. An instance with no room left for the tag can't be bound.
+*/
+func (m *AWSManager) BindAWSInstance(instanceID, bindingID, username, publicKey string) (*InstanceAddress, error) {
+	conf := instanceConfig(m.Store, instanceID)
+	logger := config.GetLogger()
+	if !bindingIDPattern.MatchString(bindingID) || !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("Invalid binding ID %q or user name %q", bindingID, username)
+	}
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if *instance.State.Name != ec2.InstanceStateNameRunning {
+		return nil, fmt.Errorf("Unable to bind to instance %s while it is %s", instanceID, *instance.State.Name)
+	}
+	bindTag := conf.TagPrefix + "brokerBind:" + bindingID
+	if _, found := instanceTag(instance, bindTag); found {
+		return nil, brokerapi.ErrBindingAlreadyExists
+	}
+	// Each binding is recorded in a tag of its own, which AWS would refuse past its limit
+	if len(instance.Tags) >= maxResourceTags {
+		return nil, fmt.Errorf("Unable to bind to instance %s: it already has the %d tags AWS allows, leaving no room to record another binding", instanceID, maxResourceTags)
+	}
+
+	err = m.Commands.RunShellCommands(*instance.InstanceId, addAuthorizedKeyCommands(username, authorizedKeyLine(publicKey, bindingID)))
+	if err != nil {
+		logger.Error("failed-adding-key", err, lager.Data{
+			"instance_id":     instanceID,
+			"binding_id":      bindingID,
+			"aws_instance_id": *instance.InstanceId,
+		})
+		return nil, err
+	}
+
+	err = m.tagEC2Instance(*instance.InstanceId, map[string]string{bindTag: username})
 	if err != nil {
-		logger.Error("failed-tagging-instance", err, lager.Data{
-			"ami_id":            amiID,
-			"security_group_id": securityGroupID,
-			"subnet_id":         subnetID,
-			"instance_id":       instanceID,
-			"aws_instance_id":   reservation.Instances[0].InstanceId,
+		logger.Error("failed-tagging-binding", err, lager.Data{
+			"instance_id":     instanceID,
+			"binding_id":      bindingID,
+			"aws_instance_id": *instance.InstanceId,
 		})
-		// Destroy the instance on failure
-		_, innerErr := m.terminateEC2Instance(*reservation.Instances[0].InstanceId)
+		// Don't leave behind a key we have no record of
+		innerErr := m.Commands.RunShellCommands(*instance.InstanceId, removeAuthorizedKeyCommands(username, bindingID))
 		if innerErr != nil {
-			logger.Error("failed-terminating-instance", err, lager.Data{
-				"instance_id": instanceID,
-			})
-			return "", fmt.Errorf("Failed to terminate instance after failing to tag instance %s (AWS ID: %s): %s (tagging error: %s)", instanceID, *reservation.Instances[0].InstanceId, innerErr, err)
+			return nil, fmt.Errorf("Failed to remove key after failing to tag binding %s on instance %s: %s (tagging error: %s)", bindingID, instanceID, innerErr, err)
 		}
+		return nil, err
+	}
+
+	return &InstanceAddress{
+		PrivateIP: aws.StringValue(instance.PrivateIpAddress),
+		PublicIP:  aws.StringValue(instance.PublicIpAddress),
+		ElasticIP: elasticIP(instance),
+	}, nil
+}
+
+/*
+UnbindAWSInstance removes the key installed for the binding and its brokerBind tag. Returns brokerapi.ErrBindingDoesNotExist
+if the instance has no such binding.
+*/
+func (m *AWSManager) UnbindAWSInstance(instanceID, bindingID string) error {
+	conf := instanceConfig(m.Store, instanceID)
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err != nil {
+		return err
+	}
+	bindTag := conf.TagPrefix + "brokerBind:" + bindingID
+	username, found := instanceTag(instance, bindTag)
+	if !found {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+	if !bindingIDPattern.MatchString(bindingID) || !usernamePattern.MatchString(username) {
+		return fmt.Errorf("Invalid binding ID %q or user name %q", bindingID, username)
+	}
+	err = m.Commands.RunShellCommands(*instance.InstanceId, removeAuthorizedKeyCommands(username, bindingID))
+	if err != nil {
+		return err
+	}
+	_, err = m.Client.DeleteTags(&ec2.DeleteTagsInput{
+		Resources: []*string{instance.InstanceId},
+		Tags:      []*ec2.Tag{{Key: aws.String(bindTag)}},
+	})
+	return err
+}
+
+/*
+DescribeAWSInstance describes an EC2 instance by its service instance ID
+*/
+func (m *AWSManager) DescribeAWSInstance(instanceID string) (*InstanceDescription, error) {
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, len(instance.SecurityGroups))
+	for i, group := range instance.SecurityGroups {
+		groups[i] = aws.StringValue(group.GroupId)
+	}
+	return &InstanceDescription{
+		AWSInstanceID:    aws.StringValue(instance.InstanceId),
+		State:            aws.StringValue(instance.State.Name),
+		InstanceType:     aws.StringValue(instance.InstanceType),
+		ImageID:          aws.StringValue(instance.ImageId),
+		SubnetID:         aws.StringValue(instance.SubnetId),
+		SecurityGroupIDs: groups,
+		PublicIP:         aws.StringValue(instance.PublicIpAddress),
+		ElasticIP:        elasticIP(instance),
+	}, nil
+}
+
+/*
+StopAWSInstance stops an EC2 instance by its service instance ID, returning its new state
+*/
+func (m *AWSManager) StopAWSInstance(instanceID string) (string, error) {
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err != nil {
 		return "", err
 	}
+	output, err := m.Client.StopInstances(&ec2.StopInstancesInput{
+		InstanceIds: []*string{instance.InstanceId},
+	})
+	if err != nil {
+		return "", err
+	}
+	state := aws.StringValue(output.StoppingInstances[0].CurrentState.Name)
+	updateStore(m.Store, instanceID, func(record *store.Instance) {
+		record.AWSState = state
+	})
+	return state, nil
+}
 
-	return *reservation.Instances[0].InstanceId, nil
+/*
+StartAWSInstance starts a stopped EC2 instance by its service instance ID, returning its new state
+*/
+func (m *AWSManager) StartAWSInstance(instanceID string) (string, error) {
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err != nil {
+		return "", err
+	}
+	output, err := m.Client.StartInstances(&ec2.StartInstancesInput{
+		InstanceIds: []*string{instance.InstanceId},
+	})
+	if err != nil {
+		return "", err
+	}
+	state := aws.StringValue(output.StartingInstances[0].CurrentState.Name)
+	updateStore(m.Store, instanceID, func(record *store.Instance) {
+		record.AWSState = state
+	})
+	return state, nil
 }
 
 /*
-TerminateAWSInstance terminates an EC2 instance given its service instance ID (*not* its AWS Instance ID).
-Returns the current status
+SetAWSInstanceSecurityGroups replaces the security groups of an EC2 instance by its service instance ID
 */
-func (m *AWSManager) TerminateAWSInstance(instanceID string) (string, error) {
+func (m *AWSManager) SetAWSInstanceSecurityGroups(instanceID string, securityGroupIDs []string) error {
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err != nil {
+		return err
+	}
+	_, err = m.Client.ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+		InstanceId: instance.InstanceId,
+		Groups:     aws.StringSlice(securityGroupIDs),
+	})
+	return err
+}
+
+/*
+SetAWSInstanceTags sets the custom tags on an EC2 instance and on the volumes and network interfaces attached to it, and
+removes the tags named in removed.
+*/
+func (m *AWSManager) SetAWSInstanceTags(instanceID string, tags map[string]string, removed []string) error {
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err != nil {
+		return err
+	}
+	resources := []*string{instance.InstanceId}
+	for _, mapping := range instance.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil {
+			resources = append(resources, mapping.Ebs.VolumeId)
+		}
+	}
+	for _, networkInterface := range instance.NetworkInterfaces {
+		resources = append(resources, networkInterface.NetworkInterfaceId)
+	}
+	if len(removed) > 0 {
+		deleted := []*ec2.Tag{}
+		for _, key := range removed {
+			deleted = append(deleted, &ec2.Tag{Key: aws.String(key)})
+		}
+		_, err = m.Client.DeleteTags(&ec2.DeleteTagsInput{Resources: resources, Tags: deleted})
+		if err != nil {
+			return err
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	created := []*ec2.Tag{}
+	for key, value := range tags {
+		created = append(created, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	_, err = m.Client.CreateTags(&ec2.CreateTagsInput{Resources: resources, Tags: created})
+	return err
+}
+
+/*
+SetAWSInstancePublicIP gives an EC2 instance a public address, or takes it away, returning the public address. A public IP assigned
+at launch can't be added to an instance afterwards, so the broker allocates an address, tags it with brokerInstance = instanceID and
+associates it with the instance's primary network interface. Only addresses allocated by the broker can be removed.
+*/
+func (m *AWSManager) SetAWSInstancePublicIP(instanceID string, assignPublicIP bool) (string, error) {
 	instance, err := m.getEC2InstanceByServiceID(instanceID)
 	if err != nil {
 		return "", err
 	}
-	return m.terminateEC2Instance(*instance.InstanceId)
+	if !assignPublicIP {
+		addresses, err := m.brokerAddresses(instanceID)
+		if err != nil {
+			return "", err
+		}
+		if len(addresses) == 0 && instance.PublicIpAddress != nil {
+			return "", fmt.Errorf("The public IP assigned to instance %s at launch cannot be removed", instanceID)
+		}
+		return "", m.releaseAddresses(instanceID)
+	}
+	if instance.PublicIpAddress != nil {
+		return *instance.PublicIpAddress, nil
+	}
+	return m.associateAddress(instanceID, instance)
 }
 
 /*
-GetAWSInstanceStatus gets the status of an EC2 instance by its service instance ID
+AssociateAWSElasticIP associates an Elastic IP with the primary network interface of an instance by its service instance
+ID, returning the address. The address allocated for the instance at provision time is used if there is one, and a new
+one allocated otherwise. Addresses the broker allocates are tagged with brokerInstance = instanceID.
 */
-func (m *AWSManager) GetAWSInstanceStatus(instanceID string) (string, error) {
+func (m *AWSManager) AssociateAWSElasticIP(instanceID string) (string, error) {
 	instance, err := m.getEC2InstanceByServiceID(instanceID)
 	if err != nil {
 		return "", err
 	}
-	return *instance.State.Name, nil
+	return m.associateAddress(instanceID, instance)
+}
+
+/*
+ReleaseAWSElasticIP disassociates and releases the Elastic IPs the broker allocated for an instance by its service instance ID
+*/
+func (m *AWSManager) ReleaseAWSElasticIP(instanceID string) error {
+	return m.releaseAddresses(instanceID)
+}
+
+/*
+SetAWSInstanceType changes the instance type of a stopped EC2 instance by its service instance ID
+*/
+func (m *AWSManager) SetAWSInstanceType(instanceID, instanceType string) error {
+	instance, err := m.getEC2InstanceByServiceID(instanceID)
+	if err != nil {
+		return err
+	}
+	_, err = m.Client.ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+		InstanceId:   instance.InstanceId,
+		InstanceType: &ec2.AttributeValue{Value: aws.String(instanceType)},
+	})
+	return err
 }
 
 // Private functions
 
-// TODO: Should probably move this to config....
+// Checks launch parameters against what the plan allows. Provisioning and updates share these checks.
+func validateParameters(plan *config.PlanConfig, parameters ProvisionParameters) error {
+	// AMIs from the plan's image families are resolved by the broker, never given by users
+	if parameters.Image != "" && findImageFamily(plan, parameters.Image) == nil {
+		return fmt.Errorf("Attempt to start disallowed image: %s", parameters.Image)
+	}
+	if parameters.Image == "" && !stringIn(parameters.AMIID, plan.AllowedAMIs) {
+		return fmt.Errorf("Attempt to start disallowed AMI: %s", parameters.AMIID)
+	}
+	securityGroupIDs := parameters.securityGroups()
+	if len(securityGroupIDs) == 0 {
+		return errors.New("Attempt to start instance without a security group")
+	}
+	for _, securityGroupID := range securityGroupIDs {
+		if !stringIn(securityGroupID, plan.AllowedSecurityGroups) {
+			return fmt.Errorf("Attempt to start instance in disallowed security group: %s", securityGroupID)
+		}
+	}
+	if !stringIn(parameters.SubnetID, plan.AllowedSubnets) {
+		return fmt.Errorf("Attempt to start instance in disallowed subnet: %s", parameters.SubnetID)
+	}
+	if parameters.AssignPublicIP && !plan.AllowPublicIP {
+		return errors.New("Attempt to start instance with a public IP while plan does not allow it")
+	}
+	if parameters.ElasticIP && !plan.AllowElasticIP {
+		return errors.New("Attempt to start instance with an Elastic IP while plan does not allow it")
+	}
+	if parameters.InstanceProfile != "" && !stringIn(parameters.InstanceProfile, plan.AllowedInstanceProfiles) {
+		return fmt.Errorf("Attempt to start instance with disallowed instance profile: %s", parameters.InstanceProfile)
+	}
+	err := validateUserData(plan, parameters.UserData)
+	if err != nil {
+		return err
+	}
+	return validateVolumes(plan, parameters.Volumes)
+}
+
+// Sets whether the data volumes launched with an instance are deleted with it, following the current policy of the
+// instance's plan since the plan may have changed since launch
+func (m *AWSManager) applyVolumeDeletionPolicy(instanceID, awsInstanceID string) error {
+	record, err := m.Store.Get(instanceID)
+	if err != nil || len(record.Parameters) == 0 {
+		return nil
+	}
+	var parameters ProvisionParameters
+	err = json.Unmarshal(record.Parameters, &parameters)
+	if err != nil || len(parameters.Volumes) == 0 {
+		return err
+	}
+	plan, err := findPlan(config.GetConfiguration(), record.PlanID)
+	if err != nil {
+		return err
+	}
+	var mappings []*ec2.InstanceBlockDeviceMappingSpecification
+	for _, volume := range resolveVolumes(plan.Volumes, parameters.Volumes) {
+		mappings = append(mappings, &ec2.InstanceBlockDeviceMappingSpecification{
+			DeviceName: aws.String(volume.DeviceName),
+			Ebs: &ec2.EbsInstanceBlockDeviceSpecification{
+				DeleteOnTermination: aws.Bool(deletesOnTermination(plan.Volumes)),
+			},
+		})
+	}
+	_, err = m.Client.ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+		InstanceId:          aws.String(awsInstanceID),
+		BlockDeviceMappings: mappings,
+	})
+	return err
+}
+
+// The client token making RunInstances idempotent for a service instance. Tokens are limited to 64 ASCII characters,
+// which a hex SHA-256 fills exactly.
+func provisionClientToken(instanceID string) string {
+	sum := sha256.Sum256([]byte("ec2-broker:" + instanceID))
+	return hex.EncodeToString(sum[:])
+}
+
+// A digest of what a provision request asks for: its plan, organization, space and parameters, with an image named
+// rather than the AMI it resolved to, since a retry may resolve the image to a newer AMI
+func provisionDigest(context ProvisionContext, parameters ProvisionParameters) string {
+	if parameters.Image != "" {
+		parameters.AMIID = ""
+	}
+	data, _ := json.Marshal(struct {
+		PlanID           string              `json:"plan_id"`
+		OrganizationGUID string              `json:"organization_guid"`
+		SpaceGUID        string              `json:"space_guid"`
+		Parameters       ProvisionParameters `json:"parameters"`
+	}{context.PlanID, context.OrganizationGUID, context.SpaceGUID, parameters})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Whether an instance already launched for a service instance was launched for the same request. Instances tagged with
+// the digest of their request must match it in full; those launched before the broker tagged the digest can only be
+// matched on their AMI, subnet and instance type.
+func sameLaunch(conf *config.Config, instance *ec2.Instance, plan *config.PlanConfig, context ProvisionContext, parameters ProvisionParameters) bool {
+	if digest, ok := instanceTag(instance, conf.TagPrefix+"brokerRequest"); ok {
+		return digest == provisionDigest(context, parameters)
+	}
+	return aws.StringValue(instance.ImageId) == parameters.AMIID &&
+		aws.StringValue(instance.SubnetId) == parameters.SubnetID &&
+		aws.StringValue(instance.InstanceType) == plan.InstanceType
+}
+
+// Instance profiles may be given by name or by ARN
+func instanceProfileSpecification(profile string) *ec2.IamInstanceProfileSpecification {
+	if strings.HasPrefix(profile, "arn:") {
+		return &ec2.IamInstanceProfileSpecification{Arn: aws.String(profile)}
+	}
+	return &ec2.IamInstanceProfileSpecification{Name: aws.String(profile)}
+}
+
+// Finds a plan in whichever service it belongs to
 func findPlan(conf *config.Config, planID string) (*config.PlanConfig, error) {
-	for i := 0; i < len(conf.Plans); i++ {
-		if conf.Plans[i].ID == planID {
-			return &conf.Plans[i], nil
+	_, plan, err := conf.FindPlan(planID)
+	return plan, err
+}
+
+// Finds a plan, along with the configuration narrowed to its service. A request naming a service must name the plan's.
+func servicePlan(conf *config.Config, serviceID, planID string) (*config.Config, *config.PlanConfig, error) {
+	service, _, err := conf.FindPlan(planID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if serviceID != "" && serviceID != service.ID {
+		return nil, nil, fmt.Errorf("Plan %s does not belong to service %s", planID, serviceID)
+	}
+	narrowed, err := conf.ForService(service.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	plan, err := findPlan(narrowed, planID)
+	return narrowed, plan, err
+}
+
+// The configuration narrowed to the service the store records an instance under, or failing that the service of its
+// plan. Instances the store cannot place get the whole configuration, which looks for them under every tag prefix.
+func instanceConfig(s store.Store, instanceID string) *config.Config {
+	conf := config.GetConfiguration()
+	record, err := s.Get(instanceID)
+	if err != nil {
+		return conf
+	}
+	serviceID := record.ServiceID
+	if serviceID == "" {
+		if service, _, err := conf.FindPlan(record.PlanID); err == nil {
+			serviceID = service.ID
 		}
 	}
-	return nil, fmt.Errorf("Unable to find plan in configuration: %s", planID)
+	if narrowed, err := conf.ForService(serviceID); err == nil {
+		return narrowed
+	}
+	return conf
+}
+
+// The login user for instances launched under a plan
+func sshUsername(plan *config.PlanConfig) string {
+	if plan.SSHUsername == "" {
+		return config.DefaultSSHUsername
+	}
+	return plan.SSHUsername
 }
 
 // TODO: And should move this to a common utility
@@ -181,8 +756,24 @@ func stringIn(s string, arr []string) bool {
 	return false
 }
 
+// Compares two lists of strings as sets
+func sameStrings(a, b []string) bool {
+	for _, s := range a {
+		if !stringIn(s, b) {
+			return false
+		}
+	}
+	for _, s := range b {
+		if !stringIn(s, a) {
+			return false
+		}
+	}
+	return true
+}
+
 // Tags a given EC2 instance with the passed in map - Instance ID refers to the AWS
-// Instance ID, *not* the service instance ID
+// Instance ID, *not* the service instance ID. Other EC2 resource IDs, such as address
+// allocations, can be tagged the same way.
 func (m *AWSManager) tagEC2Instance(awsInstanceID string, tags map[string]string) error {
 	tagStructs := make([]*ec2.Tag, len(tags))
 	i := 0
@@ -203,6 +794,165 @@ func (m *AWSManager) tagEC2Instance(awsInstanceID string, tags map[string]string
 	return err
 }
 
+// Records a change to an instance in the store. Failures are logged rather than returned, since the instance tags remain
+// a fallback record and failing here would leave AWS resources the caller doesn't know about.
+func updateStore(s store.Store, instanceID string, fn func(*store.Instance)) {
+	err := s.Update(instanceID, func(record *store.Instance) error {
+		fn(record)
+		return nil
+	})
+	if err != nil {
+		config.GetLogger().Error("updating-store", err, lager.Data{"instance_id": instanceID})
+	}
+}
+
+// The network interface at device index 0, which carries the instance's primary addresses
+func primaryNetworkInterface(instance *ec2.Instance) *ec2.InstanceNetworkInterface {
+	for _, eni := range instance.NetworkInterfaces {
+		if eni.Attachment != nil && aws.Int64Value(eni.Attachment.DeviceIndex) == 0 {
+			return eni
+		}
+	}
+	return nil
+}
+
+// The public IP of an instance's primary network interface if it is an Elastic IP rather than one assigned by AWS
+func elasticIP(instance *ec2.Instance) string {
+	eni := primaryNetworkInterface(instance)
+	if eni == nil || eni.Association == nil || aws.StringValue(eni.Association.IpOwnerId) == "amazon" {
+		return ""
+	}
+	return aws.StringValue(eni.Association.PublicIp)
+}
+
+// Allocates an address for a service instance, tagged with the prefix of its service so it can be found and released
+// along with the instance
+func (m *AWSManager) allocateAddress(conf *config.Config, instanceID string) (*ec2.Address, error) {
+	allocation, err := m.Client.AllocateAddress(&ec2.AllocateAddressInput{Domain: aws.String(ec2.DomainTypeVpc)})
+	if err != nil {
+		return nil, err
+	}
+	err = m.tagEC2Instance(*allocation.AllocationId, map[string]string{
+		conf.TagPrefix + "brokerInstance": instanceID,
+	})
+	if err != nil {
+		_, innerErr := m.Client.ReleaseAddress(&ec2.ReleaseAddressInput{AllocationId: allocation.AllocationId})
+		if innerErr != nil {
+			return nil, fmt.Errorf("Failed to release address %s after failing to tag it for instance %s: %s (tagging error: %s)", *allocation.AllocationId, instanceID, innerErr, err)
+		}
+		return nil, err
+	}
+	return &ec2.Address{AllocationId: allocation.AllocationId, PublicIp: allocation.PublicIp}, nil
+}
+
+// Associates the address the broker allocated for a service instance with its primary network interface, allocating
+// one first if there is none. An address allocated here is released again if the association fails.
+func (m *AWSManager) associateAddress(instanceID string, instance *ec2.Instance) (string, error) {
+	logger := config.GetLogger()
+	eni := primaryNetworkInterface(instance)
+	if eni == nil {
+		return "", fmt.Errorf("Instance %s has no primary network interface", instanceID)
+	}
+	addresses, err := m.brokerAddresses(instanceID)
+	if err != nil {
+		return "", err
+	}
+	var address *ec2.Address
+	allocated := false
+	if len(addresses) > 0 {
+		address = addresses[0]
+		if aws.StringValue(address.NetworkInterfaceId) == aws.StringValue(eni.NetworkInterfaceId) {
+			return aws.StringValue(address.PublicIp), nil
+		}
+	} else {
+		address, err = m.allocateAddress(instanceConfig(m.Store, instanceID), instanceID)
+		if err != nil {
+			return "", err
+		}
+		allocated = true
+	}
+
+	_, err = m.Client.AssociateAddress(&ec2.AssociateAddressInput{
+		AllocationId:       address.AllocationId,
+		NetworkInterfaceId: eni.NetworkInterfaceId,
+	})
+	if err != nil {
+		logger.Error("failed-associating-address", err, lager.Data{
+			"instance_id":   instanceID,
+			"allocation_id": *address.AllocationId,
+		})
+		if !allocated {
+			return "", err
+		}
+		_, innerErr := m.Client.ReleaseAddress(&ec2.ReleaseAddressInput{AllocationId: address.AllocationId})
+		if innerErr != nil {
+			return "", fmt.Errorf("Failed to release address %s after failing to associate it with instance %s: %s (association error: %s)", *address.AllocationId, instanceID, innerErr, err)
+		}
+		return "", err
+	}
+	return aws.StringValue(address.PublicIp), nil
+}
+
+// Finds the addresses the broker allocated for a service instance
+func (m *AWSManager) brokerAddresses(instanceID string) ([]*ec2.Address, error) {
+	addresses := []*ec2.Address{}
+	for _, prefix := range instanceConfig(m.Store, instanceID).TagPrefixes() {
+		output, err := m.Client.DescribeAddresses(&ec2.DescribeAddressesInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("tag:" + prefix + "brokerInstance"),
+					Values: []*string{aws.String(instanceID)},
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, output.Addresses...)
+	}
+	return addresses, nil
+}
+
+// Disassociates and releases the addresses the broker allocated for a service instance
+func (m *AWSManager) releaseAddresses(instanceID string) error {
+	addresses, err := m.brokerAddresses(instanceID)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		if address.AssociationId != nil {
+			_, err = m.Client.DisassociateAddress(&ec2.DisassociateAddressInput{AssociationId: address.AssociationId})
+			if err != nil {
+				return err
+			}
+		}
+		_, err = m.Client.ReleaseAddress(&ec2.ReleaseAddressInput{AllocationId: address.AllocationId})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Releases the address allocated for a service instance that failed to launch, logging rather than returning errors so
+// the launch failure is what gets reported
+func (m *AWSManager) releaseAddressAfterFailure(instanceID string, address *ec2.Address) {
+	_, err := m.Client.ReleaseAddress(&ec2.ReleaseAddressInput{AllocationId: address.AllocationId})
+	if err != nil {
+		config.GetLogger().Error("failed-releasing-address", err, lager.Data{"instance_id": instanceID, "allocation_id": aws.StringValue(address.AllocationId)})
+	}
+}
+
+// Looks up the value of the tag with the given key on an instance
+func instanceTag(instance *ec2.Instance, key string) (string, bool) {
+	for _, tag := range instance.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), true
+		}
+	}
+	return "", false
+}
+
 // Terminate an EC2 instance given its awsInstanceID
 func (m *AWSManager) terminateEC2Instance(awsInstanceID string) (string, error) {
 	input := &ec2.TerminateInstancesInput{
@@ -214,32 +964,55 @@ func (m *AWSManager) terminateEC2Instance(awsInstanceID string) (string, error)
 	if err != nil {
 		return "", err
 	}
-	return output.TerminatingInstances[0].CurrentState.String(), nil
+	return aws.StringValue(output.TerminatingInstances[0].CurrentState.Name), nil
 }
 
-// Extracts an EC2 instance based on a tag named tagPrefix + "brokerInstance" being = serviceID
+// Extracts an EC2 instance by the AWS instance ID in the store, or failing that based on a tag named
+// tagPrefix + "brokerInstance" being = serviceID, under the tag prefix of the instance's service
 // This will return brokerapi.ErrInstanceDoesNotExist if no such instance is found
 func (m *AWSManager) getEC2InstanceByServiceID(serviceID string) (*ec2.Instance, error) {
-	conf := config.GetConfiguration()
 	logger := config.GetLogger()
-	input := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			{
-				Name:   aws.String("tag:" + conf.TagPrefix + "brokerInstance"),
-				Values: []*string{aws.String(serviceID)},
-			},
-		},
+	if record, err := m.Store.Get(serviceID); err == nil && record.AWSInstanceID != "" {
+		output, err := m.Client.DescribeInstances(&ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(record.AWSInstanceID)},
+		})
+		if err == nil && len(output.Reservations) > 0 && len(output.Reservations[0].Instances) > 0 {
+			return output.Reservations[0].Instances[0], nil
+		}
+		// An instance that has aged out of AWS is reported as not found; anything else is a real failure
+		if aerr, ok := err.(awserr.Error); err != nil && (!ok || aerr.Code() != "InvalidInstanceID.NotFound") {
+			return nil, err
+		}
 	}
-	output, err := m.Client.DescribeInstances(input)
-	if err != nil {
-		return nil, err
+	var instances []*ec2.Instance
+	for _, prefix := range instanceConfig(m.Store, serviceID).TagPrefixes() {
+		input := &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("tag:" + prefix + "brokerInstance"),
+					Values: []*string{aws.String(serviceID)},
+				},
+			},
+		}
+		output, err := m.Client.DescribeInstances(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range output.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
 	}
-	if len(output.Reservations) == 0 || len(output.Reservations[0].Instances) == 0 {
+	if len(instances) == 0 {
 		return nil, brokerapi.ErrInstanceDoesNotExist
 	}
-	if len(output.Reservations) > 1 || len(output.Reservations[0].Instances) > 1 {
+	if len(instances) > 1 {
 		logger.Error("finding-instance", errors.New("Multiple nstances with the same service instance ID"), lager.Data{"brokerID": serviceID})
 		return nil, fmt.Errorf("Too many running instances with tag")
 	}
-	return output.Reservations[0].Instances[0], nil
+	instance := instances[0]
+	// A terminated instance is left from a deprovision whose record has been deleted, and is not recorded again
+	if instance.State == nil || aws.StringValue(instance.State.Name) != ec2.InstanceStateNameTerminated {
+		updateStore(m.Store, serviceID, recordFromTags(config.GetConfiguration(), instance))
+	}
+	return instance, nil
 }
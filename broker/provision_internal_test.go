@@ -0,0 +1,321 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/GSA/ec2-broker/config"
+	"github.com/GSA/ec2-broker/store"
+)
+
+// An EC2 client answering each operation with the given XML response body instead of calling AWS, and adding the
+// operations called to called if it is given. Error responses, which EC2 wraps in a Response element, have a 400 status.
+func stubEC2Client(responses map[string]string, called *[]string) *ec2.EC2 {
+	client := ec2.New(session.New(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.AnonymousCredentials}))
+	client.Handlers.Send.Clear()
+	client.Handlers.Send.PushBack(func(r *request.Request) {
+		if called != nil {
+			*called = append(*called, r.Operation.Name)
+		}
+		body := responses[r.Operation.Name]
+		status := 200
+		if strings.HasPrefix(body, "<Response>") {
+			status = 400
+		}
+		r.HTTPResponse = &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+	})
+	return client
+}
+
+const testKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f"
+
+// A command runner recording the commands it is given instead of running them
+type recordingCommandRunner struct {
+	commands [][]string
+}
+
+func (r *recordingCommandRunner) RunShellCommands(awsInstanceID string, commands []string) error {
+	r.commands = append(r.commands, commands)
+	return nil
+}
+
+var _ = Describe("Provision", func() {
+	var (
+		plan       *config.PlanConfig
+		parameters ProvisionParameters
+	)
+
+	BeforeEach(func() {
+		plan = &config.PlanConfig{
+			ID:                      "plan-id",
+			AllowedAMIs:             []string{"ami-1"},
+			AllowedSecurityGroups:   []string{"sg-1"},
+			AllowedSubnets:          []string{"sn-1"},
+			AllowedInstanceProfiles: []string{"app-profile", "arn:aws:iam::123456789012:instance-profile/other"},
+		}
+		parameters = ProvisionParameters{AMIID: "ami-1", SecurityGroupID: "sg-1", SubnetID: "sn-1"}
+	})
+
+	Describe("instance profiles", func() {
+		It("allows launching without an instance profile", func() {
+			Expect(validateParameters(plan, parameters)).To(Succeed())
+		})
+
+		It("allows the plan's instance profiles", func() {
+			parameters.InstanceProfile = "app-profile"
+			Expect(validateParameters(plan, parameters)).To(Succeed())
+		})
+
+		It("refuses instance profiles the plan does not list", func() {
+			parameters.InstanceProfile = "admin-profile"
+			Expect(validateParameters(plan, parameters)).ToNot(Succeed())
+		})
+
+		It("specifies profiles by ARN or by name", func() {
+			byARN := instanceProfileSpecification("arn:aws:iam::123456789012:instance-profile/other")
+			Expect(aws.StringValue(byARN.Arn)).To(Equal("arn:aws:iam::123456789012:instance-profile/other"))
+			Expect(byARN.Name).To(BeNil())
+			byName := instanceProfileSpecification("app-profile")
+			Expect(aws.StringValue(byName.Name)).To(Equal("app-profile"))
+			Expect(byName.Arn).To(BeNil())
+		})
+	})
+
+	It("derives a stable client token from the service instance ID", func() {
+		token := provisionClientToken("3f2c1a0e-6a55-4b1e-9d53-2f7a8c1e9b01")
+		Expect(token).To(HaveLen(64))
+		Expect(provisionClientToken("3f2c1a0e-6a55-4b1e-9d53-2f7a8c1e9b01")).To(Equal(token))
+		Expect(provisionClientToken("another-instance")).ToNot(Equal(token))
+	})
+
+	Describe("services", func() {
+		conf := &config.Config{
+			TagPrefix: "cg:",
+			Services: []config.ServiceConfig{
+				{ID: "compute-id", Plans: []config.PlanConfig{{ID: "micro-id"}}},
+				{ID: "batch-id", TagPrefix: "batch:", KeyPairName: "batch-key", Plans: []config.PlanConfig{{ID: "large-id"}}},
+			},
+		}
+
+		It("resolves a plan within its service", func() {
+			narrowed, plan, err := servicePlan(conf, "batch-id", "large-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(plan.ID).To(Equal("large-id"))
+			Expect(narrowed.TagPrefix).To(Equal("batch:"))
+			Expect(narrowed.KeyPairName).To(Equal("batch-key"))
+		})
+
+		It("refuses a plan of another service", func() {
+			_, _, err := servicePlan(conf, "compute-id", "large-id")
+			Expect(err).To(MatchError("Plan large-id does not belong to service compute-id"))
+		})
+	})
+
+	Describe("a launch whose client token was used with other parameters", func() {
+		var called []string
+		responses := func(addresses string) map[string]string {
+			return map[string]string{
+				"DescribeInstances": `<DescribeInstancesResponse><reservationSet/></DescribeInstancesResponse>`,
+				"DescribeAddresses": `<DescribeAddressesResponse><addressesSet>` + addresses + `</addressesSet></DescribeAddressesResponse>`,
+				"AllocateAddress":   `<AllocateAddressResponse><publicIp>52.0.0.2</publicIp><domain>vpc</domain><allocationId>eipalloc-2</allocationId></AllocateAddressResponse>`,
+				"CreateTags":        `<CreateTagsResponse><return>true</return></CreateTagsResponse>`,
+				"RunInstances":      `<Response><Errors><Error><Code>IdempotentParameterMismatch</Code><Message>token reused</Message></Error></Errors><RequestID>request-1</RequestID></Response>`,
+				"ReleaseAddress":    `<ReleaseAddressResponse><return>true</return></ReleaseAddressResponse>`,
+			}
+		}
+		provision := func(m *AWSManager) error {
+			_, err := m.ProvisionAWSInstance("instance-1", ProvisionContext{ServiceID: "service-id", PlanID: "plan-id"}, ProvisionParameters{AMIID: "ami-1", SecurityGroupID: "sg-1", SubnetID: "sn-1", ElasticIP: true})
+			return err
+		}
+
+		BeforeEach(func() {
+			config.SetConfiguration(&config.Config{TagPrefix: "cg:", ServiceID: "service-id", Plans: []config.PlanConfig{{
+				ID:                    "plan-id",
+				InstanceType:          "t2.micro",
+				AllowedAMIs:           []string{"ami-1"},
+				AllowedSecurityGroups: []string{"sg-1"},
+				AllowedSubnets:        []string{"sn-1"},
+				AllowElasticIP:        true,
+			}}})
+			called = nil
+		})
+
+		It("releases the Elastic IP allocated for it", func() {
+			m := &AWSManager{Store: store.NewMemoryStore(), Discovery: NewDiscoveryCache(), Client: stubEC2Client(responses(""), &called)}
+			Expect(provision(m)).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+			Expect(called).To(ContainElement("AllocateAddress"))
+			Expect(called).To(ContainElement("ReleaseAddress"))
+		})
+
+		It("leaves the Elastic IP of the instance the first launch started alone", func() {
+			address := `<item><publicIp>52.0.0.1</publicIp><allocationId>eipalloc-1</allocationId><associationId>eipassoc-1</associationId><domain>vpc</domain></item>`
+			m := &AWSManager{Store: store.NewMemoryStore(), Discovery: NewDiscoveryCache(), Client: stubEC2Client(responses(address), &called)}
+			Expect(provision(m)).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+			Expect(called).ToNot(ContainElement("AllocateAddress"))
+			Expect(called).ToNot(ContainElement("DisassociateAddress"))
+			Expect(called).ToNot(ContainElement("ReleaseAddress"))
+		})
+	})
+
+	Describe("a request for an instance that has already been launched", func() {
+		launched := ProvisionParameters{AMIID: "ami-1", SecurityGroupID: "sg-1", SubnetID: "sn-1"}
+		context := ProvisionContext{ServiceID: "service-id", PlanID: "plan-id", OrganizationGUID: "org-guid", SpaceGUID: "space-guid"}
+		var m *AWSManager
+
+		BeforeEach(func() {
+			config.SetConfiguration(&config.Config{TagPrefix: "cg:", ServiceID: "service-id", Plans: []config.PlanConfig{{
+				ID:                    "plan-id",
+				InstanceType:          "t2.micro",
+				AllowedAMIs:           []string{"ami-1"},
+				AllowedSecurityGroups: []string{"sg-1", "sg-2"},
+				AllowedSubnets:        []string{"sn-1"},
+			}}})
+			m = &AWSManager{Store: store.NewMemoryStore(), Discovery: NewDiscoveryCache(), Client: stubEC2Client(map[string]string{
+				"DescribeInstances": `<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1</instanceId>` +
+					`<imageId>ami-1</imageId><subnetId>sn-1</subnetId><instanceType>t2.micro</instanceType><instanceState><code>16</code><name>running</name></instanceState>` +
+					`<tagSet><item><key>cg:brokerInstance</key><value>instance-1</value></item>` +
+					`<item><key>cg:brokerRequest</key><value>` + provisionDigest(context, launched) + `</value></item></tagSet>` +
+					`</item></instancesSet></item></reservationSet></DescribeInstancesResponse>`,
+			}, nil)}
+		})
+
+		It("is answered with the instance when it asks for the same launch", func() {
+			awsID, err := m.ProvisionAWSInstance("instance-1", context, launched)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(awsID).To(Equal("i-1"))
+		})
+
+		It("conflicts when it asks for anything else, even with the same AMI, subnet and instance type", func() {
+			parameters := launched
+			parameters.SecurityGroupIDs = []string{"sg-2"}
+			_, err := m.ProvisionAWSInstance("instance-1", context, parameters)
+			Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+			parameters = launched
+			parameters.Tags = map[string]string{"Project": "apollo"}
+			_, err = m.ProvisionAWSInstance("instance-1", context, parameters)
+			Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+		})
+	})
+
+	It("digests a request with an image by the image rather than the AMI it resolved to", func() {
+		context := ProvisionContext{PlanID: "plan-id"}
+		digest := provisionDigest(context, ProvisionParameters{Image: "ubuntu", AMIID: "ami-1", SubnetID: "sn-1"})
+		Expect(provisionDigest(context, ProvisionParameters{Image: "ubuntu", AMIID: "ami-2", SubnetID: "sn-1"})).To(Equal(digest))
+		Expect(provisionDigest(context, ProvisionParameters{Image: "ubuntu", AMIID: "ami-1", SubnetID: "sn-2"})).ToNot(Equal(digest))
+		Expect(provisionDigest(ProvisionContext{PlanID: "plan-id", SpaceGUID: "other"}, ProvisionParameters{Image: "ubuntu", AMIID: "ami-1", SubnetID: "sn-1"})).ToNot(Equal(digest))
+	})
+
+	Describe("binding an instance that carries many tags", func() {
+		var (
+			called   []string
+			commands *recordingCommandRunner
+		)
+		manager := func(tagCount int) *AWSManager {
+			tags := `<item><key>cg:brokerInstance</key><value>instance-1</value></item>`
+			for i := 1; i < tagCount; i++ {
+				tags += fmt.Sprintf(`<item><key>Tag%d</key><value>x</value></item>`, i)
+			}
+			return &AWSManager{Store: store.NewMemoryStore(), Commands: commands, Client: stubEC2Client(map[string]string{
+				"DescribeInstances": `<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1</instanceId>` +
+					`<instanceState><code>16</code><name>running</name></instanceState><tagSet>` + tags + `</tagSet>` +
+					`</item></instancesSet></item></reservationSet></DescribeInstancesResponse>`,
+				"CreateTags": `<CreateTagsResponse><return>true</return></CreateTagsResponse>`,
+			}, &called)}
+		}
+
+		BeforeEach(func() {
+			config.SetConfiguration(&config.Config{TagPrefix: "cg:"})
+			called, commands = nil, &recordingCommandRunner{}
+		})
+
+		It("binds while there is room for the binding's tag", func() {
+			_, err := manager(maxResourceTags-1).BindAWSInstance("instance-1", "binding-1", "ec2-user", testKey)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(commands.commands).To(HaveLen(1))
+			Expect(called).To(ContainElement("CreateTags"))
+		})
+
+		It("refuses a binding there is no room to tag before installing its key", func() {
+			_, err := manager(maxResourceTags).BindAWSInstance("instance-1", "binding-1", "ec2-user", testKey)
+			Expect(err).To(MatchError(ContainSubstring("no room to record another binding")))
+			Expect(commands.commands).To(BeEmpty())
+			Expect(called).ToNot(ContainElement("CreateTags"))
+		})
+	})
+
+	It("leaves room for the launch tags and the reserved bindings within the AWS limit", func() {
+		Expect(defaultMaxUserTags + maxLaunchTags + reservedBindings).To(Equal(maxResourceTags))
+		conf := &config.Config{TagPrefix: "cg:"}
+		context := ProvisionContext{PlanID: "plan-id", OrganizationGUID: "org", SpaceGUID: "space", InstanceName: "name", OrganizationName: "org-name", SpaceName: "space-name"}
+		Expect(launchTags(conf, "instance-1", context, ProvisionParameters{Image: "ubuntu", AMIID: "ami-1"})).To(HaveLen(maxLaunchTags))
+	})
+
+	It("records the state name of a terminating instance", func() {
+		config.SetConfiguration(&config.Config{TagPrefix: "cg:"})
+		s := store.NewMemoryStore()
+		Expect(s.Update("instance-1", func(record *store.Instance) error {
+			record.AWSInstanceID = "i-1"
+			return nil
+		})).To(Succeed())
+		m := &AWSManager{Store: s, Client: stubEC2Client(map[string]string{
+			"DescribeInstances":  `<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1</instanceId><instanceState><code>16</code><name>running</name></instanceState></item></instancesSet></item></reservationSet></DescribeInstancesResponse>`,
+			"TerminateInstances": `<TerminateInstancesResponse><instancesSet><item><instanceId>i-1</instanceId><currentState><code>32</code><name>shutting-down</name></currentState></item></instancesSet></TerminateInstancesResponse>`,
+		}, nil)}
+
+		state, err := m.TerminateAWSInstance("instance-1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state).To(Equal(ec2.InstanceStateNameShuttingDown))
+		record, err := s.Get("instance-1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(record.AWSState).To(Equal("shutting-down"))
+	})
+
+	It("leaves the addresses of an instance that fails to terminate alone", func() {
+		config.SetConfiguration(&config.Config{TagPrefix: "cg:"})
+		s := store.NewMemoryStore()
+		Expect(s.Update("instance-1", func(record *store.Instance) error {
+			record.AWSInstanceID = "i-1"
+			return nil
+		})).To(Succeed())
+		var called []string
+		m := &AWSManager{Store: s, Client: stubEC2Client(map[string]string{
+			"DescribeInstances":  `<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1</instanceId><instanceState><code>16</code><name>running</name></instanceState></item></instancesSet></item></reservationSet></DescribeInstancesResponse>`,
+			"DescribeAddresses":  `<DescribeAddressesResponse><addressesSet><item><publicIp>52.0.0.1</publicIp><allocationId>eipalloc-1</allocationId><associationId>eipassoc-1</associationId><domain>vpc</domain></item></addressesSet></DescribeAddressesResponse>`,
+			"TerminateInstances": `<Response><Errors><Error><Code>OperationNotPermitted</Code><Message>termination protection</Message></Error></Errors><RequestID>request-1</RequestID></Response>`,
+		}, &called)}
+
+		_, err := m.TerminateAWSInstance("instance-1")
+		Expect(err).To(HaveOccurred())
+		Expect(called).ToNot(ContainElement("DisassociateAddress"))
+		Expect(called).ToNot(ContainElement("ReleaseAddress"))
+	})
+
+	It("does not record a terminated instance found by its tags again", func() {
+		config.SetConfiguration(&config.Config{TagPrefix: "cg:"})
+		s := store.NewMemoryStore()
+		m := &AWSManager{Store: s, Client: stubEC2Client(map[string]string{
+			"DescribeInstances": `<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1</instanceId><instanceState><code>48</code><name>terminated</name></instanceState><tagSet><item><key>cg:brokerInstance</key><value>instance-1</value></item></tagSet></item></instancesSet></item></reservationSet></DescribeInstancesResponse>`,
+		}, nil)}
+
+		instance, err := m.getEC2InstanceByServiceID("instance-1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(aws.StringValue(instance.InstanceId)).To(Equal("i-1"))
+		_, err = s.Get("instance-1")
+		Expect(err).To(Equal(store.ErrNotFound))
+	})
+})
@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// The EC2 API version of the fields added by withQueryParameters. The vendored SDK speaks 2016-09-15, which predates
+// tagging on launch and KMS keys for launch volumes; a request using them must declare the version that has them.
+const queryAPIVersion = "2016-11-15"
+
+// Builds a handler adding parameters to an EC2 query request once the SDK has built it, for API fields newer than the
+// vendored SDK, and declaring the API version they belong to. It belongs at the end of the request's Build handlers.
+func withQueryParameters(params url.Values) func(*request.Request) {
+	return func(r *request.Request) {
+		if r.Error != nil || len(params) == 0 {
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed reading EC2 Query request", err)
+			return
+		}
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed parsing EC2 Query request", err)
+			return
+		}
+		for key, value := range params {
+			values[key] = value
+		}
+		values.Set("Version", queryAPIVersion)
+		r.SetBufferBody([]byte(values.Encode()))
+	}
+}
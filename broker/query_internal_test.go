@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Query parameters", func() {
+	build := func(params url.Values) url.Values {
+		client := ec2.New(session.New(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.AnonymousCredentials}))
+		req, _ := client.RunInstancesRequest(&ec2.RunInstancesInput{ImageId: aws.String("ami-1"), MinCount: aws.Int64(1), MaxCount: aws.Int64(1)})
+		req.Handlers.Build.PushBack(withQueryParameters(params))
+		Expect(req.Build()).To(Succeed())
+		body, err := ioutil.ReadAll(req.Body)
+		Expect(err).ToNot(HaveOccurred())
+		values, err := url.ParseQuery(string(body))
+		Expect(err).ToNot(HaveOccurred())
+		return values
+	}
+
+	It("adds the parameters under the API version that has them", func() {
+		values := build(url.Values{"TagSpecification.1.ResourceType": {"instance"}})
+		Expect(values.Get("TagSpecification.1.ResourceType")).To(Equal("instance"))
+		Expect(values.Get("ImageId")).To(Equal("ami-1"))
+		Expect(values.Get("Version")).To(Equal(queryAPIVersion))
+	})
+
+	It("leaves requests without extra parameters alone", func() {
+		Expect(build(url.Values{}).Get("Version")).To(Equal("2016-09-15"))
+	})
+})
@@ -0,0 +1,440 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/GSA/ec2-broker/config"
+	"github.com/GSA/ec2-broker/store"
+)
+
+// The kinds of problem reconciliation finds
+const (
+	findingOrphan                = "orphan"
+	findingUnrecorded            = "unrecorded"
+	findingDuplicate             = "duplicate"
+	findingDrift                 = "drift"
+	findingDeprovisionIncomplete = "deprovision-incomplete"
+)
+
+/*
+ReconcileFinding is a problem found with an EC2 instance carrying the broker's brokerInstance tag. Action says what the
+reconciler did about it, if anything.
+*/
+type ReconcileFinding struct {
+	Kind          string    `json:"kind"`
+	InstanceID    string    `json:"instance_id"`
+	AWSInstanceID string    `json:"aws_instance_id"`
+	PlanID        string    `json:"plan_id,omitempty"`
+	State         string    `json:"state"`
+	LaunchTime    time.Time `json:"launch_time"`
+	Detail        string    `json:"detail"`
+	Action        string    `json:"action,omitempty"`
+}
+
+/*
+ReconcileReport holds the findings of a reconciliation run
+*/
+type ReconcileReport struct {
+	StartedAt  time.Time          `json:"started_at"`
+	FinishedAt time.Time          `json:"finished_at"`
+	Instances  int                `json:"instances"`
+	Findings   []ReconcileFinding `json:"findings"`
+	Error      string             `json:"error,omitempty"`
+}
+
+/*
+Reconciler periodically compares the EC2 instances carrying the broker's brokerInstance tag with the broker's records,
+finding instances the broker does not know of, more than one instance for a service instance, instances whose type,
+subnet or security groups no longer match their plan and parameters, and instances left running after a deprovision.
+Findings are logged, and the last report is served over HTTP. While the store is younger than the grace period, an
+instance the broker has no record of is recorded from its tags, so a lost store is rebuilt rather than mistaken for a set
+of orphans. Orphans are the instances of a provision that failed or never finished, or of a deprovision that failed, and
+may be terminated once past their grace period.
+*/
+type Reconciler struct {
+	Manager *AWSManager
+	Store   store.Store
+	mutex   sync.Mutex
+	last    *ReconcileReport
+	now     func() time.Time
+}
+
+/*
+NewReconciler creates a reconciler for the instances of the manager recorded in the given store
+*/
+func NewReconciler(m *AWSManager, s store.Store) *Reconciler {
+	return &Reconciler{Manager: m, Store: s, now: time.Now}
+}
+
+// How often reconciliation runs, or zero when it is turned off
+func reconcileInterval(conf *config.Config) time.Duration {
+	if conf.ReconcileIntervalSeconds < 0 {
+		return 0
+	}
+	if conf.ReconcileIntervalSeconds == 0 {
+		return config.DefaultReconcileIntervalSeconds * time.Second
+	}
+	return time.Duration(conf.ReconcileIntervalSeconds) * time.Second
+}
+
+// How long after launch an orphan is left alone
+func orphanGrace(conf *config.Config) time.Duration {
+	if conf.OrphanGraceSeconds <= 0 {
+		return config.DefaultOrphanGraceSeconds * time.Second
+	}
+	return time.Duration(conf.OrphanGraceSeconds) * time.Second
+}
+
+/*
+Run reconciles at the configured interval until stop is closed. It returns at once if reconciliation is turned off.
+*/
+func (r *Reconciler) Run(stop <-chan struct{}) {
+	for {
+		interval := reconcileInterval(config.GetConfiguration())
+		if interval == 0 {
+			return
+		}
+		r.Reconcile()
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+/*
+Reconcile compares the tagged instances with the broker's records once, logging and returning what it finds
+*/
+func (r *Reconciler) Reconcile() *ReconcileReport {
+	conf := config.GetConfiguration()
+	logger := config.GetLogger()
+	report := &ReconcileReport{StartedAt: r.now().UTC(), Findings: []ReconcileFinding{}}
+	instances, err := r.Manager.brokerInstances()
+	var records []*store.Instance
+	if err == nil {
+		records, err = r.Store.List()
+	}
+	if err != nil {
+		logger.Error("reconcile-failed", err)
+		report.Error = err.Error()
+	} else {
+		report.Instances = len(instances)
+		report.Findings = reconcileFindings(conf, instances, records, r.resolvePlan)
+	}
+	settled := r.storeSettled(conf, records)
+	for i := range report.Findings {
+		finding := &report.Findings[i]
+		// A store kept for longer than the grace period has recorded every provision that got as far as a launch, so an
+		// instance it has no record of is left from one that failed on the way
+		if finding.Kind == findingUnrecorded && settled {
+			finding.Kind, finding.Detail = findingOrphan, "the broker has no record of this service instance, so its provision never finished"
+		}
+		if finding.Kind == findingUnrecorded {
+			if instance := findInstance(instances, finding.AWSInstanceID); instance != nil {
+				updateStore(r.Store, finding.InstanceID, recordFromTags(conf, instance))
+				finding.Action = "recorded from the instance's tags"
+			}
+		}
+		if finding.Kind == findingOrphan && r.terminable(conf, instances, records, finding) {
+			_, err := r.Manager.terminateEC2Instance(finding.AWSInstanceID)
+			if err != nil {
+				logger.Error("reconcile-terminate-orphan", err, lager.Data{"instance_id": finding.InstanceID, "aws_instance_id": finding.AWSInstanceID})
+				finding.Action = fmt.Sprintf("termination failed: %s", err)
+			} else {
+				finding.Action = "terminated"
+			}
+		}
+		logger.Info("reconcile-finding", lager.Data{
+			"kind":            finding.Kind,
+			"instance_id":     finding.InstanceID,
+			"aws_instance_id": finding.AWSInstanceID,
+			"plan_id":         finding.PlanID,
+			"state":           finding.State,
+			"detail":          finding.Detail,
+			"action":          finding.Action,
+		})
+	}
+	report.FinishedAt = r.now().UTC()
+	logger.Info("reconciled", lager.Data{"instances": report.Instances, "findings": len(report.Findings)})
+	r.mutex.Lock()
+	r.last = report
+	r.mutex.Unlock()
+	return report
+}
+
+/*
+Report returns the last reconciliation report, or nil before the first run
+*/
+func (r *Reconciler) Report() *ReconcileReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.last
+}
+
+/*
+ServeHTTP serves the last reconciliation report as JSON
+*/
+func (r *Reconciler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.Report()
+	if report == nil {
+		report = &ReconcileReport{Findings: []ReconcileFinding{}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// The plan of an instance with any tag selectors resolved
+func (r *Reconciler) resolvePlan(planID string) (*config.PlanConfig, error) {
+	plan, err := findPlan(config.GetConfiguration(), planID)
+	if err != nil {
+		return nil, err
+	}
+	return r.Manager.ResolvePlan(plan)
+}
+
+// Only orphans launched with the broker's full set of launch tags are terminated, since instances launched before the
+// broker kept records have no record either, and only once they are past their grace period. Nothing is terminated while
+// the store is empty or younger than the grace period, since a store that was lost and started afresh knows nothing of
+// the instances launched before it.
+func (r *Reconciler) terminable(conf *config.Config, instances []*ec2.Instance, records []*store.Instance, finding *ReconcileFinding) bool {
+	if !conf.TerminateOrphans || r.now().Sub(finding.LaunchTime) < orphanGrace(conf) || !r.storeSettled(conf, records) {
+		return false
+	}
+	instance := findInstance(instances, finding.AWSInstanceID)
+	if instance == nil {
+		return false
+	}
+	_, ok := instanceTag(instance, tagPrefix(conf, instance)+"brokerCreated")
+	return ok
+}
+
+// Whether the store holds a record older than the grace period, and so has been kept at least as long as an orphan old
+// enough to terminate has been running
+func (r *Reconciler) storeSettled(conf *config.Config, records []*store.Instance) bool {
+	for _, record := range records {
+		if r.now().Sub(record.CreatedAt) >= orphanGrace(conf) {
+			return true
+		}
+	}
+	return false
+}
+
+// The instance with the given AWS instance ID
+func findInstance(instances []*ec2.Instance, awsInstanceID string) *ec2.Instance {
+	for _, instance := range instances {
+		if aws.StringValue(instance.InstanceId) == awsInstanceID {
+			return instance
+		}
+	}
+	return nil
+}
+
+// All instances carrying the brokerInstance tag of any of the services that have not been terminated
+func (m *AWSManager) brokerInstances() ([]*ec2.Instance, error) {
+	keys := []string{}
+	for _, prefix := range config.GetConfiguration().TagPrefixes() {
+		keys = append(keys, prefix+"brokerInstance")
+	}
+	instances := []*ec2.Instance{}
+	err := m.Client.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag-key"), Values: aws.StringSlice(keys)},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{
+				ec2.InstanceStateNamePending,
+				ec2.InstanceStateNameRunning,
+				ec2.InstanceStateNameStopping,
+				ec2.InstanceStateNameStopped,
+			})},
+		},
+	}, func(output *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range output.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+		return true
+	})
+	return instances, err
+}
+
+// Compares the tagged instances with the broker's records
+func reconcileFindings(conf *config.Config, instances []*ec2.Instance, records []*store.Instance, resolvePlan func(string) (*config.PlanConfig, error)) []ReconcileFinding {
+	findings := []ReconcileFinding{}
+	byID := map[string]*store.Instance{}
+	for _, record := range records {
+		byID[record.ID] = record
+	}
+	byServiceID := map[string][]*ec2.Instance{}
+	serviceIDs := []string{}
+	for _, instance := range instances {
+		serviceID, _ := brokerInstanceTag(conf, instance)
+		if _, ok := byServiceID[serviceID]; !ok {
+			serviceIDs = append(serviceIDs, serviceID)
+		}
+		byServiceID[serviceID] = append(byServiceID[serviceID], instance)
+	}
+	sort.Strings(serviceIDs)
+	for _, serviceID := range serviceIDs {
+		tagged := byServiceID[serviceID]
+		record, known := byID[serviceID]
+		if !known || record.AWSInstanceID == "" {
+			// A single instance is the service instance's own, and can be recorded from its tags; between several
+			// there is no telling which
+			if len(tagged) == 1 {
+				planID, _ := instanceTag(tagged[0], tagPrefix(conf, tagged[0])+"brokerPlan")
+				findings = append(findings, newFinding(findingUnrecorded, serviceID, tagged[0], planID, "the broker has no record of this service instance"))
+				continue
+			}
+			for _, instance := range tagged {
+				findings = append(findings, newFinding(findingOrphan, serviceID, instance, "", "the broker has no record of this service instance, and it has several instances"))
+			}
+			continue
+		}
+		for _, instance := range tagged {
+			finding := func(kind, detail string) {
+				findings = append(findings, newFinding(kind, serviceID, instance, record.PlanID, detail))
+			}
+			if aws.StringValue(instance.InstanceId) != record.AWSInstanceID {
+				finding(findingDuplicate, fmt.Sprintf("the service instance is recorded as %s", record.AWSInstanceID))
+				continue
+			}
+			if op := record.LastOperation(operationDeprovision); op != nil && op.State == string(brokerapi.Failed) {
+				finding(findingOrphan, fmt.Sprintf("the service instance's deprovision failed: %s", op.Description))
+				continue
+			}
+			if record.LastOperation(operationDeprovision) != nil {
+				finding(findingDeprovisionIncomplete, "the service instance was deprovisioned but the instance was not terminated")
+				continue
+			}
+			if op := record.LastOperation(operationProvision); op == nil {
+				finding(findingOrphan, "the service instance's provision never finished")
+				continue
+			} else if op.State == string(brokerapi.Failed) {
+				finding(findingOrphan, fmt.Sprintf("the service instance's provision failed: %s", op.Description))
+				continue
+			}
+			// Plan changes in flight change the instance type on the way
+			if op := record.LastOperation(operationUpdate); op != nil && op.State == string(brokerapi.InProgress) {
+				continue
+			}
+			for _, detail := range instanceDrift(record, instance, resolvePlan) {
+				finding(findingDrift, detail)
+			}
+		}
+	}
+	return findings
+}
+
+// The service instance ID an instance is tagged with, and the tag prefix of the service it was found under
+func brokerInstanceTag(conf *config.Config, instance *ec2.Instance) (string, string) {
+	for _, prefix := range conf.TagPrefixes() {
+		if serviceID, ok := instanceTag(instance, prefix+"brokerInstance"); ok {
+			return serviceID, prefix
+		}
+	}
+	return "", conf.TagPrefix
+}
+
+// The tag prefix of the service an instance was found under
+func tagPrefix(conf *config.Config, instance *ec2.Instance) string {
+	_, prefix := brokerInstanceTag(conf, instance)
+	return prefix
+}
+
+// Fills in what a record lacks from the tags the broker launched the instance with. A record with no provision is given
+// one that succeeded, so the instance is not taken for the orphan of a provision that never finished.
+func recordFromTags(conf *config.Config, instance *ec2.Instance) func(*store.Instance) {
+	prefix := tagPrefix(conf, instance)
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	tag := func(key string) string {
+		value, _ := instanceTag(instance, key)
+		return value
+	}
+	return func(record *store.Instance) {
+		fill(&record.AWSInstanceID, aws.StringValue(instance.InstanceId))
+		fill(&record.PlanID, tag(prefix+"brokerPlan"))
+		fill(&record.OrganizationGUID, tag(prefix+"brokerOrganization"))
+		fill(&record.SpaceGUID, tag(prefix+"brokerSpace"))
+		fill(&record.OrganizationName, tag(prefix+"brokerOrganizationName"))
+		fill(&record.SpaceName, tag(prefix+"brokerSpaceName"))
+		fill(&record.Name, tag("Name"))
+		if record.ServiceID == "" && record.PlanID != "" {
+			if service, _, err := conf.FindPlan(record.PlanID); err == nil {
+				record.ServiceID = service.ID
+			}
+		}
+		if instance.State != nil {
+			record.AWSState = aws.StringValue(instance.State.Name)
+		}
+		if record.LastOperation(operationProvision) == nil {
+			record.AddOperation(operationProvision, string(brokerapi.Succeeded), "recorded from the instance's tags")
+		}
+	}
+}
+
+// How an instance differs from its plan and the parameters it was provisioned or last updated with
+func instanceDrift(record *store.Instance, instance *ec2.Instance, resolvePlan func(string) (*config.PlanConfig, error)) []string {
+	drift := []string{}
+	subnetID := aws.StringValue(instance.SubnetId)
+	groups := []string{}
+	for _, group := range instance.SecurityGroups {
+		groups = append(groups, aws.StringValue(group.GroupId))
+	}
+	plan, err := resolvePlan(record.PlanID)
+	if err != nil {
+		drift = append(drift, fmt.Sprintf("plan %s cannot be checked: %s", record.PlanID, err))
+	} else {
+		if instanceType := aws.StringValue(instance.InstanceType); instanceType != plan.InstanceType {
+			drift = append(drift, fmt.Sprintf("instance type %s does not match plan instance type %s", instanceType, plan.InstanceType))
+		}
+		if !stringIn(subnetID, plan.AllowedSubnets) {
+			drift = append(drift, fmt.Sprintf("subnet %s is not allowed by the plan", subnetID))
+		}
+		for _, group := range groups {
+			if !stringIn(group, plan.AllowedSecurityGroups) {
+				drift = append(drift, fmt.Sprintf("security group %s is not allowed by the plan", group))
+			}
+		}
+	}
+	var parameters ProvisionParameters
+	if len(record.Parameters) == 0 || json.Unmarshal(record.Parameters, &parameters) != nil {
+		return drift
+	}
+	if parameters.SubnetID != "" && parameters.SubnetID != subnetID {
+		drift = append(drift, fmt.Sprintf("subnet %s does not match the requested subnet %s", subnetID, parameters.SubnetID))
+	}
+	if requested := parameters.securityGroups(); len(requested) > 0 && !sameStrings(requested, groups) {
+		drift = append(drift, fmt.Sprintf("security groups %s do not match the requested %s", strings.Join(groups, ", "), strings.Join(requested, ", ")))
+	}
+	return drift
+}
+
+// A finding about one of a service instance's EC2 instances
+func newFinding(kind, serviceID string, instance *ec2.Instance, planID, detail string) ReconcileFinding {
+	finding := ReconcileFinding{
+		Kind:          kind,
+		InstanceID:    serviceID,
+		AWSInstanceID: aws.StringValue(instance.InstanceId),
+		PlanID:        planID,
+		Detail:        detail,
+		LaunchTime:    aws.TimeValue(instance.LaunchTime),
+	}
+	if instance.State != nil {
+		finding.State = aws.StringValue(instance.State.Name)
+	}
+	return finding
+}
@@ -0,0 +1,297 @@
+package broker
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/GSA/ec2-broker/config"
+	"github.com/GSA/ec2-broker/store"
+)
+
+var _ = Describe("Reconciliation", func() {
+	var (
+		conf    *config.Config
+		plan    *config.PlanConfig
+		records []*store.Instance
+		resolve func(string) (*config.PlanConfig, error)
+	)
+
+	tagged := func(serviceID, awsID, instanceType string, tags ...string) *ec2.Instance {
+		instance := &ec2.Instance{
+			InstanceId:     aws.String(awsID),
+			InstanceType:   aws.String(instanceType),
+			SubnetId:       aws.String("subnet-1"),
+			SecurityGroups: []*ec2.GroupIdentifier{{GroupId: aws.String("sg-1")}},
+			State:          &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+			LaunchTime:     aws.Time(time.Now().Add(-2 * time.Hour)),
+			Tags:           []*ec2.Tag{{Key: aws.String("cg:brokerInstance"), Value: aws.String(serviceID)}},
+		}
+		for _, key := range tags {
+			instance.Tags = append(instance.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String("x")})
+		}
+		return instance
+	}
+
+	BeforeEach(func() {
+		conf = &config.Config{TagPrefix: "cg:"}
+		plan = &config.PlanConfig{ID: "plan-1", InstanceType: "t2.micro", AllowedSubnets: []string{"subnet-1"}, AllowedSecurityGroups: []string{"sg-1"}}
+		records = []*store.Instance{{
+			ID:            "instance-1",
+			AWSInstanceID: "i-1",
+			PlanID:        "plan-1",
+			Parameters:    []byte(`{"subnet_id": "subnet-1", "security_group_id": "sg-1"}`),
+		}}
+		records[0].AddOperation(operationProvision, string(brokerapi.Succeeded), "running")
+		resolve = func(planID string) (*config.PlanConfig, error) {
+			if planID != plan.ID {
+				return nil, errors.New("no such plan")
+			}
+			return plan, nil
+		}
+	})
+
+	It("finds nothing when the instances match their records", func() {
+		findings := reconcileFindings(conf, []*ec2.Instance{tagged("instance-1", "i-1", "t2.micro")}, records, resolve)
+		Expect(findings).To(BeEmpty())
+	})
+
+	It("finds instances the broker has no record of", func() {
+		findings := reconcileFindings(conf, []*ec2.Instance{tagged("instance-2", "i-2", "t2.micro")}, records, resolve)
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0].Kind).To(Equal(findingUnrecorded))
+		Expect(findings[0].InstanceID).To(Equal("instance-2"))
+	})
+
+	It("finds orphans among several instances the broker has no record of", func() {
+		findings := reconcileFindings(conf, []*ec2.Instance{tagged("instance-2", "i-2", "t2.micro"), tagged("instance-2", "i-3", "t2.micro")}, records, resolve)
+		Expect(findings).To(HaveLen(2))
+		for _, finding := range findings {
+			Expect(finding.Kind).To(Equal(findingOrphan))
+		}
+	})
+
+	It("records unrecorded instances from their tags", func() {
+		conf.Plans = []config.PlanConfig{*plan}
+		conf.ServiceID = "ec2-service"
+		instance := tagged("instance-2", "i-2", "t2.micro")
+		instance.Tags = append(instance.Tags,
+			&ec2.Tag{Key: aws.String("cg:brokerPlan"), Value: aws.String("plan-1")},
+			&ec2.Tag{Key: aws.String("cg:brokerOrganization"), Value: aws.String("org-1")},
+			&ec2.Tag{Key: aws.String("Name"), Value: aws.String("my-instance")},
+		)
+		record := &store.Instance{ID: "instance-2", SpaceGUID: "space-1"}
+		recordFromTags(conf, instance)(record)
+		Expect(record.AWSInstanceID).To(Equal("i-2"))
+		Expect(record.PlanID).To(Equal("plan-1"))
+		Expect(record.ServiceID).To(Equal("ec2-service"))
+		Expect(record.OrganizationGUID).To(Equal("org-1"))
+		Expect(record.SpaceGUID).To(Equal("space-1"))
+		Expect(record.Name).To(Equal("my-instance"))
+		Expect(record.AWSState).To(Equal(ec2.InstanceStateNameRunning))
+		Expect(record.LastOperation(operationProvision).State).To(Equal(string(brokerapi.Succeeded)))
+	})
+
+	It("finds instances under the tag prefix of each service", func() {
+		conf.Services = []config.ServiceConfig{{ID: "compute"}, {ID: "batch", TagPrefix: "batch:"}}
+		instance := tagged("instance-2", "i-2", "t2.micro")
+		instance.Tags[0].Key = aws.String("batch:brokerInstance")
+		findings := reconcileFindings(conf, []*ec2.Instance{tagged("instance-1", "i-1", "t2.micro"), instance}, records, resolve)
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0].Kind).To(Equal(findingUnrecorded))
+		Expect(findings[0].InstanceID).To(Equal("instance-2"))
+	})
+
+	It("finds more than one instance for a service instance", func() {
+		findings := reconcileFindings(conf, []*ec2.Instance{tagged("instance-1", "i-1", "t2.micro"), tagged("instance-1", "i-3", "t2.micro")}, records, resolve)
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0].Kind).To(Equal(findingDuplicate))
+		Expect(findings[0].AWSInstanceID).To(Equal("i-3"))
+	})
+
+	It("finds instances that drifted from their plan and parameters", func() {
+		instance := tagged("instance-1", "i-1", "t2.large")
+		instance.SecurityGroups = append(instance.SecurityGroups, &ec2.GroupIdentifier{GroupId: aws.String("sg-9")})
+		findings := reconcileFindings(conf, []*ec2.Instance{instance}, records, resolve)
+		Expect(findings).To(HaveLen(3))
+		for _, finding := range findings {
+			Expect(finding.Kind).To(Equal(findingDrift))
+		}
+	})
+
+	It("leaves plan changes in flight alone", func() {
+		records[0].AddOperation(operationUpdate, "in progress", "")
+		findings := reconcileFindings(conf, []*ec2.Instance{tagged("instance-1", "i-1", "t2.large")}, records, resolve)
+		Expect(findings).To(BeEmpty())
+	})
+
+	It("finds instances left after a deprovision", func() {
+		records[0].AddOperation(operationDeprovision, string(brokerapi.InProgress), "shutting-down")
+		findings := reconcileFindings(conf, []*ec2.Instance{tagged("instance-1", "i-1", "t2.micro")}, records, resolve)
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0].Kind).To(Equal(findingDeprovisionIncomplete))
+	})
+
+	It("finds the orphans of failed deprovisions", func() {
+		records[0].AddOperation(operationDeprovision, string(brokerapi.Failed), "AWS failure")
+		findings := reconcileFindings(conf, []*ec2.Instance{tagged("instance-1", "i-1", "t2.micro")}, records, resolve)
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0].Kind).To(Equal(findingOrphan))
+		Expect(findings[0].Detail).To(ContainSubstring("AWS failure"))
+	})
+
+	It("finds the orphans of provisions that failed or never finished", func() {
+		records[0].Operations = nil
+		findings := reconcileFindings(conf, []*ec2.Instance{tagged("instance-1", "i-1", "t2.micro")}, records, resolve)
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0].Kind).To(Equal(findingOrphan))
+
+		records[0].AddOperation(operationProvision, string(brokerapi.Failed), "instance stopped while starting")
+		findings = reconcileFindings(conf, []*ec2.Instance{tagged("instance-1", "i-1", "t2.micro")}, records, resolve)
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0].Kind).To(Equal(findingOrphan))
+		Expect(findings[0].Detail).To(ContainSubstring("instance stopped while starting"))
+	})
+
+	Describe("terminating orphans", func() {
+		var (
+			r         *Reconciler
+			instances []*ec2.Instance
+		)
+
+		BeforeEach(func() {
+			r = &Reconciler{now: time.Now}
+			conf.TerminateOrphans = true
+			records[0].CreatedAt = time.Now().Add(-3 * time.Hour)
+			instances = []*ec2.Instance{tagged("instance-2", "i-2", "t2.micro", "cg:brokerCreated"), tagged("instance-2", "i-3", "t2.micro", "cg:brokerCreated")}
+		})
+
+		It("terminates orphans launched by the broker once past their grace period", func() {
+			finding := reconcileFindings(conf, instances, records, resolve)[0]
+			Expect(r.terminable(conf, instances, records, &finding)).To(BeTrue())
+
+			conf.OrphanGraceSeconds = 4 * 3600
+			Expect(r.terminable(conf, instances, records, &finding)).To(BeFalse())
+		})
+
+		It("leaves instances launched before the broker kept records", func() {
+			instances = []*ec2.Instance{tagged("instance-2", "i-2", "t2.micro"), tagged("instance-2", "i-3", "t2.micro")}
+			finding := reconcileFindings(conf, instances, records, resolve)[0]
+			Expect(r.terminable(conf, instances, records, &finding)).To(BeFalse())
+		})
+
+		It("only terminates when configured to", func() {
+			conf.TerminateOrphans = false
+			finding := reconcileFindings(conf, instances, records, resolve)[0]
+			Expect(r.terminable(conf, instances, records, &finding)).To(BeFalse())
+		})
+
+		It("terminates nothing when the store is empty", func() {
+			instances = append(instances, tagged("instance-1", "i-1", "t2.micro", "cg:brokerCreated"))
+			findings := reconcileFindings(conf, instances, nil, resolve)
+			Expect(findings).To(HaveLen(3))
+			for _, finding := range findings {
+				Expect(r.terminable(conf, instances, nil, &finding)).To(BeFalse())
+			}
+			Expect(findings[0].Kind).To(Equal(findingUnrecorded))
+			Expect(findings[0].InstanceID).To(Equal("instance-1"))
+		})
+
+		Describe("by reconciling", func() {
+			var (
+				s      *store.FileStore
+				called []string
+			)
+
+			// An instance launched by the broker two hours ago, as DescribeInstances describes it
+			describe := func(serviceID, awsID string) string {
+				return `<item><instanceId>` + awsID + `</instanceId><instanceType>t2.micro</instanceType><subnetId>subnet-1</subnetId>` +
+					`<groupSet><item><groupId>sg-1</groupId></item></groupSet><instanceState><code>16</code><name>running</name></instanceState>` +
+					`<launchTime>` + time.Now().Add(-2*time.Hour).UTC().Format(time.RFC3339) + `</launchTime><tagSet>` +
+					`<item><key>cg:brokerInstance</key><value>` + serviceID + `</value></item><item><key>cg:brokerCreated</key><value>x</value></item>` +
+					`<item><key>cg:brokerPlan</key><value>plan-1</value></item></tagSet></item>`
+			}
+			reconcile := func(described ...string) *ReconcileReport {
+				conf.ServiceID = "ec2-service"
+				conf.Plans = []config.PlanConfig{*plan}
+				config.SetConfiguration(conf)
+				called = nil
+				client := stubEC2Client(map[string]string{
+					"DescribeInstances":  `<DescribeInstancesResponse><reservationSet><item><instancesSet>` + strings.Join(described, "") + `</instancesSet></item></reservationSet></DescribeInstancesResponse>`,
+					"TerminateInstances": `<TerminateInstancesResponse><instancesSet><item><currentState><code>32</code><name>shutting-down</name></currentState></item></instancesSet></TerminateInstancesResponse>`,
+				}, &called)
+				r = NewReconciler(&AWSManager{Client: client, Store: s, Discovery: NewDiscoveryCache()}, s)
+				return r.Reconcile()
+			}
+
+			BeforeEach(func() {
+				s = store.NewMemoryStore()
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.AWSInstanceID, record.PlanID, record.Parameters = "i-1", "plan-1", records[0].Parameters
+					record.CreatedAt = time.Now().Add(-3 * time.Hour)
+					record.AddOperation(operationProvision, string(brokerapi.Succeeded), "running")
+					return nil
+				})
+			})
+
+			It("terminates the instance of a failed deprovision", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.AddOperation(operationDeprovision, string(brokerapi.Failed), "AWS failure")
+					return nil
+				})
+				report := reconcile(describe("instance-1", "i-1"))
+				Expect(report.Findings).To(HaveLen(1))
+				Expect(report.Findings[0].Kind).To(Equal(findingOrphan))
+				Expect(report.Findings[0].Action).To(Equal("terminated"))
+				Expect(called).To(ContainElement("TerminateInstances"))
+			})
+
+			It("terminates the instance of a provision that failed", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.LastOperation(operationProvision).SetState(string(brokerapi.Failed), "instance stopped while starting")
+					return nil
+				})
+				report := reconcile(describe("instance-1", "i-1"))
+				Expect(report.Findings).To(HaveLen(1))
+				Expect(report.Findings[0].Kind).To(Equal(findingOrphan))
+				Expect(report.Findings[0].Action).To(Equal("terminated"))
+			})
+
+			It("terminates an unrecorded instance once the store has settled", func() {
+				report := reconcile(describe("instance-1", "i-1"), describe("instance-2", "i-2"))
+				Expect(report.Findings).To(HaveLen(1))
+				Expect(report.Findings[0].Kind).To(Equal(findingOrphan))
+				Expect(report.Findings[0].InstanceID).To(Equal("instance-2"))
+				Expect(report.Findings[0].Action).To(Equal("terminated"))
+				_, err := s.Get("instance-2")
+				Expect(err).To(Equal(store.ErrNotFound))
+			})
+
+			It("records an unrecorded instance while the store is new", func() {
+				s.Update("instance-1", func(record *store.Instance) error {
+					record.CreatedAt = time.Now()
+					return nil
+				})
+				report := reconcile(describe("instance-1", "i-1"), describe("instance-2", "i-2"))
+				Expect(report.Findings).To(HaveLen(1))
+				Expect(report.Findings[0].Kind).To(Equal(findingUnrecorded))
+				Expect(called).ToNot(ContainElement("TerminateInstances"))
+				record, err := s.Get("instance-2")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(record.AWSInstanceID).To(Equal("i-2"))
+			})
+		})
+
+		It("terminates nothing while the store is younger than the grace period", func() {
+			records[0].CreatedAt = time.Now().Add(-time.Minute)
+			finding := reconcileFindings(conf, instances, records, resolve)[0]
+			Expect(r.terminable(conf, instances, records, &finding)).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,58 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/GSA/ec2-broker/config"
+	"github.com/GSA/ec2-broker/store"
+)
+
+/*
+PlansInUse returns a check for config.Reloader, and for the configuration the broker starts with, that rejects a
+configuration dropping a plan the store's instances still use, including plans an update in progress is moving an
+instance to, since binding, updating and deprovisioning them needs the plan. Instances that have been deprovisioned or
+terminated use no plan.
+*/
+func PlansInUse(s store.Store) func(*config.Config) error {
+	return func(conf *config.Config) error {
+		records, err := s.List()
+		if err != nil {
+			return err
+		}
+		return missingPlans(conf, records)
+	}
+}
+
+// Reports the plans the records use that the configuration lacks
+func missingPlans(conf *config.Config, records []*store.Instance) error {
+	errs := config.ValidationErrors{}
+	missing := func(planID, instanceID string) {
+		if planID == "" {
+			return
+		}
+		if _, err := findPlan(conf, planID); err != nil {
+			errs = append(errs, config.ValidationError{
+				Path:    "$.plans",
+				Message: fmt.Sprintf("plan %s is still used by instance %s", planID, instanceID),
+			})
+		}
+	}
+	for _, record := range records {
+		if op := record.LastOperation(operationDeprovision); (op != nil && op.State == string(brokerapi.Succeeded)) || record.AWSState == ec2.InstanceStateNameTerminated {
+			continue
+		}
+		missing(record.PlanID, record.ID)
+		for _, op := range record.Operations {
+			if op.State == string(brokerapi.InProgress) {
+				missing(op.PlanID, record.ID)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
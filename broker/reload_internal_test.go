@@ -0,0 +1,53 @@
+package broker
+
+import (
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/GSA/ec2-broker/config"
+	"github.com/GSA/ec2-broker/store"
+)
+
+var _ = Describe("Reload checks", func() {
+	conf := &config.Config{Plans: []config.PlanConfig{{ID: "plan-1"}, {ID: "plan-2"}}}
+
+	It("accepts a configuration keeping every plan in use", func() {
+		records := []*store.Instance{{ID: "instance-1", PlanID: "plan-1"}, {ID: "instance-2"}}
+		Expect(missingPlans(conf, records)).To(Succeed())
+	})
+
+	It("rejects a configuration dropping a plan an instance uses", func() {
+		records := []*store.Instance{{ID: "instance-1", PlanID: "plan-3"}}
+		Expect(missingPlans(conf, records)).To(MatchError(ContainSubstring("plan plan-3 is still used by instance instance-1")))
+	})
+
+	It("accepts a configuration dropping the plan of a deprovisioned instance", func() {
+		records := []*store.Instance{
+			{ID: "instance-1", PlanID: "plan-3", Operations: []store.Operation{
+				{Type: operationProvision, State: string(brokerapi.Succeeded)},
+				{Type: operationDeprovision, State: string(brokerapi.Succeeded)},
+			}},
+			{ID: "instance-2", PlanID: "plan-4", AWSState: ec2.InstanceStateNameTerminated},
+		}
+		Expect(missingPlans(conf, records)).To(Succeed())
+	})
+
+	It("rejects a configuration dropping the plan of an instance whose deprovision failed", func() {
+		records := []*store.Instance{{ID: "instance-1", PlanID: "plan-3", AWSState: ec2.InstanceStateNameRunning, Operations: []store.Operation{
+			{Type: operationDeprovision, State: string(brokerapi.Failed)},
+		}}}
+		Expect(missingPlans(conf, records)).To(MatchError(ContainSubstring("plan plan-3 is still used by instance instance-1")))
+	})
+
+	It("rejects a configuration dropping the plan an update in progress moves to", func() {
+		records := []*store.Instance{{ID: "instance-1", PlanID: "plan-1", Operations: []store.Operation{
+			{Type: operationUpdate, State: string(brokerapi.Succeeded), PlanID: "plan-4"},
+			{Type: operationUpdate, State: string(brokerapi.InProgress), PlanID: "plan-3"},
+		}}}
+		err := missingPlans(conf, records)
+		Expect(err).To(MatchError(ContainSubstring("plan plan-3")))
+		Expect(err).ToNot(MatchError(ContainSubstring("plan plan-4")))
+	})
+})
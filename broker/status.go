@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+/*
+InstanceStatus is the state of an EC2 instance along with AWS's explanation of how it got there. ReasonCode and
+ReasonMessage come from the instance's StateReason, and TransitionReason from its StateTransitionReason.
+*/
+type InstanceStatus struct {
+	State            string
+	ReasonCode       string
+	ReasonMessage    string
+	TransitionReason string
+}
+
+// A human readable explanation of an AWS state reason or launch error, and the error code the broker reports it as
+type statusReason struct {
+	code        string
+	description string
+}
+
+// The state reasons AWS gives for instance state changes, and the errors RunInstances fails with, that users can act on
+var statusReasons = map[string]statusReason{
+	"Server.InsufficientInstanceCapacity": {"insufficient-capacity", "AWS does not have enough capacity for this instance type in the availability zone"},
+	"InsufficientInstanceCapacity":        {"insufficient-capacity", "AWS does not have enough capacity for this instance type in the availability zone"},
+	"Server.InternalError":                {"aws-internal-error", "an internal AWS error stopped the instance from launching"},
+	"Server.ScheduledStop":                {"scheduled-stop", "AWS stopped the instance for scheduled maintenance"},
+	"Server.SpotInstanceShutdown":         {"spot-interrupted", "AWS stopped the spot instance"},
+	"Server.SpotInstanceTermination":      {"spot-interrupted", "AWS terminated the spot instance"},
+	"Client.InstanceInitiatedShutdown":    {"instance-initiated-shutdown", "the instance shut itself down"},
+	"Client.InstanceTerminated":           {"instance-terminated", "the instance was terminated or restarted during launch"},
+	"Client.InternalError":                {"launch-error", "a problem with the launch configuration stopped the instance from launching"},
+	"Client.InvalidSnapshot.NotFound":     {"invalid-snapshot", "a snapshot used by the image could not be found"},
+	"Client.UserInitiatedShutdown":        {"user-initiated-shutdown", "the instance was shut down through the AWS API"},
+	"Client.VolumeLimitExceeded":          {"volume-limit-exceeded", "the account's EBS volume limit has been reached"},
+	"VolumeLimitExceeded":                 {"volume-limit-exceeded", "the account's EBS volume limit has been reached"},
+	"InstanceLimitExceeded":               {"instance-limit-exceeded", "the account's instance limit for this instance type has been reached"},
+	"InvalidAMIID.NotFound":               {"invalid-ami", "the image does not exist or is not available to this account"},
+	"InvalidAMIID.Malformed":              {"invalid-ami", "the image ID is not valid"},
+	"InvalidAMIID.Unavailable":            {"invalid-ami", "the image is not available"},
+}
+
+/*
+ErrorCode is a machine readable code for the reason the instance is in its current state, or an empty string if AWS has
+given no reason
+*/
+func (s *InstanceStatus) ErrorCode() string {
+	if s.ReasonCode == "" {
+		return ""
+	}
+	if reason, ok := statusReasons[s.ReasonCode]; ok {
+		return reason.code
+	}
+	return s.ReasonCode
+}
+
+/*
+Description is a human readable description of the status, as in "terminated: the account's EBS volume limit has been
+reached [volume-limit-exceeded]", falling back on the messages from AWS for reasons the broker doesn't know
+*/
+func (s *InstanceStatus) Description() string {
+	var reason string
+	if known, ok := statusReasons[s.ReasonCode]; ok {
+		reason = known.description
+	} else if s.ReasonMessage != "" {
+		reason = s.ReasonMessage
+	} else {
+		reason = s.TransitionReason
+	}
+	if reason == "" {
+		return s.State
+	}
+	if code := s.ErrorCode(); code != "" {
+		return fmt.Sprintf("%s: %s [%s]", s.State, reason, code)
+	}
+	return fmt.Sprintf("%s: %s", s.State, reason)
+}
+
+// Turns a failure to launch an instance into an error explaining the failure, if it is one users can act on
+func describeLaunchError(err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	reason, ok := statusReasons[aerr.Code()]
+	if !ok {
+		return err
+	}
+	return fmt.Errorf("Unable to launch instance: %s [%s]", reason.description, reason.code)
+}
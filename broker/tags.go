@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+// The resources RunInstances tags through its tag specifications
+var launchTaggedResources = []string{"instance", "volume", "network-interface"}
+
+// AWS limits on tags, and how the 50 tags AWS allows on a resource are shared out: up to 11 are the broker's launch
+// tags, room for 10 brokerBind tags is kept for bindings, and custom tags get the rest. Bindings may use room custom
+// tags leave over, and Bind refuses one once the instance has no room left at all.
+const (
+	maxTagKeyLength    = 128
+	maxTagValueLength  = 256
+	maxResourceTags    = 50
+	maxLaunchTags      = 11
+	reservedBindings   = 10
+	defaultMaxUserTags = maxResourceTags - maxLaunchTags - reservedBindings
+)
+
+// The tags every resource launched for a service instance carries, so it can be found and attributed and a retried
+// request told from a conflicting one, along with the user's custom tags
+func launchTags(conf *config.Config, instanceID string, context ProvisionContext, parameters ProvisionParameters) map[string]string {
+	tags := map[string]string{}
+	for key, value := range parameters.Tags {
+		tags[key] = value
+	}
+	tags[conf.TagPrefix+"brokerInstance"] = instanceID
+	tags[conf.TagPrefix+"brokerPlan"] = context.PlanID
+	tags[conf.TagPrefix+"brokerCreated"] = time.Now().UTC().Format(time.RFC3339)
+	tags[conf.TagPrefix+"brokerRequest"] = provisionDigest(context, parameters)
+	// Name is the tag the AWS console shows, so it carries the Cloud Foundry instance name unless the user named it
+	if _, ok := tags["Name"]; !ok && context.InstanceName != "" {
+		tags["Name"] = context.InstanceName
+	}
+	if context.OrganizationGUID != "" {
+		tags[conf.TagPrefix+"brokerOrganization"] = context.OrganizationGUID
+	}
+	if context.SpaceGUID != "" {
+		tags[conf.TagPrefix+"brokerSpace"] = context.SpaceGUID
+	}
+	if context.OrganizationName != "" {
+		tags[conf.TagPrefix+"brokerOrganizationName"] = context.OrganizationName
+	}
+	if context.SpaceName != "" {
+		tags[conf.TagPrefix+"brokerSpaceName"] = context.SpaceName
+	}
+	if parameters.Image != "" {
+		tags[conf.TagPrefix+"brokerImage"] = parameters.Image
+		tags[conf.TagPrefix+"brokerAMI"] = parameters.AMIID
+	}
+	return tags
+}
+
+// Keys under the broker's tag prefix, or under aws: which AWS keeps for itself, belong to the broker and AWS
+func reservedTag(conf *config.Config, key string) bool {
+	if strings.HasPrefix(strings.ToLower(key), "aws:") {
+		return true
+	}
+	if conf.TagPrefix == "" {
+		return strings.HasPrefix(key, "broker")
+	}
+	return strings.HasPrefix(key, conf.TagPrefix)
+}
+
+// Checks a user's custom tags against the configured tag policy and the limits AWS puts on tags
+func validateTags(conf *config.Config, tags map[string]string) error {
+	policy := conf.TagPolicy
+	maxTags := policy.MaxTags
+	if maxTags <= 0 || maxTags > defaultMaxUserTags {
+		maxTags = defaultMaxUserTags
+	}
+	if len(tags) > maxTags {
+		return fmt.Errorf("Too many tags: %d given, at most %d allowed", len(tags), maxTags)
+	}
+	var keyPattern *regexp.Regexp
+	if policy.KeyPattern != "" {
+		var err error
+		keyPattern, err = regexp.Compile(policy.KeyPattern)
+		if err != nil {
+			return fmt.Errorf("Invalid tag key pattern %q in the configuration: %s", policy.KeyPattern, err)
+		}
+	}
+	for key, value := range tags {
+		if key == "" || len(key) > maxTagKeyLength {
+			return fmt.Errorf("Tag keys must have 1 to %d characters: %q", maxTagKeyLength, key)
+		}
+		if len(value) > maxTagValueLength {
+			return fmt.Errorf("The value of tag %s is longer than %d characters", key, maxTagValueLength)
+		}
+		if reservedTag(conf, key) {
+			return fmt.Errorf("Tag %s is reserved", key)
+		}
+		if keyPattern != nil && !keyPattern.MatchString(key) {
+			return fmt.Errorf("Tag %s does not match the allowed pattern %s", key, policy.KeyPattern)
+		}
+	}
+	for _, key := range policy.RequiredKeys {
+		if tags[key] == "" {
+			return fmt.Errorf("Missing required tag: %s", key)
+		}
+	}
+	return nil
+}
+
+// The keys of the old tags that the new tags no longer have
+func removedTags(old, new map[string]string) []string {
+	removed := []string{}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// Encodes RunInstances tag specifications, which the vendored SDK predates, as EC2 query parameters applying the tags
+// to each of the resource types
+func tagSpecificationParameters(resourceTypes []string, tags map[string]string) url.Values {
+	params := url.Values{}
+	if len(tags) == 0 {
+		return params
+	}
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, resourceType := range resourceTypes {
+		prefix := fmt.Sprintf("TagSpecification.%d.", i+1)
+		params.Set(prefix+"ResourceType", resourceType)
+		for j, key := range keys {
+			params.Set(fmt.Sprintf("%sTag.%d.Key", prefix, j+1), key)
+			params.Set(fmt.Sprintf("%sTag.%d.Value", prefix, j+1), tags[key])
+		}
+	}
+	return params
+}
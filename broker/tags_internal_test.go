@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+var _ = Describe("Tags", func() {
+	var conf *config.Config
+
+	BeforeEach(func() {
+		conf = &config.Config{TagPrefix: "cg:"}
+	})
+
+	It("attributes launched resources to the service instance, plan, organization and space", func() {
+		tags := launchTags(conf, "instance-1", ProvisionContext{PlanID: "plan-id", OrganizationGUID: "org-guid", SpaceGUID: "space-guid"}, ProvisionParameters{})
+		Expect(tags).To(HaveKeyWithValue("cg:brokerInstance", "instance-1"))
+		Expect(tags).To(HaveKeyWithValue("cg:brokerPlan", "plan-id"))
+		Expect(tags).To(HaveKeyWithValue("cg:brokerOrganization", "org-guid"))
+		Expect(tags).To(HaveKeyWithValue("cg:brokerSpace", "space-guid"))
+		created, err := time.Parse(time.RFC3339, tags["cg:brokerCreated"])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(created).To(BeTemporally("~", time.Now(), time.Minute))
+	})
+
+	It("tags the digest of the request the resources were launched for", func() {
+		context := ProvisionContext{PlanID: "plan-id"}
+		parameters := ProvisionParameters{AMIID: "ami-1"}
+		Expect(launchTags(conf, "instance-1", context, parameters)).To(HaveKeyWithValue("cg:brokerRequest", provisionDigest(context, parameters)))
+	})
+
+	It("names resources after the Cloud Foundry service instance", func() {
+		tags := launchTags(conf, "instance-1", ProvisionContext{PlanID: "plan-id", InstanceName: "my-ec2", OrganizationName: "finance", SpaceName: "prod"}, ProvisionParameters{})
+		Expect(tags).To(HaveKeyWithValue("Name", "my-ec2"))
+		Expect(tags).To(HaveKeyWithValue("cg:brokerOrganizationName", "finance"))
+		Expect(tags).To(HaveKeyWithValue("cg:brokerSpaceName", "prod"))
+	})
+
+	It("records the AMI an image resolved to", func() {
+		tags := launchTags(conf, "instance-1", ProvisionContext{PlanID: "plan-id"}, ProvisionParameters{Image: "ubuntu-hardened", AMIID: "ami-1"})
+		Expect(tags).To(HaveKeyWithValue("cg:brokerImage", "ubuntu-hardened"))
+		Expect(tags).To(HaveKeyWithValue("cg:brokerAMI", "ami-1"))
+	})
+
+	It("launches resources with the custom tags", func() {
+		tags := launchTags(conf, "instance-1", ProvisionContext{PlanID: "plan-id", InstanceName: "my-ec2"}, ProvisionParameters{Tags: map[string]string{"Project": "apollo", "Name": "web"}})
+		Expect(tags).To(HaveKeyWithValue("Project", "apollo"))
+		Expect(tags).To(HaveKeyWithValue("Name", "web"))
+		Expect(tags).To(HaveKeyWithValue("cg:brokerInstance", "instance-1"))
+	})
+
+	Describe("custom tag policy", func() {
+		It("reserves the broker's and AWS's tags", func() {
+			Expect(validateTags(conf, map[string]string{"Project": "apollo"})).To(Succeed())
+			Expect(validateTags(conf, map[string]string{"cg:brokerInstance": "other"})).ToNot(Succeed())
+			Expect(validateTags(conf, map[string]string{"aws:cloudformation:stack-id": "x"})).ToNot(Succeed())
+		})
+
+		It("limits the number of tags", func() {
+			conf.TagPolicy.MaxTags = 1
+			Expect(validateTags(conf, map[string]string{"Project": "apollo", "Team": "ops"})).ToNot(Succeed())
+		})
+
+		It("requires keys to match the pattern", func() {
+			conf.TagPolicy.KeyPattern = "^[A-Z][A-Za-z]*$"
+			Expect(validateTags(conf, map[string]string{"Project": "apollo"})).To(Succeed())
+			Expect(validateTags(conf, map[string]string{"project-name": "apollo"})).ToNot(Succeed())
+		})
+
+		It("requires the mandatory keys", func() {
+			conf.TagPolicy.RequiredKeys = []string{"Project"}
+			Expect(validateTags(conf, map[string]string{"Team": "ops"})).ToNot(Succeed())
+			Expect(validateTags(conf, map[string]string{"Project": ""})).ToNot(Succeed())
+			Expect(validateTags(conf, map[string]string{"Project": "apollo"})).To(Succeed())
+		})
+	})
+
+	It("finds the removed tags", func() {
+		Expect(removedTags(map[string]string{"a": "1", "b": "2", "c": "3"}, map[string]string{"b": "4"})).To(Equal([]string{"a", "c"}))
+	})
+
+	It("encodes tag specifications for each resource type", func() {
+		params := tagSpecificationParameters([]string{"instance", "volume"}, map[string]string{"b": "2", "a": "1"})
+		Expect(params.Get("TagSpecification.1.ResourceType")).To(Equal("instance"))
+		Expect(params.Get("TagSpecification.1.Tag.1.Key")).To(Equal("a"))
+		Expect(params.Get("TagSpecification.1.Tag.1.Value")).To(Equal("1"))
+		Expect(params.Get("TagSpecification.1.Tag.2.Key")).To(Equal("b"))
+		Expect(params.Get("TagSpecification.2.ResourceType")).To(Equal("volume"))
+		Expect(params.Get("TagSpecification.2.Tag.2.Value")).To(Equal("2"))
+	})
+})
@@ -0,0 +1,359 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pivotal-cf/brokerapi"
+
+	"github.com/GSA/ec2-broker/config"
+	"github.com/GSA/ec2-broker/store"
+)
+
+// The steps of a plan change, which stops a running instance, changes its instance type and starts it again. An instance
+// that is stopped once started has failed to start.
+const (
+	updateStepStopping = "stopping"
+	updateStepStarting = "starting"
+)
+
+// Checks that a plan allows the AMI (or image family), subnet, security groups, public or Elastic IP, instance profile,
+// user data and data volumes an instance was launched with, since a plan change keeps all of them
+func checkPlanCompatible(plan *config.PlanConfig, instance *InstanceDescription, parameters ProvisionParameters) error {
+	if parameters.Image != "" && findImageFamily(plan, parameters.Image) == nil {
+		return fmt.Errorf("Plan %s does not have the instance's image family: %s", plan.ID, parameters.Image)
+	}
+	if parameters.Image == "" && !stringIn(instance.ImageID, plan.AllowedAMIs) {
+		return fmt.Errorf("Plan %s does not allow the instance's AMI: %s", plan.ID, instance.ImageID)
+	}
+	if !stringIn(instance.SubnetID, plan.AllowedSubnets) {
+		return fmt.Errorf("Plan %s does not allow the instance's subnet: %s", plan.ID, instance.SubnetID)
+	}
+	for _, group := range instance.SecurityGroupIDs {
+		if !stringIn(group, plan.AllowedSecurityGroups) {
+			return fmt.Errorf("Plan %s does not allow the instance's security group: %s", plan.ID, group)
+		}
+	}
+	// Only an Elastic IP asked for with elastic_ip needs the plan to allow them. The one the broker allocates for a public
+	// IP added after launch is the instance's public IP.
+	if parameters.ElasticIP && !plan.AllowElasticIP {
+		return fmt.Errorf("Plan %s does not allow the instance's Elastic IP", plan.ID)
+	}
+	// A stopped instance has given up its public IP, but gets one again when it starts
+	if !parameters.ElasticIP && (instance.PublicIP != "" || parameters.AssignPublicIP) && !plan.AllowPublicIP {
+		return fmt.Errorf("Plan %s does not allow the instance's public IP", plan.ID)
+	}
+	if parameters.InstanceProfile != "" && !stringIn(parameters.InstanceProfile, plan.AllowedInstanceProfiles) {
+		return fmt.Errorf("Plan %s does not allow the instance's instance profile: %s", plan.ID, parameters.InstanceProfile)
+	}
+	if parameters.UserData != "" && !plan.AllowUserData {
+		return fmt.Errorf("Plan %s does not allow the instance's user data", plan.ID)
+	}
+	if err := validateVolumes(plan, parameters.Volumes); err != nil {
+		return fmt.Errorf("Plan %s does not allow the instance's data volumes: %s", plan.ID, err)
+	}
+	return nil
+}
+
+// The parameters an instance is running with: those recorded in the store, or when the store has none, those read back
+// from the instance itself
+func (b *EC2Broker) currentParameters(instanceID string, instance *InstanceDescription) ProvisionParameters {
+	var parameters ProvisionParameters
+	record, err := b.Store.Get(instanceID)
+	if err == nil && len(record.Parameters) > 0 && json.Unmarshal(record.Parameters, &parameters) == nil {
+		return parameters
+	}
+	parameters = ProvisionParameters{
+		AMIID:          instance.ImageID,
+		SubnetID:       instance.SubnetID,
+		AssignPublicIP: instance.PublicIP != "",
+		ElasticIP:      instance.ElasticIP != "",
+	}
+	if len(instance.SecurityGroupIDs) > 0 {
+		parameters.SecurityGroupID = instance.SecurityGroupIDs[0]
+		parameters.SecurityGroupIDs = instance.SecurityGroupIDs[1:]
+	}
+	return parameters
+}
+
+// Applies the security group, public IP and tag parameters given to an update. The parameters are merged over those the
+// instance is running with and validated against the plan just as they are when provisioning.
+func (b *EC2Broker) updateParameters(instanceID string, plan *config.PlanConfig, rawParameters map[string]interface{}) error {
+	var changes ProvisionParameters
+	data, err := json.Marshal(rawParameters)
+	if err == nil {
+		err = json.Unmarshal(data, &changes)
+	}
+	if err != nil {
+		return brokerapi.ErrRawParamsInvalid
+	}
+	instance, err := b.Manager.DescribeAWSInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	parameters := b.currentParameters(instanceID, instance)
+	current := parameters
+	if _, ok := rawParameters["ami_id"]; ok && changes.AMIID != parameters.AMIID {
+		return fmt.Errorf("The AMI of instance %s cannot be changed", instanceID)
+	}
+	if _, ok := rawParameters["image"]; ok && changes.Image != parameters.Image {
+		return fmt.Errorf("The image of instance %s cannot be changed", instanceID)
+	}
+	if _, ok := rawParameters["subnet_id"]; ok && changes.SubnetID != parameters.SubnetID {
+		return fmt.Errorf("The subnet of instance %s cannot be changed", instanceID)
+	}
+	if _, ok := rawParameters["volumes"]; ok && !reflect.DeepEqual(changes.Volumes, parameters.Volumes) {
+		return fmt.Errorf("The data volumes of instance %s cannot be changed", instanceID)
+	}
+	if _, ok := rawParameters["user_data"]; ok && changes.UserData != parameters.UserData {
+		return fmt.Errorf("The user data of instance %s cannot be changed", instanceID)
+	}
+	if _, ok := rawParameters["instance_profile"]; ok && changes.InstanceProfile != parameters.InstanceProfile {
+		return fmt.Errorf("The instance profile of instance %s cannot be changed", instanceID)
+	}
+	if _, ok := rawParameters["security_group_id"]; ok {
+		parameters.SecurityGroupID = changes.SecurityGroupID
+	}
+	if _, ok := rawParameters["security_group_ids"]; ok {
+		parameters.SecurityGroupIDs = changes.SecurityGroupIDs
+	}
+	if _, ok := rawParameters["assign_public_ip"]; ok {
+		parameters.AssignPublicIP = changes.AssignPublicIP
+	}
+	if _, ok := rawParameters["elastic_ip"]; ok {
+		parameters.ElasticIP = changes.ElasticIP
+	}
+	// A public IP added after launch is an Elastic IP the broker allocates
+	if parameters.AssignPublicIP && !current.AssignPublicIP && !parameters.ElasticIP && !plan.AllowElasticIP {
+		return fmt.Errorf("Plan %s does not allow the Elastic IP needed to add a public IP to instance %s", plan.ID, instanceID)
+	}
+	// The tags given replace all the custom tags. They are only checked when given, so instances launched before the
+	// tag policy changed can still be updated otherwise.
+	if _, ok := rawParameters["tags"]; ok {
+		parameters.Tags = changes.Tags
+		err = validateTags(instanceConfig(b.Store, instanceID), parameters.Tags)
+		if err != nil {
+			return err
+		}
+	}
+	err = validateParameters(plan, parameters)
+	if err != nil {
+		return err
+	}
+
+	var changed []string
+	groups := parameters.securityGroups()
+	if !sameStrings(groups, instance.SecurityGroupIDs) {
+		err = b.Manager.SetAWSInstanceSecurityGroups(instanceID, groups)
+		if err == nil {
+			changed = append(changed, fmt.Sprintf("security groups set to %s", strings.Join(groups, ", ")))
+		}
+	}
+	if err == nil && parameters.ElasticIP != current.ElasticIP {
+		var address string
+		if parameters.ElasticIP {
+			address, err = b.Manager.AssociateAWSElasticIP(instanceID)
+			if err == nil {
+				changed = append(changed, fmt.Sprintf("Elastic IP %s associated", address))
+			}
+		} else {
+			err = b.Manager.ReleaseAWSElasticIP(instanceID)
+			if err == nil {
+				changed = append(changed, "Elastic IP released")
+			}
+		}
+	}
+	if err == nil && !reflect.DeepEqual(parameters.Tags, current.Tags) {
+		err = b.Manager.SetAWSInstanceTags(instanceID, parameters.Tags, removedTags(current.Tags, parameters.Tags))
+		if err == nil {
+			changed = append(changed, "tags updated")
+		}
+	}
+	// Only a change to the setting is acted on, since a stopped instance has no public IP whatever it was launched with.
+	// The setting is kept until the instance is running. An Elastic IP stands in for any other public IP.
+	if err == nil && !parameters.ElasticIP && !current.ElasticIP && parameters.AssignPublicIP != current.AssignPublicIP {
+		if instance.State != ec2.InstanceStateNameRunning {
+			parameters.AssignPublicIP = current.AssignPublicIP
+			changed = append(changed, fmt.Sprintf("public IP unchanged while instance is %s", instance.State))
+		} else {
+			var publicIP string
+			publicIP, err = b.Manager.SetAWSInstancePublicIP(instanceID, parameters.AssignPublicIP)
+			if err == nil && parameters.AssignPublicIP {
+				changed = append(changed, fmt.Sprintf("public IP %s associated", publicIP))
+			} else if err == nil {
+				changed = append(changed, "public IP removed")
+			}
+		}
+	}
+
+	updateStore(b.Store, instanceID, func(record *store.Instance) {
+		if err != nil {
+			record.AddOperation(operationUpdate, string(brokerapi.Failed), err.Error())
+			return
+		}
+		if data, marshalErr := json.Marshal(parameters); marshalErr == nil {
+			record.Parameters = data
+		}
+		if len(changed) == 0 {
+			changed = append(changed, "no changes")
+		}
+		record.AddOperation(operationUpdate, string(brokerapi.Succeeded), strings.Join(changed, "; "))
+	})
+	return err
+}
+
+// Checks that an instance can move to a plan, returning the instance as it stands
+func (b *EC2Broker) checkPlanChange(instanceID string, plan *config.PlanConfig) (*InstanceDescription, error) {
+	logger := config.GetLogger()
+	instance, err := b.Manager.DescribeAWSInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPlanCompatible(plan, instance, b.currentParameters(instanceID, instance))
+	if err != nil {
+		logger.Info("failed-update-incompatible-plan", lager.Data{"instance_id": instanceID, "error": err.Error()})
+		return nil, brokerapi.ErrPlanChangeNotSupported
+	}
+	if record, err := b.Store.Get(instanceID); err == nil {
+		err = validateContext(plan, ProvisionContext{OrganizationGUID: record.OrganizationGUID, SpaceGUID: record.SpaceGUID})
+		if err != nil {
+			logger.Info("failed-update-plan-context", lager.Data{"instance_id": instanceID, "error": err.Error()})
+			return nil, err
+		}
+	}
+	if instance.State != ec2.InstanceStateNameRunning && instance.State != ec2.InstanceStateNameStopped {
+		return nil, fmt.Errorf("Unable to change the plan of instance %s while it is %s", instanceID, instance.State)
+	}
+	return instance, nil
+}
+
+// Begins moving an instance that checkPlanChange passed to a new plan by stopping it. The remaining steps are driven by
+// lastUpdateOperation. An instance that is already stopped is resized at once.
+func (b *EC2Broker) startPlanChange(instanceID string, plan *config.PlanConfig, instance *InstanceDescription) (brokerapi.UpdateServiceSpec, error) {
+	logger := config.GetLogger()
+
+	// Plans sharing an instance type need no resize
+	if instance.InstanceType == plan.InstanceType {
+		updateStore(b.Store, instanceID, func(record *store.Instance) {
+			record.PlanID = plan.ID
+			op := record.AddOperation(operationUpdate, string(brokerapi.Succeeded), "instance type unchanged")
+			op.PlanID = plan.ID
+		})
+		return brokerapi.UpdateServiceSpec{}, nil
+	}
+
+	// A stopped instance is resized where it stands, and left stopped as its user left it
+	if instance.State == ec2.InstanceStateNameStopped {
+		err := b.Manager.SetAWSInstanceType(instanceID, plan.InstanceType)
+		if err != nil {
+			logger.Error("failed-update-resize", err, lager.Data{"instance_id": instanceID})
+		}
+		updateStore(b.Store, instanceID, func(record *store.Instance) {
+			if err != nil {
+				op := record.AddOperation(operationUpdate, string(brokerapi.Failed), fmt.Sprintf("failed changing instance type: %s", err))
+				op.PlanID = plan.ID
+				return
+			}
+			record.PlanID = plan.ID
+			op := record.AddOperation(operationUpdate, string(brokerapi.Succeeded), fmt.Sprintf("instance type changed from %s to %s; instance left stopped", instance.InstanceType, plan.InstanceType))
+			op.PlanID = plan.ID
+		})
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	_, err := b.Manager.StopAWSInstance(instanceID)
+	if err != nil {
+		logger.Error("failed-update-stop", err, lager.Data{"instance_id": instanceID})
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	updateStore(b.Store, instanceID, func(record *store.Instance) {
+		op := record.AddOperation(operationUpdate, string(brokerapi.InProgress), "")
+		op.PlanID = plan.ID
+		op.SetStep(updateStepStopping, fmt.Sprintf("stopping instance to change type from %s to %s", instance.InstanceType, plan.InstanceType))
+	})
+	return brokerapi.UpdateServiceSpec{IsAsync: true, OperationData: newOperationToken(operationUpdate, instanceID).String()}, nil
+}
+
+// Reports on a plan change, moving it on to its next step once the instance has finished the current one
+func (b *EC2Broker) lastUpdateOperation(instanceID string) (brokerapi.LastOperation, error) {
+	logger := config.GetLogger()
+	conf := config.GetConfiguration()
+	record, err := b.Store.Get(instanceID)
+	if err != nil {
+		return brokerapi.LastOperation{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	op := record.LastOperation(operationUpdate)
+	if op == nil {
+		return brokerapi.LastOperation{}, brokerapi.ErrRawParamsInvalid
+	}
+	if op.State != string(brokerapi.InProgress) {
+		return brokerapi.LastOperation{State: brokerapi.LastOperationState(op.State), Description: op.Description}, nil
+	}
+
+	status, err := b.Manager.GetAWSInstanceStatus(instanceID)
+	if err != nil {
+		logger.Error("getting-status", err)
+		return brokerapi.LastOperation{}, fmt.Errorf("Unable to look up status for %s", instanceID)
+	}
+	state, step, description := brokerapi.InProgress, op.Step, op.Description
+	switch op.Step {
+	case updateStepStopping:
+		switch status.State {
+		case ec2.InstanceStateNameRunning, ec2.InstanceStateNameStopping:
+			// The stop has not taken effect yet
+		case ec2.InstanceStateNameStopped:
+			plan, err := findPlan(conf, op.PlanID)
+			if err == nil {
+				err = b.Manager.SetAWSInstanceType(instanceID, plan.InstanceType)
+			}
+			if err != nil {
+				logger.Error("failed-update-resize", err, lager.Data{"instance_id": instanceID})
+				// Bring the instance back on its old type rather than leave it stopped
+				_, startErr := b.Manager.StartAWSInstance(instanceID)
+				if startErr != nil {
+					logger.Error("failed-update-restart", startErr, lager.Data{"instance_id": instanceID})
+				}
+				state, description = brokerapi.Failed, fmt.Sprintf("failed changing instance type: %s", err)
+				break
+			}
+			_, err = b.Manager.StartAWSInstance(instanceID)
+			if err != nil {
+				logger.Error("failed-update-start", err, lager.Data{"instance_id": instanceID})
+				state, description = brokerapi.Failed, fmt.Sprintf("failed starting instance as %s: %s", plan.InstanceType, err)
+				break
+			}
+			step, description = updateStepStarting, fmt.Sprintf("starting instance as %s", plan.InstanceType)
+		default:
+			state, description = brokerapi.Failed, fmt.Sprintf("instance %s while stopping", status.Description())
+		}
+	case updateStepStarting:
+		switch status.State {
+		case ec2.InstanceStateNamePending:
+			// The start has not taken effect yet
+		case ec2.InstanceStateNameRunning:
+			state, description = brokerapi.Succeeded, "plan changed"
+		default:
+			state, description = brokerapi.Failed, fmt.Sprintf("instance %s while starting", status.Description())
+		}
+	default:
+		state, description = brokerapi.Failed, fmt.Sprintf("unknown update step: %s", op.Step)
+	}
+
+	logger.Info("last-operation-update", lager.Data{"instanceID": instanceID, "awsStatus": status.State, "step": step, "state": state})
+	updateStore(b.Store, instanceID, func(record *store.Instance) {
+		current := record.LastOperation(operationUpdate)
+		if current == nil {
+			return
+		}
+		current.SetStep(step, description)
+		current.SetState(string(state), description)
+		if state == brokerapi.Succeeded {
+			record.PlanID = current.PlanID
+		}
+	})
+	return brokerapi.LastOperation{State: state, Description: description}, nil
+}
@@ -0,0 +1,91 @@
+package broker
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+var _ = Describe("Plan compatibility", func() {
+	var (
+		plan       *config.PlanConfig
+		instance   *InstanceDescription
+		parameters ProvisionParameters
+	)
+
+	BeforeEach(func() {
+		plan = &config.PlanConfig{
+			ID:                    "plan-id",
+			AllowedAMIs:           []string{"ami-1"},
+			AllowedSubnets:        []string{"subnet-1"},
+			AllowedSecurityGroups: []string{"sg-1"},
+		}
+		instance = &InstanceDescription{ImageID: "ami-1", SubnetID: "subnet-1", SecurityGroupIDs: []string{"sg-1"}}
+		parameters = ProvisionParameters{AMIID: "ami-1", SubnetID: "subnet-1", SecurityGroupID: "sg-1"}
+	})
+
+	It("allows plans that allow everything the instance was launched with", func() {
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(Succeed())
+	})
+
+	It("refuses plans that do not allow the instance's public IP", func() {
+		instance.PublicIP = "54.0.0.1"
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(MatchError(ContainSubstring("public IP")))
+
+		instance.PublicIP = ""
+		parameters.AssignPublicIP = true
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(MatchError(ContainSubstring("public IP")))
+
+		plan.AllowPublicIP = true
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(Succeed())
+	})
+
+	It("refuses plans that do not allow the Elastic IP the instance was given", func() {
+		plan.AllowPublicIP = true
+		instance.PublicIP = "52.0.0.1"
+		instance.ElasticIP = "52.0.0.1"
+		parameters.ElasticIP = true
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(MatchError(ContainSubstring("Elastic IP")))
+
+		plan.AllowElasticIP = true
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(Succeed())
+	})
+
+	It("treats the Elastic IP behind a public IP added after launch as the public IP", func() {
+		instance.PublicIP = "52.0.0.1"
+		instance.ElasticIP = "52.0.0.1"
+		parameters.AssignPublicIP = true
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(MatchError(ContainSubstring("public IP")))
+
+		plan.AllowPublicIP = true
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(Succeed())
+	})
+
+	It("refuses plans that do not allow the instance's instance profile", func() {
+		parameters.InstanceProfile = "app-role"
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(MatchError(ContainSubstring("instance profile")))
+
+		plan.AllowedInstanceProfiles = []string{"app-role"}
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(Succeed())
+	})
+
+	It("refuses plans that do not allow user data", func() {
+		parameters.UserData = "#cloud-config\n"
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(MatchError(ContainSubstring("user data")))
+
+		plan.AllowUserData = true
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(Succeed())
+	})
+
+	It("refuses plans whose volume policy does not allow the instance's data volumes", func() {
+		parameters.Volumes = []VolumeParameters{{SizeGB: 100}}
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(MatchError(ContainSubstring("data volumes")))
+
+		plan.Volumes = &config.VolumePolicy{AllowedTypes: []string{"gp2"}, MaxSizeGB: 50, MaxCount: 1}
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(MatchError(ContainSubstring("data volumes")))
+
+		plan.Volumes.MaxSizeGB = 100
+		Expect(checkPlanCompatible(plan, instance, parameters)).To(Succeed())
+	})
+})
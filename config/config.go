@@ -3,43 +3,187 @@ package config
 import (
 	"encoding/json"
 	"io/ioutil"
+	"reflect"
+	"sync"
 
 	"code.cloudfoundry.org/lager"
 )
 
 /*
-Config describes the configuration file used to configure this service. It expects that there is only one service, not many
+Config describes the configuration file used to configure this service. The broker offers the services listed in Services,
+or when there are none, the single service described by ServiceID, ServiceName, ServiceDescription, ServiceMetadata and
+Plans. KeyPairName and TagPrefix apply to every service that does not set its own.
 */
 type Config struct {
-	DashboardURL       string       `json:"dashboard_url"`
-	Region             string       `json:"region"`
-	ServiceID          string       `json:"service_id"`
-	ServiceName        string       `json:"service_name"`
-	ServiceDescription string       `json:"service_description"`
-	BrokerUsername     string       `json:"broker_username"`
-	BrokerPassword     string       `json:"broker_password"`
-	KeyPairName        string       `json:"keypair_name"`
-	TagPrefix          string       `json:"tag_prefix"`
-	Plans              []PlanConfig `json:"plans"`
+	DashboardURL             string          `json:"dashboard_url"`
+	Region                   string          `json:"region"`
+	ServiceID                string          `json:"service_id"`
+	ServiceName              string          `json:"service_name"`
+	ServiceDescription       string          `json:"service_description"`
+	ServiceMetadata          ServiceMetadata `json:"service_metadata"`
+	BrokerUsername           string          `json:"broker_username"`
+	BrokerPassword           string          `json:"broker_password"`
+	OperationSecret          string          `json:"operation_secret"`
+	KeyPairName              string          `json:"keypair_name"`
+	TagPrefix                string          `json:"tag_prefix"`
+	StateFile                string          `json:"state_file"`
+	DiscoveryTTLSeconds      int             `json:"discovery_ttl_seconds"`
+	TagPolicy                TagPolicy       `json:"tag_policy"`
+	ReconcileIntervalSeconds int             `json:"reconcile_interval_seconds"`
+	TerminateOrphans         bool            `json:"terminate_orphans"`
+	OrphanGraceSeconds       int             `json:"orphan_grace_seconds"`
+	Plans                    []PlanConfig    `json:"plans"`
+	Services                 []ServiceConfig `json:"services"`
+
+	// Fields in the file the broker does not know, reported by Validate
+	unknownFields ValidationErrors
+}
+
+/*
+ServiceConfig describes one of the services in the catalog, with its own plans, and the key pair and tag prefix used for
+its instances
+*/
+type ServiceConfig struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Tags        []string        `json:"tags"`
+	Metadata    ServiceMetadata `json:"metadata"`
+	KeyPairName string          `json:"keypair_name"`
+	TagPrefix   string          `json:"tag_prefix"`
+	Plans       []PlanConfig    `json:"plans"`
 }
 
 /*
-PlanConfig describes a plan, including the list of allowable subnets, AMIs, and Security groups, and what instance type of EC2 instance will be launched
+ServiceMetadata is what the marketplace shows about a service beyond its name and description
+*/
+type ServiceMetadata struct {
+	DisplayName         string `json:"display_name"`
+	ImageURL            string `json:"image_url"`
+	LongDescription     string `json:"long_description"`
+	ProviderDisplayName string `json:"provider_display_name"`
+	DocumentationURL    string `json:"documentation_url"`
+	SupportURL          string `json:"support_url"`
+}
+
+/*
+PlanConfig describes a plan, including the list of allowable subnets, AMIs, and Security groups, and what instance type of EC2 instance will be launched.
+The selectors allow any AMI, subnet or security group carrying the given tags as well; an empty tag value matches any value.
 */
 type PlanConfig struct {
-	ID                    string   `json:"id"`
-	Name                  string   `json:"name"`
-	Description           string   `json:"description"`
-	InstanceType          string   `json:"instance_type"`
-	AllowedAMIs           []string `json:"allowed_amis"`
-	AllowedSubnets        []string `json:"allowed_subnets"`
-	AllowedSecurityGroups []string `json:"allowed_security_groups"`
-	AllowPublicIP         bool     `json:"allow_public_ip"`
+	ID                      string            `json:"id"`
+	Name                    string            `json:"name"`
+	Description             string            `json:"description"`
+	InstanceType            string            `json:"instance_type"`
+	AllowedAMIs             []string          `json:"allowed_amis"`
+	AllowedSubnets          []string          `json:"allowed_subnets"`
+	AllowedSecurityGroups   []string          `json:"allowed_security_groups"`
+	AMISelector             map[string]string `json:"ami_selector"`
+	SubnetSelector          map[string]string `json:"subnet_selector"`
+	SecurityGroupSelector   map[string]string `json:"security_group_selector"`
+	ImageFamilies           []ImageFamily     `json:"image_families"`
+	AllowPublicIP           bool              `json:"allow_public_ip"`
+	AllowElasticIP          bool              `json:"allow_elastic_ip"`
+	AllowedInstanceProfiles []string          `json:"allowed_instance_profiles"`
+	AllowedOrganizations    []string          `json:"allowed_organizations"`
+	AllowedSpaces           []string          `json:"allowed_spaces"`
+	SSHUsername             string            `json:"ssh_username"`
+	Volumes                 *VolumePolicy     `json:"volumes"`
+	UserDataTemplate        string            `json:"user_data_template"`
+	AllowUserData           bool              `json:"allow_user_data"`
+	MaxUserDataBytes        int               `json:"max_user_data_bytes"`
+	Metadata                PlanMetadata      `json:"metadata"`
+}
+
+/*
+PlanMetadata is what the marketplace shows about a plan beyond its name and description. With InstanceSpecs set, the
+vCPUs and memory of the plan's instance type are listed ahead of the bullets.
+*/
+type PlanMetadata struct {
+	DisplayName   string     `json:"display_name"`
+	Bullets       []string   `json:"bullets"`
+	Costs         []PlanCost `json:"costs"`
+	InstanceSpecs bool       `json:"instance_specs"`
+}
+
+/*
+PlanCost is a price of a plan per unit, such as HOUR or MONTH, in one or more currencies, keyed by currency code
+*/
+type PlanCost struct {
+	Amount map[string]float64 `json:"amount"`
+	Unit   string             `json:"unit"`
+}
+
+/*
+ImageFamily names a series of AMIs that users may launch by name instead of AMI ID. The family resolves to the newest
+available AMI owned by one of the owners whose name matches the name pattern (wildcards allowed) and that carries every
+tag listed. A version picks out the AMIs whose version tag has that value, or whose creation date starts with it.
+*/
+type ImageFamily struct {
+	Name        string            `json:"name"`
+	Owners      []string          `json:"owners"`
+	NamePattern string            `json:"name_pattern"`
+	Tags        map[string]string `json:"tags"`
+	VersionTag  string            `json:"version_tag"`
+}
+
+/*
+VolumePolicy limits the EBS data volumes users may request when provisioning under a plan. Plans without a volume policy
+do not allow data volumes. Volumes are deleted with their instance unless DeleteOnTermination is set to false.
+*/
+type VolumePolicy struct {
+	AllowedTypes        []string `json:"allowed_types"`
+	MaxSizeGB           int64    `json:"max_size_gb"`
+	MaxCount            int      `json:"max_count"`
+	MaxIOPS             int64    `json:"max_iops"`
+	RequireEncryption   bool     `json:"require_encryption"`
+	KMSKeyID            string   `json:"kms_key_id"`
+	DeleteOnTermination *bool    `json:"delete_on_termination"`
 }
 
+/*
+TagPolicy limits the custom tags users may put on their instances. Keys must match KeyPattern when it is set, and every
+required key must be given a value. Keys under the broker's tag prefix are always reserved.
+*/
+type TagPolicy struct {
+	MaxTags      int      `json:"max_tags"`
+	KeyPattern   string   `json:"key_pattern"`
+	RequiredKeys []string `json:"required_keys"`
+}
+
+/*
+DefaultStateFile is where the broker keeps its record of instances when the configuration does not say otherwise
+*/
+const DefaultStateFile = "ec2-broker-state.json"
+
+/*
+DefaultReconcileIntervalSeconds is how often the broker looks for orphaned and drifted instances when the configuration does
+not say otherwise. A negative interval turns reconciliation off.
+*/
+const DefaultReconcileIntervalSeconds = 900
+
+/*
+DefaultOrphanGraceSeconds is how long after launch an orphaned instance is left alone when the configuration does not say
+otherwise, giving provisions in flight time to record their instances
+*/
+const DefaultOrphanGraceSeconds = 3600
+
+/*
+DefaultDiscoveryTTLSeconds is how long the resources found by plans' tag selectors are cached when the configuration does not say otherwise
+*/
+const DefaultDiscoveryTTLSeconds = 300
+
+/*
+DefaultSSHUsername is the login user for a plan's AMIs when the plan does not name one
+*/
+const DefaultSSHUsername = "ec2-user"
+
 var (
-	config Config
-	logger lager.Logger
+	// The current configuration. It is replaced, never changed, so callers holding a configuration keep a consistent one
+	// across a reload.
+	config      = &Config{}
+	configMutex sync.RWMutex
+	logger      lager.Logger
 )
 
 /*
@@ -50,25 +194,34 @@ func LoadConfiguration(filename string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(f, &config)
+	var loaded Config
+	err = json.Unmarshal(f, &loaded)
 	if err != nil {
 		return nil, err
 	}
-	return &config, nil
+	loaded.unknownFields = findUnknownFields(f, reflect.TypeOf(loaded))
+	SetConfiguration(&loaded)
+	return GetConfiguration(), nil
 }
 
 /*
-GetConfiguration provides the currently configuration to the caller.
+GetConfiguration provides the currently configuration to the caller. It must not be changed, as a reload replaces it
+rather than updating it.
 */
 func GetConfiguration() *Config {
-	return &config
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
 }
 
 /*
-SetConfiguration sets the configuration globally
+SetConfiguration sets the configuration globally, replacing the current one with a copy of c
 */
 func SetConfiguration(c *Config) {
-	config = *c
+	copied := *c
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config = &copied
 }
 
 /*
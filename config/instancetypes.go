@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+)
+
+/*
+InstanceSpec gives the vCPUs and memory of an EC2 instance type
+*/
+type InstanceSpec struct {
+	VCPUs     int
+	MemoryGiB float64
+}
+
+/*
+Bullets describes the specs as the marketplace lists them
+*/
+func (s InstanceSpec) Bullets() []string {
+	vcpus := fmt.Sprintf("%d vCPUs", s.VCPUs)
+	if s.VCPUs == 1 {
+		vcpus = "1 vCPU"
+	}
+	return []string{vcpus, strconv.FormatFloat(s.MemoryGiB, 'f', -1, 64) + " GiB memory"}
+}
+
+// The specs of the common general purpose, compute and memory optimized instance types
+var instanceSpecs = map[string]InstanceSpec{
+	"t2.nano":     {1, 0.5},
+	"t2.micro":    {1, 1},
+	"t2.small":    {1, 2},
+	"t2.medium":   {2, 4},
+	"t2.large":    {2, 8},
+	"t2.xlarge":   {4, 16},
+	"t2.2xlarge":  {8, 32},
+	"t3.nano":     {2, 0.5},
+	"t3.micro":    {2, 1},
+	"t3.small":    {2, 2},
+	"t3.medium":   {2, 4},
+	"t3.large":    {2, 8},
+	"t3.xlarge":   {4, 16},
+	"t3.2xlarge":  {8, 32},
+	"m4.large":    {2, 8},
+	"m4.xlarge":   {4, 16},
+	"m4.2xlarge":  {8, 32},
+	"m4.4xlarge":  {16, 64},
+	"m4.10xlarge": {40, 160},
+	"m4.16xlarge": {64, 256},
+	"m5.large":    {2, 8},
+	"m5.xlarge":   {4, 16},
+	"m5.2xlarge":  {8, 32},
+	"m5.4xlarge":  {16, 64},
+	"m5.12xlarge": {48, 192},
+	"m5.24xlarge": {96, 384},
+	"c4.large":    {2, 3.75},
+	"c4.xlarge":   {4, 7.5},
+	"c4.2xlarge":  {8, 15},
+	"c4.4xlarge":  {16, 30},
+	"c4.8xlarge":  {36, 60},
+	"c5.large":    {2, 4},
+	"c5.xlarge":   {4, 8},
+	"c5.2xlarge":  {8, 16},
+	"c5.4xlarge":  {16, 32},
+	"c5.9xlarge":  {36, 72},
+	"c5.18xlarge": {72, 144},
+	"r4.large":    {2, 15.25},
+	"r4.xlarge":   {4, 30.5},
+	"r4.2xlarge":  {8, 61},
+	"r4.4xlarge":  {16, 122},
+	"r4.8xlarge":  {32, 244},
+	"r4.16xlarge": {64, 488},
+	"r5.large":    {2, 16},
+	"r5.xlarge":   {4, 32},
+	"r5.2xlarge":  {8, 64},
+	"r5.4xlarge":  {16, 128},
+	"r5.12xlarge": {48, 384},
+	"r5.24xlarge": {96, 768},
+}
+
+/*
+InstanceSpecs looks up the vCPUs and memory of an instance type, reporting whether the type is one the broker knows
+*/
+func InstanceSpecs(instanceType string) (InstanceSpec, bool) {
+	spec, ok := instanceSpecs[instanceType]
+	return spec, ok
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+DefaultConfigFile is the configuration file read when none is named. Unlike a named file, it may be missing.
+*/
+const DefaultConfigFile = "config.json"
+
+/*
+DefaultVCAPServiceName is the name or tag of the user-provided service whose credentials configure the broker when
+EC2_BROKER_VCAP_SERVICE does not name another
+*/
+const DefaultVCAPServiceName = "ec2-broker-config"
+
+// The kinds of value an environment variable can hold
+const (
+	envString = iota
+	envNumber
+	envBool
+	envJSON
+)
+
+// The environment variables that override configuration fields, by the field's JSON key
+var environmentVariables = []struct {
+	name string
+	key  string
+	kind int
+}{
+	{"EC2_BROKER_DASHBOARD_URL", "dashboard_url", envString},
+	{"EC2_BROKER_REGION", "region", envString},
+	{"EC2_BROKER_SERVICE_ID", "service_id", envString},
+	{"EC2_BROKER_SERVICE_NAME", "service_name", envString},
+	{"EC2_BROKER_SERVICE_DESCRIPTION", "service_description", envString},
+	{"EC2_BROKER_SERVICE_METADATA", "service_metadata", envJSON},
+	{"EC2_BROKER_USERNAME", "broker_username", envString},
+	{"EC2_BROKER_PASSWORD", "broker_password", envString},
+	{"EC2_BROKER_OPERATION_SECRET", "operation_secret", envString},
+	{"EC2_BROKER_KEYPAIR_NAME", "keypair_name", envString},
+	{"EC2_BROKER_TAG_PREFIX", "tag_prefix", envString},
+	{"EC2_BROKER_STATE_FILE", "state_file", envString},
+	{"EC2_BROKER_DISCOVERY_TTL_SECONDS", "discovery_ttl_seconds", envNumber},
+	{"EC2_BROKER_RECONCILE_INTERVAL_SECONDS", "reconcile_interval_seconds", envNumber},
+	{"EC2_BROKER_TERMINATE_ORPHANS", "terminate_orphans", envBool},
+	{"EC2_BROKER_ORPHAN_GRACE_SECONDS", "orphan_grace_seconds", envNumber},
+	{"EC2_BROKER_TAG_POLICY", "tag_policy", envJSON},
+	{"EC2_BROKER_PLANS", "plans", envJSON},
+	{"EC2_BROKER_SERVICES", "services", envJSON},
+}
+
+/*
+Load builds the configuration in layers, each overriding the last: the defaults, then the configuration file, then the
+EC2_BROKER_* environment variables, then the credentials of the broker's user-provided service in VCAP_SERVICES. The file
+is the one named, or the one EC2_BROKER_CONFIG names, or config.json if it exists. The result becomes the current
+configuration.
+*/
+func Load(filename string, getenv func(string) string) (*Config, error) {
+	loaded, err := load(filename, getenv)
+	if err != nil {
+		return nil, err
+	}
+	SetConfiguration(loaded)
+	return GetConfiguration(), nil
+}
+
+// The configuration file to read, and whether it must exist, which it need not when it is the default
+func configFile(filename string, getenv func(string) string) (string, bool) {
+	if filename == "" {
+		filename = getenv("EC2_BROKER_CONFIG")
+	}
+	if filename == "" {
+		return DefaultConfigFile, false
+	}
+	return filename, true
+}
+
+// Builds the configuration as Load describes, without making it current
+func load(filename string, getenv func(string) string) (*Config, error) {
+	loaded := Config{
+		StateFile:                DefaultStateFile,
+		DiscoveryTTLSeconds:      DefaultDiscoveryTTLSeconds,
+		ReconcileIntervalSeconds: DefaultReconcileIntervalSeconds,
+		OrphanGraceSeconds:       DefaultOrphanGraceSeconds,
+	}
+	filename, required := configFile(filename, getenv)
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = overlay(&loaded, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		loaded.unknownFields = findUnknownFields(data, reflect.TypeOf(loaded))
+	} else if required || !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, variable := range environmentVariables {
+		value := getenv(variable.name)
+		if value == "" {
+			continue
+		}
+		var err error
+		raw := value
+		switch variable.kind {
+		case envString:
+			encoded, _ := json.Marshal(value)
+			raw = string(encoded)
+		case envNumber:
+			_, err = strconv.Atoi(value)
+		case envBool:
+			var b bool
+			b, err = strconv.ParseBool(value)
+			raw = strconv.FormatBool(b)
+		}
+		if err == nil {
+			err = overlay(&loaded, []byte(fmt.Sprintf(`{%q: %s}`, variable.key, raw)))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", variable.name, err)
+		}
+	}
+
+	credentials, path, err := vcapCredentials(getenv)
+	if err != nil {
+		return nil, err
+	}
+	if credentials != nil {
+		err = overlay(&loaded, credentials)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		for _, unknown := range findUnknownFields(credentials, reflect.TypeOf(loaded)) {
+			unknown.Path = path + unknown.Path[1:]
+			loaded.unknownFields = append(loaded.unknownFields, unknown)
+		}
+	}
+
+	return &loaded, nil
+}
+
+// Applies a layer of the configuration. Each field the layer sets replaces the field outright: decoding the layer over
+// the configuration would instead merge it into what earlier layers set, so that a plan in an overriding list of plans
+// would keep the fields of the plan at the same position in the file.
+func overlay(loaded *Config, data []byte) error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	var layer Config
+	if err := json.Unmarshal(data, &layer); err != nil {
+		return err
+	}
+	target := reflect.ValueOf(loaded).Elem()
+	source := reflect.ValueOf(layer)
+	for i := 0; i < target.NumField(); i++ {
+		name, ok := jsonFieldName(target.Type().Field(i))
+		if !ok {
+			continue
+		}
+		// Keys match fields regardless of case, as encoding/json matches them
+		for key := range keys {
+			if strings.EqualFold(key, name) {
+				target.Field(i).Set(source.Field(i))
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// The credentials of the broker's user-provided service, found by the name or tag EC2_BROKER_VCAP_SERVICE gives, along
+// with their path in VCAP_SERVICES. There are none when the broker is not bound to such a service.
+func vcapCredentials(getenv func(string) string) (json.RawMessage, string, error) {
+	vcap := getenv("VCAP_SERVICES")
+	if vcap == "" {
+		return nil, "", nil
+	}
+	name := getenv("EC2_BROKER_VCAP_SERVICE")
+	if name == "" {
+		name = DefaultVCAPServiceName
+	}
+	var services map[string][]struct {
+		Name        string          `json:"name"`
+		Tags        []string        `json:"tags"`
+		Credentials json.RawMessage `json:"credentials"`
+	}
+	if err := json.Unmarshal([]byte(vcap), &services); err != nil {
+		return nil, "", fmt.Errorf("VCAP_SERVICES: %s", err)
+	}
+	for i, service := range services["user-provided"] {
+		if service.Name == name || stringIn(name, service.Tags) {
+			return service.Credentials, fmt.Sprintf("VCAP_SERVICES.user-provided[%d].credentials", i), nil
+		}
+	}
+	return nil, "", nil
+}
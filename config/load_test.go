@@ -0,0 +1,131 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/GSA/ec2-broker/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Load", func() {
+	var env map[string]string
+
+	getenv := func(name string) string {
+		return env[name]
+	}
+
+	BeforeEach(func() {
+		env = map[string]string{}
+	})
+
+	It("reads the named file over the defaults", func() {
+		conf, err := Load("../config-sample.json", getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.ServiceName).To(Equal("ec2-service"))
+		Expect(conf.StateFile).To(Equal(DefaultStateFile))
+		Expect(conf.ReconcileIntervalSeconds).To(Equal(DefaultReconcileIntervalSeconds))
+		Expect(conf.Validate()).To(Succeed())
+	})
+
+	It("reads the file EC2_BROKER_CONFIG names", func() {
+		env["EC2_BROKER_CONFIG"] = "../config-sample.json"
+		conf, err := Load("", getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Plans).ToNot(BeEmpty())
+	})
+
+	It("fails when the named file is missing", func() {
+		_, err := Load("missing.json", getenv)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("does without config.json when it is missing", func() {
+		dir, err := ioutil.TempDir("", "config-test")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		wd, err := os.Getwd()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.Chdir(dir)).To(Succeed())
+		defer os.Chdir(wd)
+
+		env["EC2_BROKER_REGION"] = "us-west-2"
+		conf, err := Load("", getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Region).To(Equal("us-west-2"))
+		Expect(conf.StateFile).To(Equal(DefaultStateFile))
+	})
+
+	It("lets environment variables override the file", func() {
+		env["EC2_BROKER_USERNAME"] = "env-user"
+		env["EC2_BROKER_PASSWORD"] = `pass"word`
+		env["EC2_BROKER_DISCOVERY_TTL_SECONDS"] = "60"
+		env["EC2_BROKER_TERMINATE_ORPHANS"] = "true"
+		env["EC2_BROKER_TAG_POLICY"] = `{"required_keys": ["team"]}`
+		conf, err := Load("../config-sample.json", getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.BrokerUsername).To(Equal("env-user"))
+		Expect(conf.BrokerPassword).To(Equal(`pass"word`))
+		Expect(conf.DiscoveryTTLSeconds).To(Equal(60))
+		Expect(conf.TerminateOrphans).To(BeTrue())
+		Expect(conf.TagPolicy.RequiredKeys).To(Equal([]string{"team"}))
+		Expect(conf.ServiceName).To(Equal("ec2-service"))
+	})
+
+	It("replaces the file's plans with those of EC2_BROKER_PLANS", func() {
+		file, err := Load("../config-sample.json", getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(file.Plans[0].AllowedAMIs).ToNot(BeEmpty())
+
+		env["EC2_BROKER_PLANS"] = `[{"id": "env-plan", "name": "env", "instance_type": "t2.nano"}]`
+		conf, err := Load("../config-sample.json", getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Plans).To(Equal([]PlanConfig{{ID: "env-plan", Name: "env", InstanceType: "t2.nano"}}))
+	})
+
+	It("replaces the file's plans with those of the user-provided service's credentials", func() {
+		env["VCAP_SERVICES"] = `{"user-provided": [{"name": "ec2-broker-config", "credentials": {"Plans": [{"id": "vcap-plan"}]}}]}`
+		conf, err := Load("../config-sample.json", getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Plans).To(Equal([]PlanConfig{{ID: "vcap-plan"}}))
+		Expect(conf.ServiceName).To(Equal("ec2-service"))
+	})
+
+	It("names the environment variable holding a bad value", func() {
+		env["EC2_BROKER_ORPHAN_GRACE_SECONDS"] = "an hour"
+		_, err := Load("../config-sample.json", getenv)
+		Expect(err).To(MatchError(ContainSubstring("EC2_BROKER_ORPHAN_GRACE_SECONDS")))
+	})
+
+	It("lets the user-provided service's credentials override everything else", func() {
+		env["EC2_BROKER_PASSWORD"] = "env-password"
+		env["VCAP_SERVICES"] = `{"user-provided": [
+			{"name": "something-else", "credentials": {"broker_password": "wrong"}},
+			{"name": "broker-settings", "tags": ["ec2-broker-config"],
+			 "credentials": {"broker_password": "vcap-password", "regoin": "us-west-2"}}
+		]}`
+		conf, err := Load("../config-sample.json", getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.BrokerPassword).To(Equal("vcap-password"))
+		err = conf.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("VCAP_SERVICES.user-provided[1].credentials.regoin"))
+	})
+
+	It("finds the user-provided service EC2_BROKER_VCAP_SERVICE names", func() {
+		env["EC2_BROKER_VCAP_SERVICE"] = "broker-settings"
+		env["VCAP_SERVICES"] = `{"user-provided": [{"name": "broker-settings", "credentials": {"tag_prefix": "vcap"}}]}`
+		conf, err := Load("../config-sample.json", getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.TagPrefix).To(Equal("vcap"))
+	})
+
+	It("fails when VCAP_SERVICES is not JSON", func() {
+		env["VCAP_SERVICES"] = "{"
+		_, err := Load(filepath.Join("..", "config-sample.json"), getenv)
+		Expect(err).To(MatchError(ContainSubstring("VCAP_SERVICES")))
+	})
+})
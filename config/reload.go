@@ -0,0 +1,154 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+/*
+DefaultReloadPollInterval is how often a Reloader looks for changes to the configuration file
+*/
+const DefaultReloadPollInterval = 10 * time.Second
+
+/*
+Reloader reloads the configuration on SIGHUP and whenever the configuration file changes. A reloaded configuration only
+replaces the current one once it validates and passes Check; otherwise the current configuration stays in force.
+Configurations already handed out are never changed, so requests in flight finish with the one they started with.
+*/
+type Reloader struct {
+	Filename     string
+	Getenv       func(string) string
+	Check        func(*Config) error
+	PollInterval time.Duration
+	mutex        sync.Mutex
+	modTime      time.Time
+}
+
+// The fields that cannot change while the broker runs: the AWS session, the broker's credentials and its store are set
+// up from them at startup, and tokens and tags already handed out depend on them
+var restartFields = []struct {
+	key   string
+	value func(*Config) string
+}{
+	{"region", func(c *Config) string { return c.Region }},
+	{"broker_username", func(c *Config) string { return c.BrokerUsername }},
+	{"broker_password", func(c *Config) string { return c.BrokerPassword }},
+	{"operation_secret", func(c *Config) string { return c.OperationSecret }},
+	{"tag_prefix", func(c *Config) string { return c.TagPrefix }},
+	{"state_file", func(c *Config) string { return c.StateFile }},
+}
+
+/*
+NewReloader creates a reloader loading the configuration as Load does, from the given file and environment
+*/
+func NewReloader(filename string, getenv func(string) string) *Reloader {
+	r := &Reloader{Filename: filename, Getenv: getenv, PollInterval: DefaultReloadPollInterval}
+	r.modTime, _ = r.fileModTime()
+	return r
+}
+
+/*
+Reload loads the configuration again and makes it current if it is sound, returning why it was rejected otherwise
+*/
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	logger := GetLogger().Session("config-reload")
+	loaded, err := load(r.Filename, r.Getenv)
+	if err == nil {
+		err = loaded.Validate()
+	}
+	if err == nil {
+		err = restartRequired(GetConfiguration(), loaded)
+	}
+	if err == nil && r.Check != nil {
+		err = r.Check(loaded)
+	}
+	if err != nil {
+		logger.Error("rejected", err)
+		return err
+	}
+	SetConfiguration(loaded)
+	logger.Info("applied", lager.Data{"services": len(loaded.ServiceConfigs())})
+	return nil
+}
+
+/*
+Watch reloads the configuration on SIGHUP, and when the configuration file's modification time changes, until stop is
+closed
+*/
+func (r *Reloader) Watch(stop <-chan struct{}) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	ticker := time.NewTicker(r.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangups:
+			r.Reload()
+		case <-ticker.C:
+			if r.fileChanged() {
+				r.Reload()
+			}
+		}
+	}
+}
+
+// Whether the configuration file's modification time differs from when it was last seen, which is then updated
+func (r *Reloader) fileChanged() bool {
+	modTime, err := r.fileModTime()
+	if err != nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if modTime.Equal(r.modTime) {
+		return false
+	}
+	r.modTime = modTime
+	return true
+}
+
+// The modification time of the configuration file
+func (r *Reloader) fileModTime() (time.Time, error) {
+	filename, _ := configFile(r.Filename, r.Getenv)
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Reports the fields that differ between the configurations but can only change with a restart
+func restartRequired(current, loaded *Config) error {
+	errs := ValidationErrors{}
+	for _, field := range restartFields {
+		if field.value(current) != field.value(loaded) {
+			errs = append(errs, ValidationError{Path: "$." + field.key, Message: "cannot change without a restart"})
+		}
+	}
+	// Services may come and go, but those that stay must keep finding their instances
+	if len(loaded.Services) > 0 {
+		for i, service := range loaded.ServiceConfigs() {
+			if before, err := current.ForService(service.ID); err == nil && before.TagPrefix != service.TagPrefix {
+				errs = append(errs, ValidationError{
+					Path:    fmt.Sprintf("$.services[%d].tag_prefix", i),
+					Message: fmt.Sprintf("of service %s cannot change without a restart", service.ID),
+				})
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,79 @@
+package config_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/GSA/ec2-broker/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reloader", func() {
+	var (
+		dir      string
+		path     string
+		sample   string
+		reloader *Reloader
+	)
+
+	write := func(data string) {
+		Expect(ioutil.WriteFile(path, []byte(data), 0600)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config-test")
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadFile("../config-sample.json")
+		Expect(err).ToNot(HaveOccurred())
+		sample = string(data)
+		path = filepath.Join(dir, "config.json")
+		write(sample)
+		getenv := func(string) string { return "" }
+		_, err = Load(path, getenv)
+		Expect(err).ToNot(HaveOccurred())
+		reloader = NewReloader(path, getenv)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("swaps in a sound configuration, leaving the one handed out before unchanged", func() {
+		before := GetConfiguration()
+		write(strings.Replace(sample, `"ec2-service"`, `"ec2-reloaded"`, 1))
+		Expect(reloader.Reload()).To(Succeed())
+		Expect(GetConfiguration().ServiceName).To(Equal("ec2-reloaded"))
+		Expect(before.ServiceName).To(Equal("ec2-service"))
+	})
+
+	It("keeps the current configuration when the new one is invalid", func() {
+		write(strings.Replace(sample, `"t2.micro"`, `"micro"`, 1))
+		Expect(reloader.Reload()).To(MatchError(ContainSubstring("instance_type")))
+		Expect(GetConfiguration().Plans[0].InstanceType).To(Equal("t2.micro"))
+	})
+
+	It("keeps the current configuration when the file cannot be read", func() {
+		write("{")
+		Expect(reloader.Reload()).ToNot(Succeed())
+		Expect(GetConfiguration().ServiceName).To(Equal("ec2-service"))
+	})
+
+	It("refuses changes that need a restart", func() {
+		write(strings.Replace(sample, `"us-east-1"`, `"us-west-2"`, 1))
+		Expect(reloader.Reload()).To(MatchError(ContainSubstring("$.region: cannot change without a restart")))
+		Expect(GetConfiguration().Region).To(Equal("us-east-1"))
+	})
+
+	It("refuses configurations its check rejects", func() {
+		reloader.Check = func(*Config) error { return errors.New("plan in use") }
+		write(strings.Replace(sample, `"ec2-service"`, `"ec2-reloaded"`, 1))
+		Expect(reloader.Reload()).To(MatchError("plan in use"))
+		Expect(GetConfiguration().ServiceName).To(Equal("ec2-service"))
+	})
+})
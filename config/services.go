@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+)
+
+/*
+ServiceConfigs lists the services the broker offers: those in Services, with the broker's key pair and tag prefix filled in
+where they set none, or the single service configured at the top level. The plans are shared with the configuration.
+*/
+func (c *Config) ServiceConfigs() []ServiceConfig {
+	if len(c.Services) == 0 {
+		return []ServiceConfig{{
+			ID:          c.ServiceID,
+			Name:        c.ServiceName,
+			Description: c.ServiceDescription,
+			Metadata:    c.ServiceMetadata,
+			KeyPairName: c.KeyPairName,
+			TagPrefix:   c.TagPrefix,
+			Plans:       c.Plans,
+		}}
+	}
+	services := make([]ServiceConfig, len(c.Services))
+	for i, service := range c.Services {
+		if service.KeyPairName == "" {
+			service.KeyPairName = c.KeyPairName
+		}
+		if service.TagPrefix == "" {
+			service.TagPrefix = c.TagPrefix
+		}
+		services[i] = service
+	}
+	return services
+}
+
+/*
+FindPlan finds a plan by ID, along with the service it belongs to. Plan IDs are unique across services.
+*/
+func (c *Config) FindPlan(planID string) (*ServiceConfig, *PlanConfig, error) {
+	services := c.ServiceConfigs()
+	for i := range services {
+		for j := range services[i].Plans {
+			if services[i].Plans[j].ID == planID {
+				return &services[i], &services[i].Plans[j], nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("Unable to find plan in configuration: %s", planID)
+}
+
+/*
+ForService narrows the configuration to one service: the copy returned describes that service alone at the top level,
+with its plans, key pair and tag prefix, so code working on the service's instances can use it as it would a single
+service configuration
+*/
+func (c *Config) ForService(serviceID string) (*Config, error) {
+	for _, service := range c.ServiceConfigs() {
+		if service.ID != serviceID {
+			continue
+		}
+		narrowed := *c
+		narrowed.ServiceID = service.ID
+		narrowed.ServiceName = service.Name
+		narrowed.ServiceDescription = service.Description
+		narrowed.ServiceMetadata = service.Metadata
+		narrowed.KeyPairName = service.KeyPairName
+		narrowed.TagPrefix = service.TagPrefix
+		narrowed.Plans = service.Plans
+		narrowed.Services = nil
+		return &narrowed, nil
+	}
+	return nil, fmt.Errorf("Unable to find service in configuration: %s", serviceID)
+}
+
+/*
+TagPrefixes lists the distinct tag prefixes of the broker's services, which between them mark every instance it launches
+*/
+func (c *Config) TagPrefixes() []string {
+	prefixes := []string{}
+	for _, service := range c.ServiceConfigs() {
+		if !stringIn(service.TagPrefix, prefixes) {
+			prefixes = append(prefixes, service.TagPrefix)
+		}
+	}
+	return prefixes
+}
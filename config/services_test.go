@@ -0,0 +1,92 @@
+package config_test
+
+import (
+	. "github.com/GSA/ec2-broker/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Services", func() {
+	var conf *Config
+
+	BeforeEach(func() {
+		conf = &Config{
+			KeyPairName: "shared-key",
+			TagPrefix:   "cg:",
+			Services: []ServiceConfig{
+				{ID: "compute-id", Name: "compute", Plans: []PlanConfig{{ID: "micro-id", Name: "micro"}}},
+				{ID: "batch-id", Name: "batch", KeyPairName: "batch-key", TagPrefix: "batch:", Plans: []PlanConfig{{ID: "large-id", Name: "large"}}},
+			},
+		}
+	})
+
+	It("treats a single service configuration as one service", func() {
+		legacy := &Config{ServiceID: "service-id", ServiceName: "ec2", TagPrefix: "cg:", Plans: []PlanConfig{{ID: "micro-id"}}}
+		services := legacy.ServiceConfigs()
+		Expect(services).To(HaveLen(1))
+		Expect(services[0].ID).To(Equal("service-id"))
+		Expect(services[0].TagPrefix).To(Equal("cg:"))
+		Expect(services[0].Plans).To(HaveLen(1))
+	})
+
+	It("gives services the broker's key pair and tag prefix unless they set their own", func() {
+		services := conf.ServiceConfigs()
+		Expect(services[0].KeyPairName).To(Equal("shared-key"))
+		Expect(services[0].TagPrefix).To(Equal("cg:"))
+		Expect(services[1].KeyPairName).To(Equal("batch-key"))
+		Expect(services[1].TagPrefix).To(Equal("batch:"))
+		Expect(conf.TagPrefixes()).To(Equal([]string{"cg:", "batch:"}))
+	})
+
+	It("finds plans in whichever service they belong to", func() {
+		service, plan, err := conf.FindPlan("large-id")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(service.ID).To(Equal("batch-id"))
+		Expect(plan.Name).To(Equal("large"))
+		_, _, err = conf.FindPlan("unknown-id")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("narrows the configuration to one service", func() {
+		narrowed, err := conf.ForService("batch-id")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(narrowed.ServiceName).To(Equal("batch"))
+		Expect(narrowed.TagPrefix).To(Equal("batch:"))
+		Expect(narrowed.KeyPairName).To(Equal("batch-key"))
+		Expect(narrowed.Services).To(BeEmpty())
+		Expect(narrowed.ServiceConfigs()).To(HaveLen(1))
+		_, _, err = narrowed.FindPlan("micro-id")
+		Expect(err).To(HaveOccurred())
+		Expect(conf.TagPrefix).To(Equal("cg:"))
+	})
+
+	Describe("validation", func() {
+		BeforeEach(func() {
+			conf.Region, conf.BrokerUsername, conf.BrokerPassword, conf.OperationSecret = "us-east-1", "user", "password", "secret"
+			for i := range conf.Services {
+				plan := &conf.Services[i].Plans[0]
+				plan.InstanceType = "t2.micro"
+				plan.AllowedAMIs = []string{"ami-0123456789abcdef0"}
+				plan.AllowedSubnets = []string{"subnet-0123456789abcdef0"}
+				plan.AllowedSecurityGroups = []string{"sg-0123456789abcdef0"}
+			}
+		})
+
+		It("accepts several services", func() {
+			Expect(conf.Validate()).To(Succeed())
+		})
+
+		It("requires plan IDs to be unique across services, and names only within one", func() {
+			conf.Services[1].Plans[0].ID = "micro-id"
+			conf.Services[1].Plans[0].Name = "micro"
+			Expect(paths(conf.Validate())).To(ConsistOf("$.services[1].plans[0].id"))
+		})
+
+		It("refuses services alongside a single service's fields", func() {
+			conf.ServiceID = "service-id"
+			conf.Services[0].Name = ""
+			Expect(paths(conf.Validate())).To(ConsistOf("$.services", "$.services[0].name"))
+		})
+	})
+})
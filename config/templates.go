@@ -0,0 +1,42 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+/*
+UserDataTemplateFuncs are the functions a plan's user data template can call to quote the values users choose, such as
+instance names, for the place they are written to: shellquote makes a single quoted shell word, and yamlquote a double
+quoted YAML scalar for cloud-config
+*/
+var UserDataTemplateFuncs = template.FuncMap{
+	"shellquote": ShellQuote,
+	"yamlquote":  YAMLQuote,
+}
+
+/*
+ParseUserDataTemplate parses a plan's user data template with UserDataTemplateFuncs
+*/
+func ParseUserDataTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(UserDataTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+/*
+ShellQuote quotes a value as a single shell word. A single quote can't appear inside single quotes, so each one closes
+the quoting, is escaped, and reopens it.
+*/
+func ShellQuote(value interface{}) string {
+	return "'" + strings.Replace(fmt.Sprint(value), "'", `'\''`, -1) + "'"
+}
+
+/*
+YAMLQuote quotes a value as a double quoted YAML scalar. JSON strings are valid YAML, and escape every quote, backslash
+and control character.
+*/
+func YAMLQuote(value interface{}) string {
+	data, _ := json.Marshal(fmt.Sprint(value))
+	return string(data)
+}
@@ -0,0 +1,372 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+ValidationError is a problem with the configuration, at the JSON path of the offending field
+*/
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+/*
+Error gives the path and the problem found there
+*/
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+/*
+ValidationErrors lists every problem found with a configuration
+*/
+type ValidationErrors []ValidationError
+
+/*
+Error lists the problems one per line
+*/
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return fmt.Sprintf("%d configuration problem(s):\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// The shapes AWS gives resource IDs and instance types
+var (
+	amiIDPattern         = regexp.MustCompile(`^ami-[0-9a-f]{8,17}$`)
+	subnetIDPattern      = regexp.MustCompile(`^subnet-[0-9a-f]{8,17}$`)
+	securityGroupPattern = regexp.MustCompile(`^sg-[0-9a-f]{8,17}$`)
+	instanceTypePattern  = regexp.MustCompile(`^[a-z][a-z0-9-]*\.[a-z0-9]+$`)
+)
+
+// The EBS volume types a volume policy may allow
+var volumeTypes = []string{"standard", "gp2", "io1", "st1", "sc1"}
+
+/*
+Validate checks the configuration, returning ValidationErrors naming every problem found, or nil. Fields in the file that
+the broker does not know are problems too, since they are usually misspelled.
+*/
+func (c *Config) Validate() error {
+	errs := append(ValidationErrors{}, c.unknownFields...)
+	add := func(path, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	required := map[string]string{
+		"region":           c.Region,
+		"broker_username":  c.BrokerUsername,
+		"broker_password":  c.BrokerPassword,
+		"operation_secret": c.OperationSecret,
+	}
+	// keypair_name is not among them: bindings install their own keys, and instances launch without a key pair when
+	// none is named
+	for _, field := range []string{"region", "broker_username", "broker_password", "operation_secret"} {
+		if required[field] == "" {
+			add("$."+field, "is required")
+		}
+	}
+	// Operation tokens must not be forgeable by whoever holds the broker's credentials
+	if c.OperationSecret != "" && c.OperationSecret == c.BrokerPassword {
+		add("$.operation_secret", "must differ from broker_password")
+	}
+	if c.DiscoveryTTLSeconds < 0 {
+		add("$.discovery_ttl_seconds", "cannot be negative")
+	}
+	if c.OrphanGraceSeconds < 0 {
+		add("$.orphan_grace_seconds", "cannot be negative")
+	}
+	if c.TagPolicy.KeyPattern != "" {
+		if _, err := regexp.Compile(c.TagPolicy.KeyPattern); err != nil {
+			add("$.tag_policy.key_pattern", "is not a valid regular expression: %s", err)
+		}
+	}
+	if c.TagPolicy.MaxTags < 0 {
+		add("$.tag_policy.max_tags", "cannot be negative")
+	}
+	// Plan IDs must be unique across the catalog, names only within their service
+	planIDs := map[string]bool{}
+	validatePlans := func(path string, plans []PlanConfig) {
+		if len(plans) == 0 {
+			add(path, "at least one plan is required")
+		}
+		planNames := map[string]bool{}
+		for i := range plans {
+			plan := &plans[i]
+			planPath := fmt.Sprintf("%s[%d]", path, i)
+			if plan.ID == "" {
+				add(planPath+".id", "is required")
+			} else if planIDs[plan.ID] {
+				add(planPath+".id", "duplicates the id of another plan: %s", plan.ID)
+			}
+			planIDs[plan.ID] = true
+			if plan.Name == "" {
+				add(planPath+".name", "is required")
+			} else if planNames[plan.Name] {
+				add(planPath+".name", "duplicates the name of another plan: %s", plan.Name)
+			}
+			planNames[plan.Name] = true
+			errs = append(errs, plan.validate(planPath)...)
+		}
+	}
+	if len(c.Services) == 0 {
+		if c.ServiceID == "" {
+			add("$.service_id", "is required")
+		}
+		if c.ServiceName == "" {
+			add("$.service_name", "is required")
+		}
+		errs = append(errs, c.ServiceMetadata.validate("$.service_metadata")...)
+		validatePlans("$.plans", c.Plans)
+	} else {
+		// The single service fields would otherwise be silently ignored
+		if c.ServiceID != "" || c.ServiceName != "" || c.ServiceDescription != "" || c.ServiceMetadata != (ServiceMetadata{}) || len(c.Plans) > 0 {
+			add("$.services", "cannot be used along with service_id, service_name, service_description, service_metadata and plans; move them into a service")
+		}
+		serviceIDs, serviceNames := map[string]bool{}, map[string]bool{}
+		for i, service := range c.Services {
+			path := fmt.Sprintf("$.services[%d]", i)
+			if service.ID == "" {
+				add(path+".id", "is required")
+			} else if serviceIDs[service.ID] {
+				add(path+".id", "duplicates the id of another service: %s", service.ID)
+			}
+			serviceIDs[service.ID] = true
+			if service.Name == "" {
+				add(path+".name", "is required")
+			} else if serviceNames[service.Name] {
+				add(path+".name", "duplicates the name of another service: %s", service.Name)
+			}
+			serviceNames[service.Name] = true
+			errs = append(errs, service.Metadata.validate(path+".metadata")...)
+			validatePlans(path+".plans", service.Plans)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Checks a plan, whose fields are under the given path
+func (plan *PlanConfig) validate(path string) ValidationErrors {
+	errs := ValidationErrors{}
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path + field, Message: fmt.Sprintf(format, args...)})
+	}
+	if plan.InstanceType == "" {
+		add(".instance_type", "is required")
+	} else if !instanceTypePattern.MatchString(plan.InstanceType) {
+		add(".instance_type", "is not an EC2 instance type: %s", plan.InstanceType)
+	}
+	if len(plan.AllowedAMIs) == 0 && len(plan.AMISelector) == 0 && len(plan.ImageFamilies) == 0 {
+		add(".allowed_amis", "no AMIs are allowed; list some, or set ami_selector or image_families")
+	}
+	if len(plan.AllowedSubnets) == 0 && len(plan.SubnetSelector) == 0 {
+		add(".allowed_subnets", "no subnets are allowed; list some, or set subnet_selector")
+	}
+	if len(plan.AllowedSecurityGroups) == 0 && len(plan.SecurityGroupSelector) == 0 {
+		add(".allowed_security_groups", "no security groups are allowed; list some, or set security_group_selector")
+	}
+	for i, id := range plan.AllowedAMIs {
+		if !amiIDPattern.MatchString(id) {
+			add(fmt.Sprintf(".allowed_amis[%d]", i), "is not an AMI ID: %s", id)
+		}
+	}
+	for i, id := range plan.AllowedSubnets {
+		if !subnetIDPattern.MatchString(id) {
+			add(fmt.Sprintf(".allowed_subnets[%d]", i), "is not a subnet ID: %s", id)
+		}
+	}
+	for i, id := range plan.AllowedSecurityGroups {
+		if !securityGroupPattern.MatchString(id) {
+			add(fmt.Sprintf(".allowed_security_groups[%d]", i), "is not a security group ID: %s", id)
+		}
+	}
+	families := map[string]bool{}
+	for i, family := range plan.ImageFamilies {
+		familyPath := fmt.Sprintf(".image_families[%d]", i)
+		if family.Name == "" {
+			add(familyPath+".name", "is required")
+		} else if families[family.Name] {
+			add(familyPath+".name", "duplicates the name of another image family: %s", family.Name)
+		}
+		families[family.Name] = true
+		if len(family.Owners) == 0 {
+			add(familyPath+".owners", "at least one owner is required")
+		}
+	}
+	if plan.Volumes != nil {
+		if len(plan.Volumes.AllowedTypes) == 0 {
+			add(".volumes.allowed_types", "at least one volume type is required")
+		}
+		for i, volumeType := range plan.Volumes.AllowedTypes {
+			if !stringIn(volumeType, volumeTypes) {
+				add(fmt.Sprintf(".volumes.allowed_types[%d]", i), "is not an EBS volume type: %s", volumeType)
+			}
+		}
+		// A zero limit would refuse every volume; plans without data volumes leave out the policy instead
+		if plan.Volumes.MaxSizeGB < 1 {
+			add(".volumes.max_size_gb", "must be at least 1")
+		}
+		if plan.Volumes.MaxCount < 1 {
+			add(".volumes.max_count", "must be at least 1")
+		}
+		if stringIn("io1", plan.Volumes.AllowedTypes) && plan.Volumes.MaxIOPS < 1 {
+			add(".volumes.max_iops", "must be at least 1 when io1 volumes are allowed")
+		} else if plan.Volumes.MaxIOPS < 0 {
+			add(".volumes.max_iops", "cannot be negative")
+		}
+	}
+	if plan.UserDataTemplate != "" {
+		if _, err := ParseUserDataTemplate("user_data", plan.UserDataTemplate); err != nil {
+			add(".user_data_template", "is not a valid template: %s", err)
+		}
+	}
+	if plan.MaxUserDataBytes < 0 {
+		add(".max_user_data_bytes", "cannot be negative")
+	}
+	if _, known := InstanceSpecs(plan.InstanceType); plan.Metadata.InstanceSpecs && instanceTypePattern.MatchString(plan.InstanceType) && !known {
+		add(".metadata.instance_specs", "the specs of instance type %s are not known; list them in bullets instead", plan.InstanceType)
+	}
+	for i, cost := range plan.Metadata.Costs {
+		costPath := fmt.Sprintf(".metadata.costs[%d]", i)
+		if cost.Unit == "" {
+			add(costPath+".unit", "is required")
+		}
+		if len(cost.Amount) == 0 {
+			add(costPath+".amount", "at least one currency is required")
+		}
+		currencies := make([]string, 0, len(cost.Amount))
+		for currency := range cost.Amount {
+			currencies = append(currencies, currency)
+		}
+		sort.Strings(currencies)
+		for _, currency := range currencies {
+			if cost.Amount[currency] < 0 {
+				add(costPath+".amount."+currency, "cannot be negative")
+			}
+		}
+	}
+	return errs
+}
+
+// Checks the marketplace metadata of a service, whose fields are under the given path
+func (metadata ServiceMetadata) validate(path string) ValidationErrors {
+	errs := ValidationErrors{}
+	urls := []struct {
+		field   string
+		value   string
+		schemes []string
+	}{
+		{".image_url", metadata.ImageURL, []string{"http", "https", "data"}},
+		{".documentation_url", metadata.DocumentationURL, []string{"http", "https"}},
+		{".support_url", metadata.SupportURL, []string{"http", "https"}},
+	}
+	for _, u := range urls {
+		if u.value == "" {
+			continue
+		}
+		parsed, err := url.Parse(u.value)
+		if err != nil || !stringIn(parsed.Scheme, u.schemes) || (parsed.Scheme != "data" && parsed.Host == "") {
+			errs = append(errs, ValidationError{Path: path + u.field, Message: fmt.Sprintf("is not an absolute %s URL: %s", strings.Join(u.schemes, " or "), u.value)})
+		}
+	}
+	return errs
+}
+
+// Whether the list holds s
+func stringIn(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the fields in a JSON document that have no counterpart in the type it is decoded into
+func findUnknownFields(data []byte, t reflect.Type) ValidationErrors {
+	var document interface{}
+	if json.Unmarshal(data, &document) != nil {
+		return nil
+	}
+	errs := ValidationErrors{}
+	walkUnknownFields("$", document, t, &errs)
+	return errs
+}
+
+// The key a struct field is encoded under, and whether it is encoded at all
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" || field.PkgPath != "" {
+		return "", false
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
+
+// The type of the field a key decodes into. Keys match fields regardless of case, as encoding/json matches them, though
+// an exact match comes first.
+func matchField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if t, ok := fields[key]; ok {
+		return t, true
+	}
+	for name, t := range fields {
+		if strings.EqualFold(name, key) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// Compares a decoded JSON value with the type it is decoded into, adding the unknown fields of objects to errs
+func walkUnknownFields(path string, value interface{}, t reflect.Type, errs *ValidationErrors) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			if name, ok := jsonFieldName(t.Field(i)); ok {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldType, ok := matchField(fields, key)
+			if !ok {
+				*errs = append(*errs, ValidationError{Path: path + "." + key, Message: "is not a known field"})
+				continue
+			}
+			walkUnknownFields(path+"."+key, object[key], fieldType, errs)
+		}
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+		for i, item := range list {
+			walkUnknownFields(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), errs)
+		}
+	}
+}
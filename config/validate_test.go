@@ -0,0 +1,154 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/GSA/ec2-broker/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The paths of the problems in a validation error
+func paths(err error) []string {
+	Expect(err).To(HaveOccurred())
+	errs, ok := err.(ValidationErrors)
+	Expect(ok).To(BeTrue())
+	found := []string{}
+	for _, e := range errs {
+		found = append(found, e.Path)
+	}
+	return found
+}
+
+var _ = Describe("Validate", func() {
+	var conf *Config
+
+	BeforeEach(func() {
+		var err error
+		conf, err = LoadConfiguration("../config-sample.json")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("accepts the sample configuration", func() {
+		Expect(conf.Validate()).To(Succeed())
+	})
+
+	It("reports every problem at once", func() {
+		conf.ServiceID = ""
+		conf.Plans[1].ID = conf.Plans[0].ID
+		conf.Plans[0].InstanceType = "micro"
+		conf.Plans[0].AllowedSubnets = nil
+		conf.Plans[1].AllowedAMIs = []string{"ami-1"}
+		Expect(paths(conf.Validate())).To(ConsistOf(
+			"$.service_id",
+			"$.plans[1].id",
+			"$.plans[0].instance_type",
+			"$.plans[0].allowed_subnets",
+			"$.plans[1].allowed_amis[0]",
+		))
+	})
+
+	It("accepts an empty keypair_name, since bindings install their own keys", func() {
+		conf.KeyPairName = ""
+		for i := range conf.Services {
+			conf.Services[i].KeyPairName = ""
+		}
+		Expect(conf.Validate()).To(Succeed())
+	})
+
+	It("rejects zero volume limits, which would refuse every volume", func() {
+		conf.Plans[1].Volumes.MaxSizeGB = 0
+		conf.Plans[1].Volumes.MaxCount = 0
+		conf.Plans[1].Volumes.MaxIOPS = 0
+		Expect(paths(conf.Validate())).To(ConsistOf(
+			"$.plans[1].volumes.max_size_gb",
+			"$.plans[1].volumes.max_count",
+			"$.plans[1].volumes.max_iops",
+		))
+	})
+
+	It("only requires max_iops of plans allowing io1 volumes", func() {
+		conf.Plans[1].Volumes.AllowedTypes = []string{"gp2"}
+		conf.Plans[1].Volumes.MaxIOPS = 0
+		Expect(conf.Validate()).To(Succeed())
+		conf.Plans[1].Volumes.MaxIOPS = -1
+		Expect(paths(conf.Validate())).To(ConsistOf("$.plans[1].volumes.max_iops"))
+	})
+
+	It("accepts user data templates quoting with the template functions", func() {
+		conf.Plans[0].UserDataTemplate = "#!/bin/sh\nhostname {{shellquote .UserSupplied.InstanceName}}\n"
+		Expect(conf.Validate()).To(Succeed())
+		conf.Plans[0].UserDataTemplate = "#!/bin/sh\nhostname {{quote .UserSupplied.InstanceName}}\n"
+		Expect(paths(conf.Validate())).To(ConsistOf("$.plans[0].user_data_template"))
+	})
+
+	It("requires an operation secret of its own", func() {
+		conf.OperationSecret = ""
+		Expect(paths(conf.Validate())).To(ConsistOf("$.operation_secret"))
+
+		conf.OperationSecret = conf.BrokerPassword
+		Expect(paths(conf.Validate())).To(ConsistOf("$.operation_secret"))
+	})
+
+	It("checks the marketplace metadata", func() {
+		conf.ServiceMetadata.SupportURL = "support.example.com"
+		conf.Plans[0].InstanceType = "x9.huge"
+		conf.Plans[0].Metadata = PlanMetadata{InstanceSpecs: true, Costs: []PlanCost{{Amount: map[string]float64{"usd": -1}}}}
+		Expect(paths(conf.Validate())).To(ConsistOf(
+			"$.service_metadata.support_url",
+			"$.plans[0].metadata.instance_specs",
+			"$.plans[0].metadata.costs[0].unit",
+			"$.plans[0].metadata.costs[0].amount.usd",
+		))
+	})
+
+	It("knows the specs of common instance types", func() {
+		spec, ok := InstanceSpecs("c4.large")
+		Expect(ok).To(BeTrue())
+		Expect(spec.Bullets()).To(Equal([]string{"2 vCPUs", "3.75 GiB memory"}))
+		_, ok = InstanceSpecs("x9.huge")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("accepts plans allowing resources by selector instead of by ID", func() {
+		conf.Plans[0].AllowedSubnets = nil
+		conf.Plans[0].SubnetSelector = map[string]string{"cg:ec2broker:plan": "micro"}
+		Expect(conf.Validate()).To(Succeed())
+	})
+
+	It("reports fields it does not know", func() {
+		dir, err := ioutil.TempDir("", "config-test")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		data, err := ioutil.ReadFile("../config-sample.json")
+		Expect(err).ToNot(HaveOccurred())
+		data = []byte(`{"regoin": "us-west-2",` + string(data[1:]))
+		path := filepath.Join(dir, "config.json")
+		Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+
+		conf, err = LoadConfiguration(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(paths(conf.Validate())).To(ContainElement("$.regoin"))
+	})
+
+	It("knows fields whatever their case, as they are decoded", func() {
+		dir, err := ioutil.TempDir("", "config-test")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		data, err := ioutil.ReadFile("../config-sample.json")
+		Expect(err).ToNot(HaveOccurred())
+		data = []byte(strings.Replace(string(data), `"max_tags": 10`, `"MAX_TAGS": 5`, 1))
+		data = []byte(`{"Dashboard_URL": "https://dashboard.example.com",` + string(data[1:]))
+		path := filepath.Join(dir, "config.json")
+		Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+
+		conf, err = LoadConfiguration(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.TagPolicy.MaxTags).To(Equal(5))
+		Expect(conf.Validate()).To(Succeed())
+	})
+})
@@ -7,18 +7,26 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
 
 	"github.com/GSA/ec2-broker/broker"
 	"github.com/GSA/ec2-broker/config"
+	"github.com/GSA/ec2-broker/metrics"
+	"github.com/GSA/ec2-broker/store"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(validateConfig(os.Args[2:]))
+	}
 	logger := config.GetLogger()
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
 	port := os.Getenv("PORT")
@@ -26,29 +34,66 @@ func main() {
 		port = "8000"
 	}
 	// Bail out if we either cannot read our configuration or connect to AWS
-	conf, err := config.LoadConfiguration("config.json")
+	configFile := flag.String("config", "", "the configuration file (EC2_BROKER_CONFIG, or config.json if it exists, by default)")
+	flag.Parse()
+	conf, err := config.Load(*configFile, os.Getenv)
+	if err == nil {
+		err = conf.Validate()
+	}
+	if err != nil {
+		logger.Fatal("loading-broker", err, nil)
+		return
+	}
+
+	s, err := store.NewFileStore(conf.StateFile)
+	if err != nil {
+		logger.Fatal("loading-store", err, lager.Data{"state_file": conf.StateFile})
+		return
+	}
+
+	// The broker starts under the same check a reload is held to, so a restart cannot drop a plan instances still use
+	plansInUse := broker.PlansInUse(s)
+	err = plansInUse(conf)
 	if err != nil {
 		logger.Fatal("loading-broker", err, nil)
 		return
 	}
 
-	m, err := broker.NewAWSManager()
+	m, err := broker.NewAWSManager(s)
 	if err != nil {
 		logger.Fatal("loading-aws-session", err, nil)
 		return
 	}
 
-	b, err := broker.New("ec2-broker", m)
+	b, err := broker.New("ec2-broker", m, s)
 	if err != nil {
 		logger.Fatal("loading-broker", err, nil)
 		return
 	}
-	// TODO: Remove user/password from configuration file
-	handler := brokerapi.New(b, logger, brokerapi.BrokerCredentials{Username: conf.BrokerUsername, Password: conf.BrokerPassword})
-	s := &http.Server{
+	reconciler := broker.NewReconciler(m, s)
+	go reconciler.Run(nil)
+	reloader := config.NewReloader(*configFile, os.Getenv)
+	reloader.Check = plansInUse
+	go reloader.Watch(nil)
+
+	broker.RegisterInstanceMetrics(s)
+	// The broker API routes are attached without brokerapi.New's own basic auth: credentials below is the one layer
+	// that authenticates every protected endpoint, and it runs before WithPlatformContext reads a request body.
+	router := mux.NewRouter()
+	brokerapi.AttachRoutes(router, broker.InstrumentedBroker{EC2Broker: b}, logger)
+	routes := http.NewServeMux()
+	health := broker.NewHealthChecker(m)
+	routes.HandleFunc("/healthz", health.Liveness)
+	routes.HandleFunc("/readyz", health.Readiness)
+	credentials := auth.NewWrapper(conf.BrokerUsername, conf.BrokerPassword)
+	routes.Handle("/metrics", credentials.Wrap(metrics.DefaultRegistry))
+	routes.Handle("/admin/readiness", credentials.Wrap(http.HandlerFunc(health.ReadinessReport)))
+	routes.Handle("/admin/reconciliation", credentials.Wrap(reconciler))
+	routes.Handle("/", credentials.Wrap(broker.WithPlatformContext(router)))
+	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: handler,
+		Handler: routes,
 	}
 	logger.Info("starting-server", lager.Data{"message": fmt.Sprintf("Starting server on port: %s", port)})
-	logger.Fatal("listening-error", s.ListenAndServe(), nil)
+	logger.Fatal("listening-error", server.ListenAndServe(), nil)
 }
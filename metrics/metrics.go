@@ -0,0 +1,344 @@
+/*
+Package metrics keeps counters, gauges and histograms and serves them in the Prometheus text exposition format.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+DefaultBuckets are the upper bounds, in seconds, of the histogram buckets for request latencies
+*/
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+/*
+Registry holds a set of metrics, along with hooks run before each scrape to bring gauges up to date
+*/
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+	hooks   []func()
+}
+
+// A metric family, written out as a whole
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+/*
+NewRegistry creates an empty registry
+*/
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+/*
+DefaultRegistry is the registry the package level constructors add to
+*/
+var DefaultRegistry = NewRegistry()
+
+/*
+OnCollect adds a hook to run before each scrape of the default registry
+*/
+func OnCollect(hook func()) {
+	DefaultRegistry.OnCollect(hook)
+}
+
+/*
+OnCollect adds a hook to run before each scrape
+*/
+func (r *Registry) OnCollect(hook func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+// Adds a metric to those the registry serves
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+/*
+ServeHTTP runs the collect hooks and writes every metric in the text exposition format
+*/
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mutex.Lock()
+	hooks := append([]func(){}, r.hooks...)
+	metrics := append([]metric{}, r.metrics...)
+	r.mutex.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	sort.Sort(byName(metrics))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(out)
+	}
+	out.Flush()
+}
+
+// Metrics sorted by name, so scrapes list them in a stable order
+type byName []metric
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byName) Less(i, j int) bool { return m[i].name() < m[j].name() }
+
+// The name, help, type and label names shared by every kind of metric, and its series by label values
+type family struct {
+	mutex  sync.Mutex
+	family string
+	help   string
+	kind   string
+	labels []string
+	series map[string][]string
+}
+
+func newFamily(name, help, kind string, labels []string) family {
+	return family{family: name, help: help, kind: kind, labels: labels, series: map[string][]string{}}
+}
+
+func (f *family) name() string {
+	return f.family
+}
+
+// The key of a series, registering its label values the first time it is seen
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, given %d values", f.family, f.labels, len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := f.series[key]; !ok {
+		f.series[key] = append([]string{}, values...)
+	}
+	return key
+}
+
+// The series keys in a stable order
+func (f *family) keys() []string {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *family) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.family, strings.Replace(strings.Replace(f.help, `\`, `\\`, -1), "\n", `\n`, -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.family, f.kind)
+}
+
+// The label set of a series, with any extra label given after the series' own
+func (f *family) labelSet(key string, extra ...string) string {
+	pairs := []string{}
+	for i, value := range f.series[key] {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, f.labels[i], escapeLabel(value)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Escapes a label value as the text exposition format requires
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+// Formats a sample value, writing infinity the way Prometheus expects
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+/*
+Counter is a family of counters that only go up, one for each set of label values
+*/
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+/*
+NewCounter creates a counter in the default registry
+*/
+func NewCounter(name, help string, labels ...string) *Counter {
+	return DefaultRegistry.NewCounter(name, help, labels...)
+}
+
+/*
+NewCounter creates a counter in the registry
+*/
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{family: newFamily(name, help, "counter", labels), values: map[string]float64{}}
+	r.register(c)
+	return c
+}
+
+/*
+Inc adds one to the counter with the given label values
+*/
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+/*
+Add adds a non-negative amount to the counter with the given label values
+*/
+func (c *Counter) Add(amount float64, labelValues ...string) {
+	if amount < 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[c.key(labelValues)] += amount
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.header(w)
+	for _, key := range c.keys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.family.family, c.labelSet(key), formatFloat(c.values[key]))
+	}
+}
+
+/*
+Gauge is a family of values that go up and down, one for each set of label values
+*/
+type Gauge struct {
+	family
+	values map[string]float64
+}
+
+/*
+NewGauge creates a gauge in the default registry
+*/
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help, labels...)
+}
+
+/*
+NewGauge creates a gauge in the registry
+*/
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{family: newFamily(name, help, "gauge", labels), values: map[string]float64{}}
+	r.register(g)
+	return g
+}
+
+/*
+Set sets the gauge with the given label values
+*/
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values[g.key(labelValues)] = value
+}
+
+/*
+Reset drops every series of the gauge, for gauges rebuilt from scratch before each scrape
+*/
+func (g *Gauge) Reset() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values = map[string]float64{}
+	g.series = map[string][]string{}
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.header(w)
+	for _, key := range g.keys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.family.family, g.labelSet(key), formatFloat(g.values[key]))
+	}
+}
+
+/*
+Histogram is a family of histograms counting observations into buckets, one for each set of label values
+*/
+type Histogram struct {
+	family
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+/*
+NewHistogram creates a histogram in the default registry. The buckets are upper bounds in increasing order.
+*/
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return DefaultRegistry.NewHistogram(name, help, buckets, labels...)
+}
+
+/*
+NewHistogram creates a histogram in the registry. The buckets are upper bounds in increasing order.
+*/
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		family:  newFamily(name, help, "histogram", labels),
+		buckets: buckets,
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+		totals:  map[string]uint64{},
+	}
+	r.register(h)
+	return h
+}
+
+/*
+Observe adds a value to the histogram with the given label values
+*/
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := h.key(labelValues)
+	counts, ok := h.counts[key]
+	if !ok {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[key] = counts
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			counts[i]++
+		}
+	}
+	h.sums[key] += value
+	h.totals[key]++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.header(w)
+	for _, key := range h.keys() {
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.family.family, h.labelSet(key, "le", formatFloat(bound)), h.counts[key][i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.family.family, h.labelSet(key, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.family.family, h.labelSet(key), formatFloat(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.family.family, h.labelSet(key), h.totals[key])
+	}
+}
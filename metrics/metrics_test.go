@@ -0,0 +1,70 @@
+package metrics_test
+
+import (
+	"net/http/httptest"
+
+	. "github.com/GSA/ec2-broker/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	var r *Registry
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(recorder.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+		return recorder.Body.String()
+	}
+
+	BeforeEach(func() {
+		r = NewRegistry()
+	})
+
+	It("writes counters by label values", func() {
+		c := r.NewCounter("requests_total", "Requests.", "operation", "outcome")
+		c.Inc("provision", "success")
+		c.Inc("provision", "success")
+		c.Add(3, "provision", "error")
+		Expect(scrape()).To(Equal(`# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{operation="provision",outcome="error"} 3
+requests_total{operation="provision",outcome="success"} 2
+`))
+	})
+
+	It("escapes label values", func() {
+		c := r.NewCounter("errors_total", "Errors.", "message")
+		c.Inc("a \"quoted\"\nvalue")
+		Expect(scrape()).To(ContainSubstring(`errors_total{message="a \"quoted\"\nvalue"} 1`))
+	})
+
+	It("writes cumulative histogram buckets", func() {
+		h := r.NewHistogram("duration_seconds", "Durations.", []float64{0.1, 1}, "operation")
+		h.Observe(0.05, "RunInstances")
+		h.Observe(0.5, "RunInstances")
+		h.Observe(5, "RunInstances")
+		Expect(scrape()).To(Equal(`# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{operation="RunInstances",le="0.1"} 1
+duration_seconds_bucket{operation="RunInstances",le="1"} 2
+duration_seconds_bucket{operation="RunInstances",le="+Inf"} 3
+duration_seconds_sum{operation="RunInstances"} 5.55
+duration_seconds_count{operation="RunInstances"} 3
+`))
+	})
+
+	It("brings gauges up to date before each scrape", func() {
+		g := r.NewGauge("instances", "Instances.", "plan")
+		count := 0
+		r.OnCollect(func() {
+			count++
+			g.Reset()
+			g.Set(float64(count), "micro")
+		})
+		Expect(scrape()).To(ContainSubstring(`instances{plan="micro"} 1`))
+		Expect(scrape()).To(ContainSubstring(`instances{plan="micro"} 2`))
+	})
+})
@@ -1,41 +1,85 @@
 package service
 
 import (
+	"sync"
+
 	"github.com/pivotal-cf/brokerapi"
 
 	"github.com/GSA/ec2-broker/config"
 )
 
 var (
-	services []brokerapi.Service
+	// The catalog, and the configuration it was built from. It is rebuilt when a reload replaces the configuration.
+	services      []brokerapi.Service
+	servicesConf  *config.Config
+	servicesMutex sync.Mutex
 )
 
 /*
-GetServiceDescriptions provides a populated arraay of all the exisitng services, built from configuration files.
+GetServiceDescriptions provides a populated arraay of all the exisitng services, built from the current configuration.
 */
 func GetServiceDescriptions() ([]brokerapi.Service, error) {
-	if services != nil {
+	conf := config.GetConfiguration()
+	servicesMutex.Lock()
+	defer servicesMutex.Unlock()
+	if services != nil && servicesConf == conf {
 		return services, nil
 	}
-	conf := config.GetConfiguration()
-	plans := make([]brokerapi.ServicePlan, len(conf.Plans))
-	for i := 0; i < len(plans); i++ {
-		plans[i] = brokerapi.ServicePlan{
-			ID:          conf.Plans[i].ID,
-			Name:        conf.Plans[i].Name,
-			Description: conf.Plans[i].Description,
+	services = []brokerapi.Service{}
+	for _, service := range conf.ServiceConfigs() {
+		plans := make([]brokerapi.ServicePlan, len(service.Plans))
+		for i := 0; i < len(plans); i++ {
+			plans[i] = brokerapi.ServicePlan{
+				ID:          service.Plans[i].ID,
+				Name:        service.Plans[i].Name,
+				Description: service.Plans[i].Description,
+				Metadata:    planMetadata(&service.Plans[i]),
+			}
 		}
-	}
-	// TODO: Add metadata information in here.
-	services := []brokerapi.Service{
-		brokerapi.Service{
-			ID:            conf.ServiceID,
-			Name:          conf.ServiceName,
-			Description:   conf.ServiceDescription,
+		services = append(services, brokerapi.Service{
+			ID:            service.ID,
+			Name:          service.Name,
+			Description:   service.Description,
 			Bindable:      true,
-			PlanUpdatable: false,
+			Tags:          service.Tags,
+			PlanUpdatable: true,
 			Plans:         plans,
-		},
+			Metadata:      serviceMetadata(service.Metadata),
+		})
 	}
+	servicesConf = conf
 	return services, nil
 }
+
+// The catalog metadata of a service, or nil when none is configured
+func serviceMetadata(metadata config.ServiceMetadata) *brokerapi.ServiceMetadata {
+	if metadata == (config.ServiceMetadata{}) {
+		return nil
+	}
+	return &brokerapi.ServiceMetadata{
+		DisplayName:         metadata.DisplayName,
+		ImageUrl:            metadata.ImageURL,
+		LongDescription:     metadata.LongDescription,
+		ProviderDisplayName: metadata.ProviderDisplayName,
+		DocumentationUrl:    metadata.DocumentationURL,
+		SupportUrl:          metadata.SupportURL,
+	}
+}
+
+// The catalog metadata of a plan, with the specs of its instance type ahead of the bullets when asked for, or nil when
+// there is none
+func planMetadata(plan *config.PlanConfig) *brokerapi.ServicePlanMetadata {
+	bullets := []string{}
+	if spec, ok := config.InstanceSpecs(plan.InstanceType); ok && plan.Metadata.InstanceSpecs {
+		bullets = append(bullets, spec.Bullets()...)
+	}
+	bullets = append(bullets, plan.Metadata.Bullets...)
+	costs := make([]brokerapi.ServicePlanCost, len(plan.Metadata.Costs))
+	for i, cost := range plan.Metadata.Costs {
+		costs[i] = brokerapi.ServicePlanCost{Amount: cost.Amount, Unit: cost.Unit}
+	}
+	if plan.Metadata.DisplayName == "" && len(bullets) == 0 && len(costs) == 0 {
+		return nil
+	}
+	return &brokerapi.ServicePlanMetadata{DisplayName: plan.Metadata.DisplayName, Bullets: bullets, Costs: costs}
+}
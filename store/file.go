@@ -0,0 +1,164 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+FileStore keeps every instance in memory and writes the whole set out to a JSON file after each change. The file is
+replaced atomically, so a crash leaves either the old or the new contents behind.
+*/
+type FileStore struct {
+	path      string
+	mutex     sync.RWMutex
+	instances map[string]*Instance
+}
+
+/*
+NewFileStore opens the store at the given path, loading any existing contents
+*/
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:      path,
+		instances: make(map[string]*Instance),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &s.instances)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+/*
+NewMemoryStore builds a store which is never written to disk
+*/
+func NewMemoryStore() *FileStore {
+	return &FileStore{instances: make(map[string]*Instance)}
+}
+
+/*
+Get returns a copy of the instance, or ErrNotFound
+*/
+func (s *FileStore) Get(instanceID string) (*Instance, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	instance, ok := s.instances[instanceID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyInstance(instance), nil
+}
+
+/*
+Update applies fn to the stored instance, creating the instance if needed, and saves the result unless fn fails
+*/
+func (s *FileStore) Update(instanceID string, fn func(*Instance) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now().UTC()
+	instance, ok := s.instances[instanceID]
+	if ok {
+		instance = copyInstance(instance)
+	} else {
+		instance = &Instance{ID: instanceID, CreatedAt: now}
+	}
+	err := fn(instance)
+	if err != nil {
+		return err
+	}
+	instance.ID = instanceID
+	instance.UpdatedAt = now
+	previous := s.instances[instanceID]
+	s.instances[instanceID] = instance
+	err = s.save()
+	if err != nil {
+		// Keep memory consistent with what is on disk
+		if previous == nil {
+			delete(s.instances, instanceID)
+		} else {
+			s.instances[instanceID] = previous
+		}
+	}
+	return err
+}
+
+/*
+Delete removes the instance and everything recorded about it
+*/
+func (s *FileStore) Delete(instanceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous, ok := s.instances[instanceID]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.instances, instanceID)
+	err := s.save()
+	if err != nil {
+		s.instances[instanceID] = previous
+	}
+	return err
+}
+
+/*
+List returns copies of all instances, ordered by ID
+*/
+func (s *FileStore) List() ([]*Instance, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	instances := make([]*Instance, 0, len(s.instances))
+	for _, instance := range s.instances {
+		instances = append(instances, copyInstance(instance))
+	}
+	sort.Sort(byID(instances))
+	return instances, nil
+}
+
+// Orders instances by ID
+type byID []*Instance
+
+func (a byID) Len() int           { return len(a) }
+func (a byID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// Writes the instances to a temporary file next to the store and renames it into place. Callers hold the lock.
+func (s *FileStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.instances, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
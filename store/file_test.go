@@ -0,0 +1,104 @@
+package store_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/GSA/ec2-broker/store"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileStore", func() {
+	var (
+		dir  string
+		path string
+		s    *FileStore
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "store-test")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "state.json")
+		s, err = NewFileStore(path)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("returns ErrNotFound for unknown instances", func() {
+		_, err := s.Get("unknown")
+		Expect(err).To(Equal(ErrNotFound))
+		Expect(s.Delete("unknown")).To(Equal(ErrNotFound))
+	})
+
+	It("creates instances on update", func() {
+		err := s.Update("instance-1", func(i *Instance) error {
+			i.AWSInstanceID = "i-1"
+			i.AddOperation("provision", "in progress", "")
+			return nil
+		})
+		Expect(err).ToNot(HaveOccurred())
+		record, err := s.Get("instance-1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(record.ID).To(Equal("instance-1"))
+		Expect(record.AWSInstanceID).To(Equal("i-1"))
+		Expect(record.CreatedAt.IsZero()).To(BeFalse())
+		Expect(record.LastOperation("provision").State).To(Equal("in progress"))
+		Expect(record.LastOperation("deprovision")).To(BeNil())
+	})
+
+	It("leaves the instance untouched when the update fails", func() {
+		s.Update("instance-1", func(i *Instance) error {
+			i.PlanID = "plan-1"
+			return nil
+		})
+		err := s.Update("instance-1", func(i *Instance) error {
+			i.PlanID = "plan-2"
+			return errors.New("failed")
+		})
+		Expect(err).To(HaveOccurred())
+		record, _ := s.Get("instance-1")
+		Expect(record.PlanID).To(Equal("plan-1"))
+	})
+
+	It("does not share state with callers", func() {
+		s.Update("instance-1", func(i *Instance) error {
+			i.PlanID = "plan-1"
+			return nil
+		})
+		record, _ := s.Get("instance-1")
+		record.PlanID = "changed"
+		record, _ = s.Get("instance-1")
+		Expect(record.PlanID).To(Equal("plan-1"))
+	})
+
+	It("persists instances across reopening", func() {
+		s.Update("instance-1", func(i *Instance) error {
+			i.Bindings = map[string]Binding{"binding-1": {ID: "binding-1", Username: "ec2-user"}}
+			return nil
+		})
+		s.Update("instance-2", func(i *Instance) error { return nil })
+		Expect(s.Delete("instance-2")).To(Succeed())
+
+		reopened, err := NewFileStore(path)
+		Expect(err).ToNot(HaveOccurred())
+		instances, err := reopened.List()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(instances).To(HaveLen(1))
+		Expect(instances[0].Bindings).To(HaveKey("binding-1"))
+	})
+
+	It("does not write memory stores to disk", func() {
+		m := NewMemoryStore()
+		Expect(m.Update("instance-1", func(i *Instance) error { return nil })).To(Succeed())
+		instances, _ := m.List()
+		Expect(instances).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+/*
+Store records what the broker knows about each service instance, so that it does not depend solely on the instance's tags
+and on what DescribeInstances still returns. A record is deleted once the instance's deprovision succeeds.
+*/
+type Store interface {
+	// Get returns a copy of the instance, or ErrNotFound
+	Get(instanceID string) (*Instance, error)
+	// Update applies fn to the stored instance, creating the instance if needed, and saves the result unless fn fails
+	Update(instanceID string, fn func(*Instance) error) error
+	// Delete removes the instance and everything recorded about it
+	Delete(instanceID string) error
+	// List returns copies of all instances
+	List() ([]*Instance, error)
+}
+
+/*
+ErrNotFound is returned when the store has no record of an instance
+*/
+var ErrNotFound = errors.New("instance not found in store")
+
+/*
+Instance is the record kept for a single service instance
+*/
+type Instance struct {
+	ID               string             `json:"id"`
+	AWSInstanceID    string             `json:"aws_instance_id,omitempty"`
+	ServiceID        string             `json:"service_id,omitempty"`
+	PlanID           string             `json:"plan_id,omitempty"`
+	OrganizationGUID string             `json:"organization_guid,omitempty"`
+	SpaceGUID        string             `json:"space_guid,omitempty"`
+	Name             string             `json:"name,omitempty"`
+	OrganizationName string             `json:"organization_name,omitempty"`
+	SpaceName        string             `json:"space_name,omitempty"`
+	Parameters       json.RawMessage    `json:"parameters,omitempty"`
+	AWSState         string             `json:"aws_state,omitempty"`
+	Operations       []Operation        `json:"operations,omitempty"`
+	Bindings         map[string]Binding `json:"bindings,omitempty"`
+	CreatedAt        time.Time          `json:"created_at"`
+	UpdatedAt        time.Time          `json:"updated_at"`
+}
+
+/*
+Operation is an entry in the operation history of an instance. Detail is a fixed note about the operation, such as the AMI
+a provision resolved its image to, which is reported along with each description.
+*/
+type Operation struct {
+	Type        string    `json:"type"`
+	State       string    `json:"state"`
+	Step        string    `json:"step,omitempty"`
+	PlanID      string    `json:"plan_id,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+/*
+Binding records a binding to an instance. The credentials themselves are never stored.
+*/
+type Binding struct {
+	ID          string    `json:"id"`
+	AppGUID     string    `json:"app_guid,omitempty"`
+	Username    string    `json:"username"`
+	Fingerprint string    `json:"fingerprint"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+/*
+AddOperation appends a new operation to the instance's history, returning it so multi-step operations can set their step
+*/
+func (i *Instance) AddOperation(operationType, state, description string) *Operation {
+	now := time.Now().UTC()
+	i.Operations = append(i.Operations, Operation{
+		Type:        operationType,
+		State:       state,
+		Description: description,
+		StartedAt:   now,
+		UpdatedAt:   now,
+	})
+	return &i.Operations[len(i.Operations)-1]
+}
+
+/*
+LastOperation returns the most recent operation of the given type, or nil if there has not been one
+*/
+func (i *Instance) LastOperation(operationType string) *Operation {
+	for j := len(i.Operations) - 1; j >= 0; j-- {
+		if i.Operations[j].Type == operationType {
+			return &i.Operations[j]
+		}
+	}
+	return nil
+}
+
+/*
+SetStep moves a multi-step operation on to its next step
+*/
+func (o *Operation) SetStep(step, description string) {
+	o.Step = step
+	o.Description = description
+	o.UpdatedAt = time.Now().UTC()
+}
+
+/*
+SetState updates the state and description of the operation
+*/
+func (o *Operation) SetState(state, description string) {
+	o.State = state
+	o.Description = description
+	o.UpdatedAt = time.Now().UTC()
+}
+
+// Deep copies an instance through JSON so callers never share state with the store
+func copyInstance(i *Instance) *Instance {
+	data, _ := json.Marshal(i)
+	c := &Instance{}
+	json.Unmarshal(data, c)
+	return c
+}
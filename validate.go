@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/GSA/ec2-broker/broker"
+	"github.com/GSA/ec2-broker/config"
+)
+
+// Runs the validate-config subcommand, which checks the configuration, loaded just as the broker loads it, for CI and
+// exits non-zero if it has problems. With -online it also checks that the AWS resources it names exist.
+func validateConfig(args []string) int {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	filename := flags.String("config", "", "the configuration file to check (EC2_BROKER_CONFIG, or config.json if it exists, by default)")
+	online := flags.Bool("online", false, "check that the AMIs, subnets, security groups and key pair exist in the region")
+	flags.Parse(args)
+
+	conf, err := config.Load(*filename, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	problems := conf.Validate()
+	if problems == nil && *online {
+		m, err := broker.NewAWSManager(nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		problems = broker.ValidateResources(m, conf)
+	}
+	if problems != nil {
+		fmt.Fprintln(os.Stderr, problems)
+		return 1
+	}
+	fmt.Println("configuration ok")
+	return 0
+}